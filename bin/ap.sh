@@ -36,6 +36,18 @@ fi
 
 DEFAULT_ACCESS_POINT_INTERFACE="ap0"
 
+# The management service surveys the spectrum and selects the least
+# busy channel right before it starts us, either as configured or to
+# avoid a DFS channel radar was detected on.
+auto_channel=false
+if [ "$WIFI_CHANNEL" = "auto" ] || [ -e $SNAP_DATA/auto-channel ] ; then
+	auto_channel=true
+	if ! read WIFI_CHANNEL < $SNAP_DATA/auto-channel ; then
+		echo "ERROR: No channel was selected automatically"
+		exit 1
+	fi
+fi
+
 # Make sure the configured WiFi interface is really available before
 # doing anything.
 if ! ifconfig $WIFI_INTERFACE ; then
@@ -61,14 +73,22 @@ cleanup_on_exit() {
 	if [ "$WIFI_INTERFACE_MODE" = "virtual" ] ; then
 		iface=$DEFAULT_ACCESS_POINT_INTERFACE
 	fi
+	network=$iface
+	if [ "$RADIO2_DISABLED" = "false" ] ; then
+		network=$DUAL_BAND_BRIDGE
+	fi
 
 	if [ $SHARE_DISABLED = "false" ] ; then
 		# flush forwarding rules out
 		iptables --table nat --delete POSTROUTING --out-interface $SHARE_NETWORK_INTERFACE -j MASQUERADE
-		iptables --delete FORWARD --in-interface $iface -j ACCEPT
+		iptables --delete FORWARD --in-interface $network -j ACCEPT
 		sysctl -w net.ipv4.ip_forward=0
 	fi
 
+	if [ "$RADIO2_DISABLED" = "false" ] ; then
+		ip link delete $DUAL_BAND_BRIDGE type bridge
+	fi
+
 	if is_nm_running ; then
 		# Hand interface back to network-manager. This will also trigger the
 		# auto connection process inside network-manager to get connected
@@ -98,6 +118,8 @@ if [ "$WIFI_INTERFACE_MODE" = "virtual" ] ; then
 		echo "         which channel we can use for the AP. This will most"
 		echo "         likely lead to failed connections when the STA gets"
 		echo "         connected."
+	elif [ "$auto_channel" = "true" ] ; then
+		WIFI_CHANNEL=$channel_in_use
 	elif [ "$channel_in_use" != "$WIFI_CHANNEL" ] ; then
 		echo "ERROR: You configured a different channel than the WiFi device"
 		echo "       is currently using. This will not work as most devices"
@@ -149,14 +171,26 @@ if [ $? -ne 0 ] ; then
 	exit 1
 fi
 
+# With a second radio both access points join a bridge which carries
+# the address of the network. hostapd adds the interfaces to it and
+# radio.sh waits for it to show up.
+network=$iface
+if [ "$RADIO2_DISABLED" = "false" ] ; then
+	network=$DUAL_BAND_BRIDGE
+	if ! does_interface_exist $network ; then
+		ip link add name $network type bridge
+	fi
+	ifconfig $network up
+fi
+
 # Configure interface and give it a moment to settle
-ifconfig $iface $WIFI_ADDRESS netmask $WIFI_NETMASK
+ifconfig $network $WIFI_ADDRESS netmask $WIFI_NETMASK
 sleep 2
 
 if [ $SHARE_DISABLED = "false" ] ; then
 	# Enable NAT to forward our network connection
 	iptables --table nat --append POSTROUTING --out-interface $SHARE_NETWORK_INTERFACE -j MASQUERADE
-	iptables --append FORWARD --in-interface $iface -j ACCEPT
+	iptables --append FORWARD --in-interface $network -j ACCEPT
 	sysctl -w net.ipv4.ip_forward=1
 fi
 
@@ -169,90 +203,11 @@ $SNAP/bin/dnsmasq \
 	-u root -g root \
 	&
 
-driver=$WIFI_HOSTAPD_DRIVER
-
 # Generate our hostapd configuration file
-cat <<EOF > $SNAP_DATA/hostapd.conf
-interface=$iface
-driver=$driver
-channel=$WIFI_CHANNEL
-macaddr_acl=0
-ignore_broadcast_ssid=0
-ieee80211n=1
-ssid=$WIFI_SSID
-auth_algs=1
-utf8_ssid=1
-hw_mode=$WIFI_OPERATION_MODE
-# DTIM 3 is a good tradeoff between powersave and latency
-dtim_period=3
-
-# The wmm_* options are needed to enable AMPDU
-# and get decent 802.11n throughput
-# UAPSD is for stations powersave
-uapsd_advertisement_enabled=1
-wmm_enabled=1
-wmm_ac_bk_cwmin=4
-wmm_ac_bk_cwmax=10
-wmm_ac_bk_aifs=7
-wmm_ac_bk_txop_limit=0
-wmm_ac_bk_acm=0
-wmm_ac_be_aifs=3
-wmm_ac_be_cwmin=4
-wmm_ac_be_cwmax=10
-wmm_ac_be_txop_limit=0
-wmm_ac_be_acm=0
-wmm_ac_vi_aifs=2
-wmm_ac_vi_cwmin=3
-wmm_ac_vi_cwmax=4
-wmm_ac_vi_txop_limit=94
-wmm_ac_vi_acm=0
-wmm_ac_vo_aifs=2
-wmm_ac_vo_cwmin=2
-wmm_ac_vo_cwmax=3
-wmm_ac_vo_txop_limit=47
-wmm_ac_vo_acm=0
-EOF
-
-if [ -n "$WIFI_COUNTRY_CODE" ] ; then
-	cat <<-EOF >> $SNAP_DATA/hostapd.conf
-	# Regulatory domain options
-	country_code=$WIFI_COUNTRY_CODE
-	# Send country code in beacon frames
-	ieee80211d=1
-	# Enable radar detection
-	ieee80211h=1
-	# Send power constraint IE, 3dB below maximum allowed transmit power
-	local_pwr_constraint=3
-	# End reg domain options
-	EOF
-else
-	cat <<-EOF >> $SNAP_DATA/hostapd.conf
-	# Regulatory domain options
-	# Country code set to global
-	country_code=XX
-	# End reg domain options
-	EOF
+if ! generate_hostapd_config $iface $WIFI_CHANNEL > $SNAP_DATA/hostapd.conf ; then
+	exit 1
 fi
 
-case "$WIFI_SECURITY" in
-	open)
-		cat <<-EOF >> $SNAP_DATA/hostapd.conf
-		EOF
-		;;
-	wpa2)
-		cat <<-EOF >> $SNAP_DATA/hostapd.conf
-		wpa=2
-		wpa_key_mgmt=WPA-PSK
-		wpa_passphrase=$WIFI_SECURITY_PASSPHRASE
-		wpa_pairwise=TKIP
-		rsn_pairwise=CCMP
-		EOF
-		;;
-	*)
-		echo "Unsupported WiFi security '$WIFI_SECURITY' selected"
-		exit 1
-esac
-
 EXTRA_ARGS=
 if [ "$DEBUG" = "true" ] ; then
 	EXTRA_ARGS="$EXTRA_ARGS -ddd -t"
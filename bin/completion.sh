@@ -0,0 +1,57 @@
+# -*- sh -*-
+#
+# Copyright (C) 2017 Canonical Ltd
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU General Public License version 3 as
+# published by the Free Software Foundation.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU General Public License for more details.
+#
+# You should have received a copy of the GNU General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+# Bash completion for the wifi-ap commands. Candidates are provided by
+# the client itself which asks the service for configuration items and
+# their allowed values.
+
+_wifi_ap_complete() {
+	local command
+	case "${COMP_WORDS[0]}" in
+		*.config) command=config ;;
+		*.status) command=status ;;
+		*) return ;;
+	esac
+
+	# Bash splits key=value arguments at the '=' so the words are taken
+	# from the command line instead.
+	local line="${COMP_LINE:0:$COMP_POINT}"
+	local -a words
+	read -ra words <<< "$line"
+	if [ "${line: -1}" = " " ]; then
+		words+=("")
+	fi
+
+	# Only the part of the last word after a '=' gets replaced
+	local last="${words[${#words[@]}-1]}"
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	if [ "$cur" = "=" ]; then
+		cur=""
+	fi
+	local prefix="${last:0:${#last}-${#cur}}"
+
+	local IFS=$'\n'
+	local candidate
+	COMPREPLY=()
+	for candidate in $(GO_FLAGS_COMPLETION=1 "$SNAP/bin/client" "$command" "${words[@]:1}"); do
+		COMPREPLY+=("${candidate#$prefix}")
+		if [ "${candidate: -1}" = "=" ]; then
+			compopt -o nospace
+		fi
+	done
+}
+
+complete -F _wifi_ap_complete wifi-ap.config wifi-ap.status
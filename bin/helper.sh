@@ -14,6 +14,10 @@
 # You should have received a copy of the GNU General Public License
 # along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+# Bridge joining the access points of both radios into one network.
+# Has to match dualBandBridge of the service.
+DUAL_BAND_BRIDGE=apbr0
+
 does_interface_exist() {
 	[ -d /sys/class/net/$1 ]
 }
@@ -38,6 +42,9 @@ generate_dnsmasq_config() {
 	if [ "$WIFI_INTERFACE_MODE" = "virtual" ] ; then
 		iface=$DEFAULT_ACCESS_POINT_INTERFACE
 	fi
+	if [ "$RADIO2_DISABLED" = "false" ] ; then
+		iface=$DUAL_BAND_BRIDGE
+	fi
 
 	cat<<-EOF
 	port=53
@@ -53,6 +60,183 @@ generate_dnsmasq_config() {
 	} > $1
 }
 
+# Prints whether the secondary channel of a 40 MHz wide channel lies
+# above or below the given primary channel. The pairs of channels are
+# fixed on 5 GHz. Has to match secondaryChannelAbove of the service.
+secondary_channel_position() {
+	if [ "$WIFI_OPERATION_MODE" = "a" ] ; then
+		first=36
+		if [ $1 -ge 149 ] ; then
+			first=149
+		fi
+		if [ $(( ($1 - first) / 4 % 2 )) -eq 0 ] ; then
+			echo above
+		else
+			echo below
+		fi
+	elif [ "$WIFI_SECONDARY_CHANNEL" = "auto" ] ; then
+		if [ $1 -le 7 ] ; then
+			echo above
+		else
+			echo below
+		fi
+	else
+		echo $WIFI_SECONDARY_CHANNEL
+	fi
+}
+
+# Prints the center channel of the 80 or 160 MHz wide channel on 5 GHz
+# the given primary channel belongs to. Has to match centerChannel of
+# the service.
+center_channel() {
+	if [ "$WIFI_CENTER_CHANNEL" != "auto" ] ; then
+		echo $WIFI_CENTER_CHANNEL
+		return
+	fi
+	first=36
+	if [ $1 -ge 149 ] ; then
+		first=149
+	fi
+	count=$(( $2 / 20 ))
+	echo $(( first + ($1 - first) / (count * 4) * (count * 4) + (count - 1) * 2 ))
+}
+
+# Prints the hostapd options for 802.11n/ac with the configured
+# channel width for the given primary channel
+generate_throughput_config() {
+	if [ "$WIFI_IEEE80211N" = "true" ] ; then
+		ht_capab=
+		if [ $WIFI_CHANNEL_WIDTH -ge 40 ] ; then
+			if [ "$(secondary_channel_position $1)" = "above" ] ; then
+				ht_capab="[HT40+]"
+			else
+				ht_capab="[HT40-]"
+			fi
+		fi
+		echo "ieee80211n=1"
+		if [ -n "$ht_capab$WIFI_HT_CAPABILITIES" ] ; then
+			echo "ht_capab=$ht_capab$WIFI_HT_CAPABILITIES"
+		fi
+	fi
+
+	chwidth=0
+	case "$WIFI_CHANNEL_WIDTH" in
+		80)
+			chwidth=1
+			;;
+		160)
+			chwidth=2
+			;;
+	esac
+	center=
+	if [ $chwidth -gt 0 ] ; then
+		center=$(center_channel $1 $WIFI_CHANNEL_WIDTH)
+	fi
+
+	if [ "$WIFI_IEEE80211AC" = "true" ] ; then
+		echo "ieee80211ac=1"
+		if [ -n "$WIFI_VHT_CAPABILITIES" ] ; then
+			echo "vht_capab=$WIFI_VHT_CAPABILITIES"
+		fi
+		echo "vht_oper_chwidth=$chwidth"
+		if [ -n "$center" ] ; then
+			echo "vht_oper_centr_freq_seg0_idx=$center"
+		fi
+	fi
+}
+
+# Prints the hostapd configuration of an access point on the given
+# interface and channel with the WIFI_* settings. With a second radio
+# hostapd adds the interface to the bridge joining both.
+generate_hostapd_config() {
+	cat <<-EOF
+	interface=$1
+	driver=$WIFI_HOSTAPD_DRIVER
+	# Control interface used by the management service to query the AP state
+	ctrl_interface=$SNAP_DATA/hostapd
+	channel=$2
+	macaddr_acl=0
+	ignore_broadcast_ssid=0
+	ssid=$WIFI_SSID
+	auth_algs=1
+	utf8_ssid=1
+	hw_mode=$WIFI_OPERATION_MODE
+	# DTIM 3 is a good tradeoff between powersave and latency
+	dtim_period=3
+
+	# The wmm_* options are needed to enable AMPDU
+	# and get decent 802.11n throughput
+	# UAPSD is for stations powersave
+	uapsd_advertisement_enabled=1
+	wmm_enabled=1
+	wmm_ac_bk_cwmin=4
+	wmm_ac_bk_cwmax=10
+	wmm_ac_bk_aifs=7
+	wmm_ac_bk_txop_limit=0
+	wmm_ac_bk_acm=0
+	wmm_ac_be_aifs=3
+	wmm_ac_be_cwmin=4
+	wmm_ac_be_cwmax=10
+	wmm_ac_be_txop_limit=0
+	wmm_ac_be_acm=0
+	wmm_ac_vi_aifs=2
+	wmm_ac_vi_cwmin=3
+	wmm_ac_vi_cwmax=4
+	wmm_ac_vi_txop_limit=94
+	wmm_ac_vi_acm=0
+	wmm_ac_vo_aifs=2
+	wmm_ac_vo_cwmin=2
+	wmm_ac_vo_cwmax=3
+	wmm_ac_vo_txop_limit=47
+	wmm_ac_vo_acm=0
+	EOF
+
+	if [ "$RADIO2_DISABLED" = "false" ] ; then
+		echo "bridge=$DUAL_BAND_BRIDGE"
+	fi
+
+	generate_throughput_config $2
+
+	if [ -n "$WIFI_COUNTRY_CODE" ] ; then
+		cat <<-EOF
+		# Regulatory domain options
+		country_code=$WIFI_COUNTRY_CODE
+		# Send country code in beacon frames
+		ieee80211d=1
+		# Enable radar detection
+		ieee80211h=1
+		# Send power constraint IE, 3dB below maximum allowed transmit power
+		local_pwr_constraint=3
+		# End reg domain options
+		EOF
+	else
+		cat <<-EOF
+		# Regulatory domain options
+		# No country code set, the world regulatory domain of the kernel
+		# applies. The management service only allows channels usable
+		# everywhere then.
+		# End reg domain options
+		EOF
+	fi
+
+	case "$WIFI_SECURITY" in
+		open)
+			;;
+		wpa2)
+			cat <<-EOF
+			wpa=2
+			wpa_key_mgmt=WPA-PSK
+			wpa_passphrase=$WIFI_SECURITY_PASSPHRASE
+			wpa_pairwise=TKIP
+			rsn_pairwise=CCMP
+			EOF
+			;;
+		*)
+			echo "Unsupported WiFi security '$WIFI_SECURITY' selected" >&2
+			return 1
+	esac
+}
+
 is_nm_running() {
 	nm_status=`$SNAP/bin/nmcli -t -f RUNNING general`
 	[ "$nm_status" = "running" ]
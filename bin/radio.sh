@@ -0,0 +1,111 @@
+#!/bin/bash
+#
+# Copyright (C) 2017 Canonical Ltd
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU General Public License version 3 as
+# published by the Free Software Foundation.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU General Public License for more details.
+#
+# You should have received a copy of the GNU General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+# Operates the access point on the second radio of dual-band setups.
+# It joins the bridge ap.sh creates and shares SSID, security, DHCP and
+# connection sharing with the access point of ap.sh.
+
+if [ $(id -u) -ne 0 ] ; then
+	echo "ERROR: $0 needs to be executed as root!"
+	exit 1
+fi
+
+. $SNAP/bin/config-internal.sh
+
+if [ $DEBUG = "true" ]; then
+	set -x
+fi
+
+. $SNAP/bin/helper.sh
+
+if [ $DISABLED = "true" ] || [ $RADIO2_DISABLED = "true" ] ; then
+	echo "Not starting as the second radio is disabled"
+	exit 0
+fi
+
+# The radio has its own interface, channel and band, everything else
+# is shared with the access point of ap.sh
+WIFI_INTERFACE=$RADIO2_INTERFACE
+WIFI_CHANNEL=$RADIO2_CHANNEL
+WIFI_OPERATION_MODE=$RADIO2_OPERATION_MODE
+WIFI_CHANNEL_WIDTH=$RADIO2_CHANNEL_WIDTH
+WIFI_IEEE80211AC=$RADIO2_IEEE80211AC
+WIFI_SECONDARY_CHANNEL="auto"
+WIFI_CENTER_CHANNEL="auto"
+# The capabilities describe the device of the first radio, not this one
+WIFI_HT_CAPABILITIES=""
+WIFI_VHT_CAPABILITIES=""
+
+# The management service selects the channel like for ap.sh
+if [ "$WIFI_CHANNEL" = "auto" ] || [ -e $SNAP_DATA/auto-channel-radio2 ] ; then
+	if ! read WIFI_CHANNEL < $SNAP_DATA/auto-channel-radio2 ; then
+		echo "ERROR: No channel was selected automatically"
+		exit 1
+	fi
+fi
+
+if ! ifconfig $WIFI_INTERFACE ; then
+	echo "ERROR: WiFi interface $WIFI_INTERFACE is not available!"
+	exit 1
+fi
+
+cleanup_on_exit() {
+	read HOSTAPD_PID <$SNAP_DATA/hostapd-radio2.pid
+	if [ -n "$HOSTAPD_PID" ] ; then
+		kill -TERM $HOSTAPD_PID || true
+		wait $HOSTAPD_PID
+	fi
+
+	if is_nm_running ; then
+		$SNAP/bin/nmcli d set $WIFI_INTERFACE managed yes
+	fi
+}
+
+trap cleanup_on_exit TERM
+
+assert_not_managed_by_ifupdown $WIFI_INTERFACE
+
+if is_nm_running ; then
+	$SNAP/bin/nmcli d set $WIFI_INTERFACE managed no
+fi
+
+if ! ifconfig $WIFI_INTERFACE up ; then
+	echo "ERROR: Failed to enable WiFi network interface '$WIFI_INTERFACE'"
+	if is_nm_running ; then
+		$SNAP/bin/nmcli d set $WIFI_INTERFACE managed yes
+	fi
+	exit 1
+fi
+
+# ap.sh creates the bridge before it starts its hostapd
+wait_until_interface_is_available $DUAL_BAND_BRIDGE
+
+if ! generate_hostapd_config $WIFI_INTERFACE $WIFI_CHANNEL > $SNAP_DATA/hostapd-radio2.conf ; then
+	exit 1
+fi
+
+EXTRA_ARGS=
+if [ "$DEBUG" = "true" ] ; then
+	EXTRA_ARGS="$EXTRA_ARGS -ddd -t"
+fi
+
+$SNAP/bin/hostapd $EXTRA_ARGS $SNAP_DATA/hostapd-radio2.conf &
+hostapd_pid=$!
+echo $hostapd_pid > $SNAP_DATA/hostapd-radio2.pid
+wait $hostapd_pid
+
+cleanup_on_exit
+exit 0
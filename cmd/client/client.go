@@ -16,19 +16,33 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
 	socketPathSuffix   = "sockets/control"
 	configurationV1Uri = "/v1/configuration"
 	statusV1Uri        = "/v1/status"
+	healthV1Uri        = "/v1/health"
+	historyV1Uri       = "/v1/configuration/history"
+	profilesV1Uri      = "/v1/profiles"
+	changesV1Uri       = "/v1/changes"
+	schemaV1Uri        = "/v1/schema"
+	scanV1Uri          = "/v1/scan"
+	regulatoryV1Uri    = "/v1/regulatory"
+	hardwareV1Uri      = "/v1/hardware"
+	eventsV1Uri        = "/v1/events"
 )
 
 type serviceResponse struct {
@@ -46,6 +60,42 @@ func getServiceStatusURI() string {
 	return fmt.Sprintf("http://unix%s", statusV1Uri)
 }
 
+func getServiceHistoryURI() string {
+	return fmt.Sprintf("http://unix%s", historyV1Uri)
+}
+
+func getServiceProfilesURI() string {
+	return fmt.Sprintf("http://unix%s", profilesV1Uri)
+}
+
+func getServiceHealthURI() string {
+	return fmt.Sprintf("http://unix%s", healthV1Uri)
+}
+
+func getServiceChangesURI() string {
+	return fmt.Sprintf("http://unix%s", changesV1Uri)
+}
+
+func getServiceSchemaURI() string {
+	return fmt.Sprintf("http://unix%s", schemaV1Uri)
+}
+
+func getServiceScanURI() string {
+	return fmt.Sprintf("http://unix%s", scanV1Uri)
+}
+
+func getServiceRegulatoryURI() string {
+	return fmt.Sprintf("http://unix%s", regulatoryV1Uri)
+}
+
+func getServiceHardwareURI() string {
+	return fmt.Sprintf("http://unix%s", hardwareV1Uri)
+}
+
+func getServiceEventsURI() string {
+	return fmt.Sprintf("http://unix%s", eventsV1Uri)
+}
+
 type doer interface {
 	Do(*http.Request) (*http.Response, error)
 }
@@ -57,19 +107,62 @@ func unixDialer(_, _ string) (net.Conn, error) {
 	return net.Dial("unix", path)
 }
 
+// remoteTLSConfig returns the TLS configuration used to talk to the
+// service of a remote device.
+func remoteTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(options.CACert) > 0 {
+		ca, err := ioutil.ReadFile(options.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", options.CACert)
+		}
+	}
+
+	if len(options.Cert) > 0 {
+		cert, err := tls.LoadX509KeyPair(options.Cert, options.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 func sendHTTPRequest(uri string, method string, body io.Reader) (*serviceResponse, error) {
 	req, err := http.NewRequest(method, uri, body)
 	if err != nil {
 		return nil, err
 	}
 
+	transport := &http.Transport{
+		Dial: unixDialer,
+	}
+
+	// Requests for remote devices go over TLS instead of the socket
+	if len(options.Host) > 0 {
+		req.URL.Scheme = "https"
+		req.URL.Host = options.Host
+		req.Host = options.Host
+		req.Header.Set("Authorization", "Bearer "+options.Token)
+
+		config, err := remoteTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{TLSClientConfig: config}
+	}
+
 	var resp *http.Response
 
 	if customDoer == nil {
 		client := &http.Client{
-			Transport: &http.Transport{
-				Dial: unixDialer,
-			},
+			Transport: transport,
 		}
 		resp, err = client.Do(req)
 	} else {
@@ -87,9 +180,73 @@ func sendHTTPRequest(uri string, method string, body io.Reader) (*serviceRespons
 		return nil, err
 	}
 
-	if realResponse.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed: %s", realResponse.Result["message"])
+	switch realResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted:
+		return waitForChange(realResponse)
+	default:
+		return nil, newServiceError(realResponse)
 	}
 
 	return realResponse, nil
 }
+
+// Interval in which we ask the service about the progress of a change
+var changePollInterval = 500 * time.Millisecond
+
+// Where the progress of changes is shown
+var progressOutput io.Writer = os.Stderr
+
+// waitForChange follows the change the service started for an async
+// response until it is ready and returns its result like the service
+// would have returned it for a sync request.
+func waitForChange(response *serviceResponse) (*serviceResponse, error) {
+	id := fmt.Sprint(response.Result["change"])
+	if options.NoWait {
+		if options.Format == formatTable {
+			fmt.Fprintf(os.Stdout, "Change %s started\n", id)
+		}
+		return response, nil
+	}
+
+	label := ""
+	for {
+		response, err := sendHTTPRequest(getServiceChangesURI()+"/"+id, "GET", nil)
+		if err != nil {
+			return nil, err
+		}
+		change := response.Result
+
+		// Show every step once, counting the one in progress
+		progress, _ := change["progress"].(map[string]interface{})
+		if current, _ := progress["label"].(string); len(current) > 0 && current != label {
+			label = current
+			done, _ := progress["done"].(float64)
+			total, _ := progress["total"].(float64)
+			fmt.Fprintf(progressOutput, "[%d/%d] %s\n", int(math.Min(done+1, total)), int(total), label)
+		}
+
+		switch change["status"] {
+		case "Done":
+			result, _ := change["result"].(map[string]interface{})
+			if result == nil {
+				result = map[string]interface{}{}
+			}
+			return &serviceResponse{
+				Result:     result,
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Type:       "sync",
+			}, nil
+		case "Error":
+			failure, _ := change["err"].(map[string]interface{})
+			return nil, newServiceError(&serviceResponse{
+				Result:     failure,
+				StatusCode: http.StatusInternalServerError,
+				Type:       "error",
+			})
+		}
+
+		time.Sleep(changePollInterval)
+	}
+}
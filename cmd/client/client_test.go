@@ -21,9 +21,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
+	"github.com/jessevdk/go-flags"
 	"gopkg.in/check.v1"
 )
 
@@ -33,6 +38,7 @@ func Test(t *testing.T) { check.TestingT(t) }
 type ClientSuite struct {
 	req     *http.Request
 	rsp     string
+	rsps    []string
 	err     error
 	doCalls int
 	header  http.Header
@@ -44,6 +50,7 @@ var _ = check.Suite(&ClientSuite{})
 func (s *ClientSuite) SetUpTest(c *check.C) {
 	s.req = nil
 	s.rsp = ""
+	s.rsps = nil
 	s.err = nil
 	s.doCalls = 0
 	s.header = nil
@@ -56,8 +63,13 @@ func (s *ClientSuite) SetUpTest(c *check.C) {
 
 func (s *ClientSuite) Do(req *http.Request) (*http.Response, error) {
 	s.req = req
+	// Queued responses are returned in order before the default one
+	body := s.rsp
+	if len(s.rsps) > 0 {
+		body, s.rsps = s.rsps[0], s.rsps[1:]
+	}
 	rsp := &http.Response{
-		Body:       ioutil.NopCloser(strings.NewReader(s.rsp)),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
 		Header:     s.header,
 		StatusCode: s.status,
 	}
@@ -106,6 +118,121 @@ func (s *ClientSuite) TestSendHTTPRequestErrorFromService(c *check.C) {
 	c.Assert(s.req.Method, check.Equals, "GET")
 }
 
+func (s *ClientSuite) TestSendHTTPRequestReturnsServiceError(c *check.C) {
+	s.rsp = `{"result":{"kind":"invalid-value","message":"Invalid configuration","details":{"wifi.channel":"must be a number"}},"status":"Bad Request","status-code":400,"type":"error"}`
+	_, err := sendHTTPRequest(getServiceConfigurationURI(), "PUT", nil)
+	c.Assert(err, check.DeepEquals, &serviceError{
+		StatusCode: 400,
+		Kind:       "invalid-value",
+		Message:    "Invalid configuration",
+		Details:    map[string]interface{}{"wifi.channel": "must be a number"},
+	})
+	c.Assert(err.Error(), check.Equals, "Failed: Invalid configuration")
+}
+
+func (s *ClientSuite) TestDescribeError(c *check.C) {
+	for _, t := range []struct {
+		err     error
+		message string
+		code    int
+	}{
+		{fmt.Errorf("usage: foo"), "usage: foo", exitFailure},
+		{&flags.Error{Type: flags.ErrUnknownCommand, Message: "Unknown command"}, "Unknown command", exitUsage},
+		{&serviceError{Kind: "invalid-key", Message: `Invalid key "foo"`},
+			"Invalid key \"foo\"\nRun 'wifi-ap.config get' to see all valid configuration items.", exitInvalidRequest},
+		{&serviceError{Kind: "invalid-value", Message: "Invalid a", Details: map[string]interface{}{"b": "Invalid b", "a": "Invalid a"}},
+			"Invalid a\n  a: Invalid a\n  b: Invalid b", exitInvalidRequest},
+		{&serviceError{Kind: "not-found", Message: "Profile does not exist"}, "Profile does not exist", exitNotFound},
+		{&serviceError{Kind: "conflict", Message: "Busy"}, "Busy\nWait for the other change to finish and try again.", exitConflict},
+		{&serviceError{Kind: "ap-start-failed", Message: "Down"},
+			"Down\nCheck 'wifi-ap.status' and the logs of the management-service for details.", exitApStartFailed},
+		{&serviceError{Kind: "unauthorized", Message: "Denied"}, "Denied\nRun the command as root, for example with sudo, or ask for access to the service.", exitUnauthorized},
+		{&serviceError{Kind: "locked-key", Message: `Configuration item "wifi.channel" is locked`},
+			"Configuration item \"wifi.channel\" is locked\nThe item is locked through the locked-keys option of the snap, usually by the image. Remove it from there with 'snap set wifi-ap locked-keys=...' to change it.", exitUnauthorized},
+		{&serviceError{Kind: "internal-error", Message: "Oops"}, "Oops", exitFailure},
+	} {
+		message, code := describeError(t.err)
+		c.Assert(message, check.Equals, t.message)
+		c.Assert(code, check.Equals, t.code)
+	}
+
+	_, code := describeError(&url.Error{Op: "Get", URL: "http://unix/v1/status", Err: fmt.Errorf("no such file")})
+	c.Assert(code, check.Equals, exitServiceUnavailable)
+}
+
+func (s *ClientSuite) TestSendHTTPRequestToRemoteHost(c *check.C) {
+	defer func() { options = commonOptions{} }()
+	options.Host = "ap.example.com:8443"
+	options.Token = "secret"
+
+	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
+	_, err := sendHTTPRequest(getServiceStatusURI(), "GET", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.req.URL.String(), check.Equals, "https://ap.example.com:8443/v1/status")
+	c.Assert(s.req.Header.Get("Authorization"), check.Equals, "Bearer secret")
+
+	options.CACert = filepath.Join(c.MkDir(), "missing.crt")
+	_, err = sendHTTPRequest(getServiceStatusURI(), "GET", nil)
+	c.Assert(err, check.NotNil)
+	c.Assert(s.doCalls, check.Equals, 1)
+}
+
+func (s *ClientSuite) TestSendHTTPRequestWaitsForChange(c *check.C) {
+	changePollInterval = 0
+	var progress bytes.Buffer
+	progressOutput = &progress
+	defer func() { progressOutput = os.Stderr }()
+
+	s.rsps = []string{
+		`{"result":{"change":3},"status":"Accepted","status-code":202,"type":"async"}`,
+		`{"result":{"id":3,"status":"Doing","progress":{"label":"Write configuration","done":0,"total":3}},"status":"OK","status-code":200,"type":"sync"}`,
+		`{"result":{"id":3,"status":"Doing","progress":{"label":"Restart access point","done":1,"total":3}},"status":"OK","status-code":200,"type":"sync"}`,
+	}
+	s.rsp = `{"result":{"id":3,"status":"Done","progress":{"label":"Restart access point","done":3,"total":3},"result":{"changed":["wifi.ssid"]}},"status":"OK","status-code":200,"type":"sync"}`
+
+	rsp, err := sendHTTPRequest(getServiceConfigurationURI(), "POST", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.Result, check.DeepEquals, map[string]interface{}{"changed": []interface{}{"wifi.ssid"}})
+	c.Assert(s.doCalls, check.Equals, 4)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/changes/3")
+	c.Assert(progress.String(), check.Equals, "[1/3] Write configuration\n[2/3] Restart access point\n")
+}
+
+func (s *ClientSuite) TestSendHTTPRequestReturnsChangeError(c *check.C) {
+	changePollInterval = 0
+	progressOutput = ioutil.Discard
+	defer func() { progressOutput = os.Stderr }()
+
+	s.rsps = []string{`{"result":{"change":4},"status":"Accepted","status-code":202,"type":"async"}`}
+	s.rsp = `{"result":{"id":4,"status":"Error","err":{"message":"AP did not come up","kind":"ap-start-failed"}},"status":"OK","status-code":200,"type":"sync"}`
+
+	_, err := sendHTTPRequest(getServiceStatusURI(), "POST", nil)
+	c.Assert(err, check.ErrorMatches, "Failed: AP did not come up")
+	_, code := describeError(err)
+	c.Assert(code, check.Equals, exitApStartFailed)
+}
+
+func (s *ClientSuite) TestSendHTTPRequestNoWait(c *check.C) {
+	defer func() { options = commonOptions{} }()
+	options.NoWait = true
+
+	s.rsp = `{"result":{"change":5},"status":"Accepted","status-code":202,"type":"async"}`
+	rsp, err := sendHTTPRequest(getServiceStatusURI(), "POST", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.Result, check.DeepEquals, map[string]interface{}{"change": float64(5)})
+	c.Assert(s.doCalls, check.Equals, 1)
+}
+
+func (s *ClientSuite) TestChangesCommand(c *check.C) {
+	s.rsp = `{"result":{"changes":[{"id":1,"status":"Done","summary":"Change configuration"}]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&changesCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/changes")
+
+	s.rsp = `{"result":{"id":1,"kind":"configure","status":"Done","summary":"Change configuration"},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&changesCommand{}).Execute([]string{"1"}), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/changes/1")
+}
+
 func (s *ClientSuite) TestSendHTTPRequestSendsCorrectContent(c *check.C) {
 	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
 	request := make(map[string]string)
@@ -118,3 +245,414 @@ func (s *ClientSuite) TestSendHTTPRequestSendsCorrectContent(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(s.req.Body, check.NotNil)
 }
+
+func (s *ClientSuite) TestHealthCommand(c *check.C) {
+	s.rsp = `{"result":{"healthy":true,"checks":[{"name":"hostapd","status":"pass","message":"ok"}]},"status":"OK","status-code":200,"type":"sync"}`
+	cmd := &healthCommand{}
+	c.Assert(cmd.Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/health")
+
+	s.rsp = `{"result":{"healthy":false,"checks":[{"name":"hostapd","status":"fail","message":"down"}]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert(cmd.Execute(nil), check.ErrorMatches, "Access point is not healthy")
+}
+
+func (s *ClientSuite) TestHistoryCommands(c *check.C) {
+	s.rsp = `{"result":{"entries":[{"id":1,"time":"2017-10-20T09:12:03Z","changed-keys":["wifi.ssid"],"uid":0}]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&historyCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "GET")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration/history")
+
+	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&restoreCommand{}).Execute([]string{"1"}), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "POST")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration/history/1/restore")
+
+	c.Assert((&restoreCommand{}).Execute(nil), check.NotNil)
+}
+
+func (s *ClientSuite) TestPrintHistoryEntries(c *check.C) {
+	var b bytes.Buffer
+	printHistoryEntries(&b, []interface{}{
+		map[string]interface{}{"id": 3.0, "time": "invalid", "changed-keys": []interface{}{"wifi.ssid", "disabled"}},
+	})
+	c.Assert(b.String(), check.Equals, "ID  Time     UID  Changed\n3   invalid  -    wifi.ssid, disabled\n")
+}
+
+func (s *ClientSuite) TestParseConfigurationDocument(c *check.C) {
+	expected := map[string]interface{}{
+		"disabled":     false,
+		"wifi.ssid":    "Ubuntu",
+		"wifi.channel": 6,
+	}
+
+	config, err := parseConfigurationDocument([]byte("disabled: false\nwifi.ssid: Ubuntu\nwifi.channel: 6\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, expected)
+
+	config, err = parseConfigurationDocument([]byte(`{"disabled": false, "wifi.ssid": "Ubuntu", "wifi.channel": 6}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(config["wifi.channel"], check.Equals, 6.0)
+
+	_, err = parseConfigurationDocument([]byte("- not\n- a map\n"))
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ClientSuite) TestExportCommand(c *check.C) {
+	var buf bytes.Buffer
+	output = &buf
+	defer func() { output = os.Stdout }()
+
+	s.rsp = `{"result":{"wifi.ssid":"Exported","wifi.security-passphrase":"secret123"},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&exportCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "GET")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration")
+	c.Assert(s.req.URL.Query().Get("system"), check.Equals, "true")
+	c.Assert(buf.String(), check.Equals, "{\n  \"wifi.ssid\": \"Exported\"\n}\n")
+
+	buf.Reset()
+	c.Assert((&exportCommand{IncludeSecrets: true}).Execute(nil), check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*"wifi.security-passphrase": "secret123".*`)
+}
+
+func (s *ClientSuite) TestImportCommand(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("wifi.channel: 11\ndisabled: false\n"), 0644), check.IsNil)
+
+	s.rsps = []string{schemaResponse}
+	s.rsp = `{"result":{"added":["disabled"],"changed":["wifi.channel"],"removed":[]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&importCommand{}).Execute([]string{path}), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "PUT")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration")
+
+	body, err := ioutil.ReadAll(s.req.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `{"disabled":false,"wifi.channel":11}`)
+}
+
+func (s *ClientSuite) TestImportCommandValidatesItems(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"wifi.channel": 11, "wifi.chanel": 6}`), 0644), check.IsNil)
+
+	s.rsp = schemaResponse
+	err := (&importCommand{}).Execute([]string{path})
+	c.Assert(err, check.FitsTypeOf, &serviceError{})
+	e := err.(*serviceError)
+	c.Assert(e.Kind, check.Equals, "invalid-key")
+	c.Assert(e.Details, check.DeepEquals, map[string]interface{}{
+		"wifi.chanel": `Invalid key "wifi.chanel"`,
+	})
+
+	// The configuration wasn't replaced
+	c.Assert(s.doCalls, check.Equals, 1)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/schema")
+}
+
+func (s *ClientSuite) TestUnsetAndResetCommands(c *check.C) {
+	s.rsp = `{"result":{"added":[],"changed":[],"removed":["wifi.ssid"]},"status":"OK","status-code":200,"type":"sync"}`
+
+	unset := &unsetCommand{}
+	unset.Positional.Key = "wifi.ssid"
+	c.Assert(unset.Execute(nil), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "DELETE")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration/wifi.ssid")
+
+	c.Assert((&resetCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "DELETE")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration")
+
+	c.Assert((&unsetCommand{}).Execute(nil), check.NotNil)
+	c.Assert((&resetCommand{}).Execute([]string{"wifi.ssid"}), check.NotNil)
+	c.Assert(s.doCalls, check.Equals, 2)
+}
+
+func (s *ClientSuite) TestProfileCommands(c *check.C) {
+	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
+
+	c.Assert((&profileActivateCommand{}).Execute([]string{"field"}), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "POST")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/profiles/field")
+	body, err := ioutil.ReadAll(s.req.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `{"action":"activate"}`)
+
+	c.Assert((&profileSaveCommand{}).Execute([]string{"depot"}), check.IsNil)
+	body, err = ioutil.ReadAll(s.req.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `{"action":"save"}`)
+
+	c.Assert((&profileDeleteCommand{}).Execute([]string{"depot"}), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "DELETE")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/profiles/depot")
+
+	c.Assert((&profileActivateCommand{}).Execute(nil), check.NotNil)
+	c.Assert(s.doCalls, check.Equals, 3)
+}
+
+func (s *ClientSuite) TestOutputFormats(c *check.C) {
+	var buf bytes.Buffer
+	output = &buf
+	defer func() {
+		output = os.Stdout
+		options = commonOptions{}
+	}()
+
+	s.rsp = `{"result":{"wifi.ssid":"Ubuntu","wifi.channel":6},"status":"OK","status-code":200,"type":"sync"}`
+	for format, expected := range map[string]string{
+		formatJSON: "{\n  \"wifi.channel\": 6,\n  \"wifi.ssid\": \"Ubuntu\"\n}\n",
+		formatYAML: "wifi.channel: 6\nwifi.ssid: Ubuntu\n",
+	} {
+		buf.Reset()
+		options.Format = format
+		c.Assert((&getCommand{}).Execute(nil), check.IsNil)
+		c.Assert(buf.String(), check.Equals, expected)
+	}
+
+	// Single items keep their key
+	buf.Reset()
+	options.Format = formatJSON
+	get := &getCommand{}
+	get.Positional.Key = "wifi.ssid"
+	c.Assert(get.Execute(nil), check.IsNil)
+	c.Assert(buf.String(), check.Equals, "{\n  \"wifi.ssid\": \"Ubuntu\"\n}\n")
+
+	// Empty results are still documents
+	buf.Reset()
+	s.rsp = `{"result":null,"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&profileDeleteCommand{}).Execute([]string{"depot"}), check.IsNil)
+	c.Assert(buf.String(), check.Equals, "{}\n")
+
+	// Tables are printed by the commands themselves
+	buf.Reset()
+	options.Format = formatTable
+	c.Assert(printOutput(map[string]interface{}{"a": 1}, nil), check.IsNil)
+	c.Assert(buf.Len(), check.Equals, 0)
+}
+
+func (s *ClientSuite) TestErrorDocument(c *check.C) {
+	err := &serviceError{
+		StatusCode: http.StatusBadRequest,
+		Kind:       "invalid-value",
+		Message:    "Invalid value",
+		Details:    map[string]interface{}{"wifi.channel": "must be a number"},
+	}
+	c.Assert(errorDocument(err, exitInvalidRequest), check.DeepEquals, map[string]interface{}{
+		"message":   "Invalid value",
+		"kind":      "invalid-value",
+		"details":   map[string]interface{}{"wifi.channel": "must be a number"},
+		"exit-code": exitInvalidRequest,
+	})
+	c.Assert(errorDocument(fmt.Errorf("Failed"), exitFailure), check.DeepEquals, map[string]interface{}{
+		"message":   "Failed",
+		"exit-code": exitFailure,
+	})
+}
+
+const schemaResponse = `{"result":{"items":[` +
+	`{"key":"wifi.security","type":"string","default":"open","values":["open","wpa2"],"description":"Security of the wireless network.","requires-restart":true},` +
+	`{"key":"wifi.channel","type":"integer","default":"6","description":"Channel the access point operates on.","requires-restart":true},` +
+	`{"key":"disabled","type":"boolean","default":true,"description":"Whether the access point is disabled.","requires-restart":true}` +
+	`]},"status":"OK","status-code":200,"type":"sync"}`
+
+func (s *ClientSuite) TestSetCommandValidatesItems(c *check.C) {
+	s.rsp = schemaResponse
+	cmd := &setCommand{}
+	cmd.Positional.Items = []configAssignment{"wifi.security=wep", "wifi.channel=six", "wifi.ssid=Ubuntu"}
+
+	err := cmd.Execute(nil)
+	c.Assert(err, check.FitsTypeOf, &serviceError{})
+	e := err.(*serviceError)
+	c.Assert(e.Kind, check.Equals, "invalid-key")
+	c.Assert(e.Details, check.DeepEquals, map[string]interface{}{
+		"wifi.channel":  `Invalid value "six" for "wifi.channel": must be a number`,
+		"wifi.security": `Invalid value "wep" for "wifi.security": must be one of [open wpa2]`,
+		"wifi.ssid":     `Invalid key "wifi.ssid"`,
+	})
+	_, code := describeError(err)
+	c.Assert(code, check.Equals, exitInvalidRequest)
+
+	// Nothing was sent after the schema was fetched
+	c.Assert(s.doCalls, check.Equals, 1)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/schema")
+
+	s.rsps = []string{schemaResponse}
+	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
+	cmd.Positional.Items = []configAssignment{"wifi.security=wpa2", "disabled=false"}
+	c.Assert(cmd.Execute(nil), check.IsNil)
+	c.Assert(s.req.Method, check.Equals, "POST")
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/configuration")
+}
+
+func (s *ClientSuite) TestValidateItemsChecksLimits(c *check.C) {
+	s.rsp = `{"result":{"items":[` +
+		`{"key":"wifi.security-passphrase","type":"string","default":"","min-length":8,"max-length":63,"allow-empty":true,"description":"WPA2 passphrase.","requires-restart":true},` +
+		`{"key":"wifi.address","type":"string","default":"10.0.60.1","format":"ipv4","description":"IP address of the access point interface.","requires-restart":true},` +
+		`{"key":"wifi.netmask","type":"string","default":"255.255.255.0","format":"netmask","description":"Netmask of the access point network.","requires-restart":true}` +
+		`]},"status":"OK","status-code":200,"type":"sync"}`
+	schema, err := loadSchema()
+	c.Assert(err, check.IsNil)
+
+	c.Assert(validateItems(schema, map[string]string{
+		"wifi.security-passphrase": "",
+		"wifi.address":             "192.168.7.1",
+		"wifi.netmask":             "255.255.0.0",
+	}), check.IsNil)
+
+	err = validateItems(schema, map[string]string{
+		"wifi.security-passphrase": "secret",
+		"wifi.address":             "192.168.7",
+		"wifi.netmask":             "255.0.255.0",
+	})
+	c.Assert(err, check.FitsTypeOf, &serviceError{})
+	c.Assert(err.(*serviceError).Details, check.DeepEquals, map[string]interface{}{
+		"wifi.security-passphrase": `Invalid value "secret" for "wifi.security-passphrase": must be 8 to 63 characters long`,
+		"wifi.address":             `Invalid value "192.168.7" for "wifi.address": must be an IPv4 address`,
+		"wifi.netmask":             `Invalid value "255.0.255.0" for "wifi.netmask": must be an IPv4 netmask like 255.255.255.0`,
+	})
+}
+
+func (s *ClientSuite) TestDescribeCommand(c *check.C) {
+	var buf bytes.Buffer
+	output = &buf
+	defer func() {
+		output = os.Stdout
+		options = commonOptions{}
+	}()
+
+	s.rsp = schemaResponse
+	options.Format = formatJSON
+	cmd := &describeCommand{}
+	cmd.Positional.Key = "wifi.channel"
+	c.Assert(cmd.Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/schema")
+
+	var item map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &item), check.IsNil)
+	c.Assert(item["type"], check.Equals, "integer")
+	c.Assert(item["requires-restart"], check.Equals, true)
+
+	cmd.Positional.Key = "wifi.ssid"
+	err := cmd.Execute(nil)
+	c.Assert(err, check.ErrorMatches, `Failed: Invalid key "wifi.ssid"`)
+}
+
+func (s *ClientSuite) TestCompletion(c *check.C) {
+	s.rsp = schemaResponse
+
+	items := func(completions []flags.Completion) []string {
+		result := []string{}
+		for _, completion := range completions {
+			result = append(result, completion.Item)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	c.Assert(items(configKey("").Complete("wifi.")), check.DeepEquals, []string{"wifi.channel", "wifi.security"})
+	c.Assert(items(configAssignment("").Complete("wifi.s")), check.DeepEquals, []string{"wifi.security="})
+	c.Assert(items(configAssignment("").Complete("wifi.security=")), check.DeepEquals,
+		[]string{"wifi.security=open", "wifi.security=wpa2"})
+	c.Assert(items(configAssignment("").Complete("disabled=t")), check.DeepEquals, []string{"disabled=true"})
+
+	// Nothing is completed without the service
+	s.err = fmt.Errorf("no service")
+	c.Assert(configKey("").Complete(""), check.HasLen, 0)
+}
+
+func (s *ClientSuite) TestApplySnapConfig(c *check.C) {
+	oldRunSnapctl := runSnapctl
+	defer func() { runSnapctl = oldRunSnapctl }()
+	runSnapctl = func(args ...string) ([]byte, error) {
+		c.Assert(args, check.DeepEquals, []string{"get", "-d"})
+		return []byte(`{"wifi": {"security": "wpa2", "channel": 6}, "automatic-setup": {"disable": false}}`), nil
+	}
+
+	// Only the changed item is sent
+	s.rsps = []string{
+		schemaResponse,
+		`{"result":{"wifi.security":"open","wifi.channel":"6"},"status":"OK","status-code":200,"type":"sync"}`,
+	}
+	s.rsp = `{"result":{},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&applySnapConfigCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.doCalls, check.Equals, 3)
+	c.Assert(s.req.Method, check.Equals, "POST")
+	body, err := ioutil.ReadAll(s.req.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `{"wifi.security":"wpa2"}`)
+
+	// Secrets are removed from the snap configuration once forwarded,
+	// even if the service already uses them
+	var calls [][]string
+	runSnapctl = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return []byte(`{"wifi": {"security-passphrase": "secret123"}}`), nil
+	}
+	s.rsps = []string{
+		schemaResponse,
+		`{"result":{"wifi.security-passphrase":"secret123"},"status":"OK","status-code":200,"type":"sync"}`,
+	}
+	s.doCalls = 0
+	c.Assert((&applySnapConfigCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.doCalls, check.Equals, 2)
+	c.Assert(calls, check.DeepEquals, [][]string{{"get", "-d"}, {"unset", "wifi.security-passphrase"}})
+
+	// Invalid items make snap set fail
+	runSnapctl = func(args ...string) ([]byte, error) {
+		return []byte(`{"wifi": {"security": "wep"}}`), nil
+	}
+	s.rsps = []string{schemaResponse}
+	s.rsp = `{"result":{"wifi.security":"open"},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&applySnapConfigCommand{}).Execute(nil), check.ErrorMatches, `Failed: Invalid value "wep" .*`)
+
+	// Without the service nothing is sent but the items are checked
+	// with the schema of the service binary
+	oldCheckSnapConfig := checkSnapConfig
+	defer func() { checkSnapConfig = oldCheckSnapConfig }()
+	checkSnapConfig = func() error { return nil }
+
+	s.rsps = nil
+	s.doCalls = 0
+	s.err = &url.Error{Op: "Get", URL: "http://unix/v1/schema", Err: fmt.Errorf("no such file")}
+	c.Assert((&applySnapConfigCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.doCalls, check.Equals, 1)
+
+	checkSnapConfig = func() error { return fmt.Errorf("Invalid snap configuration") }
+	c.Assert((&applySnapConfigCommand{}).Execute(nil), check.ErrorMatches, "Invalid snap configuration")
+}
+
+func (s *ClientSuite) TestScanCommand(c *check.C) {
+	s.rsp = `{"result":{"interface":"wlan0","networks":[]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&scanCommand{Refresh: true}).Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/scan")
+	c.Assert(s.req.URL.RawQuery, check.Equals, "refresh=true")
+
+	c.Assert((&scanCommand{Refresh: true, Force: true}).Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.RawQuery, check.Equals, "force=true&refresh=true")
+
+	var b bytes.Buffer
+	printNetworks(&b, []interface{}{
+		map[string]interface{}{"ssid": "Depot", "bssid": "00:11:22:33:44:55", "channel": 6.0, "width": 40.0, "signal": -40.0, "security": "wpa2"},
+	})
+	c.Assert(b.String(), check.Equals, "SSID   BSSID              Channel  Width   Signal   Security\n"+
+		"Depot  00:11:22:33:44:55  6        40 MHz  -40 dBm  wpa2\n")
+}
+
+func (s *ClientSuite) TestLoadAccessPointInterfaces(c *check.C) {
+	s.rsp = `{"result":{"phys":[{"name":"phy0","ap":true,"interfaces":["wlan0","wlan1"]},` +
+		`{"name":"phy1","ap":false,"interfaces":["wlx0"]}]},"status":"OK","status-code":200,"type":"sync"}`
+	ifaces, err := loadAccessPointInterfaces()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/hardware")
+	c.Assert(ifaces, check.DeepEquals, []string{"wlan0", "wlan1"})
+}
+
+func (s *ClientSuite) TestEventsCommand(c *check.C) {
+	s.rsp = `{"result":{"events":[]},"status":"OK","status-code":200,"type":"sync"}`
+	c.Assert((&eventsCommand{}).Execute(nil), check.IsNil)
+	c.Assert(s.req.URL.Path, check.Equals, "/v1/events")
+
+	var b bytes.Buffer
+	printEvents(&b, []interface{}{
+		map[string]interface{}{"id": 1.0, "time": "invalid", "kind": "dfs-radar-detected", "message": "Radar detected on channel 52"},
+	})
+	c.Assert(b.String(), check.Equals, "invalid dfs-radar-detected   Radar detected on channel 52\n")
+}
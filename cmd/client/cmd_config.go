@@ -19,8 +19,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 type configCommand struct{}
@@ -29,37 +36,65 @@ func (cmd *configCommand) Execute(args []string) error {
 	return nil
 }
 
-type getCommand struct{}
+type getCommand struct {
+	Positional struct {
+		Key configKey `positional-arg-name:"key"`
+	} `positional-args:"yes"`
+}
 
 func (cmd *getCommand) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %s get [<key>]\n", os.Args[0])
+	}
+
 	response, err := sendHTTPRequest(getServiceConfigurationURI(), "GET", nil)
 	if err != nil {
 		return err
 	}
 
-	if len(args) == 1 {
-		wantedKey := args[0]
-		if val, ok := response.Result[wantedKey]; ok {
-			fmt.Fprintf(os.Stdout, "%v\n", val)
-		} else {
+	if len(cmd.Positional.Key) > 0 {
+		wantedKey := string(cmd.Positional.Key)
+		val, ok := response.Result[wantedKey]
+		if !ok {
 			return fmt.Errorf("Config item '%s' does not exist", wantedKey)
 		}
-	} else {
-		printMapSorted(response.Result)
+		return printOutput(map[string]interface{}{wantedKey: val}, func() {
+			fmt.Fprintf(os.Stdout, "%v\n", val)
+		})
 	}
 
-	return nil
+	return printOutput(response.Result, func() {
+		// Mark the items the device does not allow to change
+		schema, _ := loadSchema()
+		keys := make([]string, 0, len(response.Result))
+		for key := range response.Result {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if locked, _ := schema[key]["locked"].(bool); locked {
+				fmt.Fprintf(os.Stdout, "%s: %v (locked)\n", key, response.Result[key])
+			} else {
+				fmt.Fprintf(os.Stdout, "%s: %v\n", key, response.Result[key])
+			}
+		}
+	})
 }
 
-type setCommand struct{}
+type setCommand struct {
+	Positional struct {
+		Items []configAssignment `positional-arg-name:"key=value"`
+	} `positional-args:"yes"`
+}
 
 func (cmd *setCommand) Execute(args []string) error {
-	if len(args) < 1 {
+	if len(cmd.Positional.Items) < 1 {
 		return fmt.Errorf("usage: %s set key1=value1 key2=value2 ...\n", os.Args[0])
 	}
 
-	request := make(map[string]string, len(args))
-	for _, arg := range args {
+	request := make(map[string]string, len(cmd.Positional.Items))
+	for _, item := range cmd.Positional.Items {
+		arg := string(item)
 		i := strings.IndexRune(arg, '=')
 		if i <= 0 {
 			return fmt.Errorf("%q is not in the key=val format", arg)
@@ -67,18 +102,307 @@ func (cmd *setCommand) Execute(args []string) error {
 		request[arg[:i]] = arg[i+1:]
 	}
 
+	// Catch mistakes before the service restarts the access point. The
+	// service validates the items as well, so its errors are left to it.
+	if schema, err := loadSchema(); err == nil {
+		if err := validateItems(schema, request); err != nil {
+			return err
+		}
+	}
+
 	b, err := json.Marshal(request)
 
-	_, err = sendHTTPRequest(getServiceConfigurationURI(), "POST", bytes.NewReader(b))
+	response, err := sendHTTPRequest(getServiceConfigurationURI(), "POST", bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return printOutput(response.Result, nil)
+}
+
+type historyCommand struct{}
+
+func (cmd *historyCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s history [id]\n", os.Args[0])
+	}
+
+	if len(args) == 1 {
+		response, err := sendHTTPRequest(getServiceHistoryURI()+"/"+args[0], "GET", nil)
+		if err != nil {
+			return err
+		}
+		return printOutput(response.Result, func() {
+			printHistoryEntries(os.Stdout, []interface{}{response.Result})
+			fmt.Fprintln(os.Stdout)
+			if config, ok := response.Result["config"].(map[string]interface{}); ok {
+				printMapSorted(config)
+			}
+		})
+	}
+
+	response, err := sendHTTPRequest(getServiceHistoryURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+	return printOutput(response.Result, func() {
+		entries, _ := response.Result["entries"].([]interface{})
+		printHistoryEntries(os.Stdout, entries)
+	})
+}
+
+// printHistoryEntries prints a table with the given configuration
+// history entries.
+func printHistoryEntries(w io.Writer, entries []interface{}) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTime\tUID\tChanged")
+	for _, item := range entries {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		when := fmt.Sprint(entry["time"])
+		if t, err := time.Parse(time.RFC3339Nano, when); err == nil {
+			when = t.Local().Format("2006-01-02 15:04:05")
+		}
+		uid := "-"
+		if value, ok := entry["uid"]; ok {
+			uid = fmt.Sprint(value)
+		}
+		changed := []string{}
+		keys, _ := entry["changed-keys"].([]interface{})
+		for _, key := range keys {
+			changed = append(changed, fmt.Sprint(key))
+		}
+
+		fmt.Fprintf(tw, "%v\t%s\t%s\t%s\n", entry["id"], when, uid, strings.Join(changed, ", "))
+	}
+	tw.Flush()
+}
+
+type restoreCommand struct{}
+
+func (cmd *restoreCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s restore <id>\n", os.Args[0])
+	}
+
+	response, err := sendHTTPRequest(getServiceHistoryURI()+"/"+args[0]+"/restore", "POST", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, nil)
+}
+
+// Configuration items which are only exported when explicitly asked for
+var secretKeys = []string{"wifi.security-passphrase"}
+
+type exportCommand struct {
+	IncludeSecrets bool `long:"include-secrets" description:"Include secrets like the WPA2 passphrase"`
+}
+
+func (cmd *exportCommand) Execute(args []string) error {
+	// Defaults are left out so that the importing device keeps its own
+	response, err := sendHTTPRequest(getServiceConfigurationURI()+"?system=true", "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	config := response.Result
+	if !cmd.IncludeSecrets {
+		for _, key := range secretKeys {
+			delete(config, key)
+		}
+	}
+
+	// The exported document is JSON unless YAML is asked for with --format
+	if options.Format == formatYAML {
+		return printOutput(config, nil)
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = output.Write(append(data, '\n'))
+	return err
+}
+
+// parseConfigurationDocument reads a configuration from either a JSON
+// or a YAML document.
+func parseConfigurationDocument(data []byte) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(data, &config); err == nil {
+		return config, nil
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Configuration is neither valid JSON nor YAML: %s", err)
+	}
+	return config, nil
+}
+
+type importCommand struct{}
+
+func (cmd *importCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s import <file>\n", os.Args[0])
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	config, err := parseConfigurationDocument(data)
+	if err != nil {
+		return err
+	}
+
+	// Like with set, mistakes in the file are caught before the service
+	// replaces the configuration
+	if schema, err := loadSchema(); err == nil {
+		if err := validateConfiguration(schema, config); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	response, err := sendHTTPRequest(getServiceConfigurationURI(), "PUT", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		printChanges(response.Result)
+	})
+}
+
+// printChanges prints the summary of a configuration change the
+// service returned.
+func printChanges(summary map[string]interface{}) {
+	for _, category := range []string{"added", "changed", "removed"} {
+		keys, _ := summary[category].([]interface{})
+		for _, key := range keys {
+			fmt.Fprintf(os.Stdout, "%s: %v\n", category, key)
+		}
+	}
+}
+
+type unsetCommand struct {
+	Positional struct {
+		Key configKey `positional-arg-name:"key"`
+	} `positional-args:"yes"`
+}
+
+func (cmd *unsetCommand) Execute(args []string) error {
+	if len(cmd.Positional.Key) == 0 || len(args) != 0 {
+		return fmt.Errorf("usage: %s unset <key>\n", os.Args[0])
+	}
+
+	response, err := sendHTTPRequest(getServiceConfigurationURI()+"/"+string(cmd.Positional.Key), "DELETE", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		printChanges(response.Result)
+	})
+}
+
+type resetCommand struct{}
+
+func (cmd *resetCommand) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %s reset\n", os.Args[0])
+	}
+
+	response, err := sendHTTPRequest(getServiceConfigurationURI(), "DELETE", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		printChanges(response.Result)
+	})
+}
+
+type describeCommand struct {
+	Positional struct {
+		Key configKey `positional-arg-name:"key"`
+	} `positional-args:"yes"`
+}
+
+func (cmd *describeCommand) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %s describe [<key>]\n", os.Args[0])
+	}
+
+	schema, err := loadSchema()
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Positional.Key) == 0 {
+		keys := make([]string, 0, len(schema))
+		for key := range schema {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		items := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			items = append(items, schema[key])
+		}
+		return printOutput(map[string]interface{}{"items": items}, func() {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			for _, key := range keys {
+				fmt.Fprintf(tw, "%s\t%v\t%v\n", key, schema[key]["type"], schema[key]["description"])
+			}
+			tw.Flush()
+		})
+	}
+
+	key := string(cmd.Positional.Key)
+	item, ok := schema[key]
+	if !ok {
+		return &serviceError{Kind: "invalid-key", Message: fmt.Sprintf("Invalid key %q", key)}
+	}
+
+	return printOutput(item, func() {
+		fmt.Fprintf(os.Stdout, "key: %s\n", key)
+		fmt.Fprintf(os.Stdout, "type: %v\n", item["type"])
+		fmt.Fprintf(os.Stdout, "default: %v\n", item["default"])
+		if values := item.values(); len(values) > 0 {
+			fmt.Fprintf(os.Stdout, "values: %s\n", strings.Join(values, ", "))
+		}
+		fmt.Fprintf(os.Stdout, "requires-restart: %v\n", item["requires-restart"])
+		if locked, _ := item["locked"].(bool); locked {
+			fmt.Fprintf(os.Stdout, "locked: true\n")
+		}
+		fmt.Fprintf(os.Stdout, "description: %v\n", item["description"])
+	})
 }
 
 func init() {
 	cmd, _ := addCommand("config", "Adjust the service configuration", "", &configCommand{})
 	cmd.AddCommand("get", "", "", &getCommand{})
 	cmd.AddCommand("set", "", "", &setCommand{})
+	cmd.AddCommand("history", "Show the history of configuration changes", "", &historyCommand{})
+	cmd.AddCommand("restore", "Restore a configuration from the history", "", &restoreCommand{})
+	cmd.AddCommand("export", "Export the configuration as a JSON or YAML document", "", &exportCommand{})
+	cmd.AddCommand("import", "Replace the configuration with a JSON or YAML document", "", &importCommand{})
+	cmd.AddCommand("unset", "Reset a configuration item to its default value", "", &unsetCommand{})
+	cmd.AddCommand("reset", "Reset the whole configuration to the default values", "", &resetCommand{})
+	cmd.AddCommand("describe", "Describe the configuration items", "", &describeCommand{})
+
+	// Only meant to be run by the configure hook of the snap
+	apply, _ := cmd.AddCommand("apply-snap-config", "Apply the snap configuration", "", &applySnapConfigCommand{})
+	apply.Hidden = true
 }
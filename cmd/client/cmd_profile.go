@@ -0,0 +1,133 @@
+//
+// Copyright (C) 2016 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+type profileCommand struct{}
+
+func (cmd *profileCommand) Execute(args []string) error {
+	return nil
+}
+
+type profileListCommand struct{}
+
+func (cmd *profileListCommand) Execute(args []string) error {
+	response, err := sendHTTPRequest(getServiceProfilesURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		names, _ := response.Result["profiles"].([]interface{})
+		for _, name := range names {
+			marker := " "
+			if name == response.Result["active"] {
+				marker = "*"
+			}
+			fmt.Fprintf(os.Stdout, "%s %v\n", marker, name)
+		}
+	})
+}
+
+// sendProfileAction asks the service to perform an action on the
+// given profile.
+func sendProfileAction(name, action string) error {
+	b, err := json.Marshal(map[string]string{"action": action})
+	if err != nil {
+		return err
+	}
+
+	response, err := sendHTTPRequest(getServiceProfilesURI()+"/"+name, "POST", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, nil)
+}
+
+type profileSaveCommand struct{}
+
+func (cmd *profileSaveCommand) Execute(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: %s profile save <name> [file]\n", os.Args[0])
+	}
+
+	// Without a file the current configuration is saved
+	if len(args) == 1 {
+		return sendProfileAction(args[0], "save")
+	}
+
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	config, err := parseConfigurationDocument(data)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	response, err := sendHTTPRequest(getServiceProfilesURI()+"/"+args[0], "PUT", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, nil)
+}
+
+type profileActivateCommand struct{}
+
+func (cmd *profileActivateCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s profile activate <name>\n", os.Args[0])
+	}
+	return sendProfileAction(args[0], "activate")
+}
+
+type profileDeleteCommand struct{}
+
+func (cmd *profileDeleteCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s profile delete <name>\n", os.Args[0])
+	}
+
+	response, err := sendHTTPRequest(getServiceProfilesURI()+"/"+args[0], "DELETE", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, nil)
+}
+
+func init() {
+	cmd, _ := parser.Find("config").AddCommand("profile", "Manage named configuration profiles", "", &profileCommand{})
+	cmd.AddCommand("list", "List all profiles", "", &profileListCommand{})
+	cmd.AddCommand("save", "Save the current configuration or a file as profile", "", &profileSaveCommand{})
+	cmd.AddCommand("activate", "Replace the configuration with a profile", "", &profileActivateCommand{})
+	cmd.AddCommand("delete", "Delete a profile", "", &profileDeleteCommand{})
+}
@@ -18,6 +18,12 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
 )
 
 type restartCommand struct{}
@@ -31,12 +37,12 @@ func (cmd *restartCommand) Execute(args []string) error {
 		return err
 	}
 
-	_, err = sendHTTPRequest(getServiceStatusURI(), "POST", bytes.NewReader(b))
+	response, err := sendHTTPRequest(getServiceStatusURI(), "POST", bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return printOutput(response.Result, nil)
 }
 
 type statusCommand struct{}
@@ -46,13 +52,243 @@ func (cmd *statusCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	printMapSorted(response.Result)
+	return printOutput(response.Result, func() {
+		printStatus(response.Result)
+	})
+}
+
+// Prefixes of the status items of the access point and the second radio
+var statusPrefixes = []string{"ap", "radio2"}
+
+// printStatus prints all status items sorted by their key and the
+// history of state transitions of the access point and the second
+// radio at the end.
+func printStatus(status map[string]interface{}) {
+	items := make(map[string]interface{}, len(status))
+	for key, value := range status {
+		items[key] = value
+	}
+	for _, prefix := range statusPrefixes {
+		delete(items, prefix+".history")
+		if uptime, ok := items[prefix+".uptime"].(float64); ok {
+			items[prefix+".uptime"] = time.Duration(uptime) * time.Second
+		}
+	}
+
+	printMapSorted(items)
+
+	for _, prefix := range statusPrefixes {
+		history, _ := status[prefix+".history"].([]interface{})
+		printHistory(prefix, history)
+	}
+}
+
+// printHistory prints the given state transitions of the access point
+// or the second radio.
+func printHistory(prefix string, history []interface{}) {
+	if len(history) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, "%s.history:\n", prefix)
+	for _, entry := range history {
+		transition, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		when := fmt.Sprint(transition["time"])
+		if t, err := time.Parse(time.RFC3339Nano, when); err == nil {
+			when = t.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(os.Stdout, "  %s %v -> %v", when, transition["from"], transition["to"])
+		if reason, ok := transition["reason"]; ok {
+			fmt.Fprintf(os.Stdout, " (%v)", reason)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+}
+
+type healthCommand struct{}
+
+func (cmd *healthCommand) Execute(args []string) error {
+	response, err := sendHTTPRequest(getServiceHealthURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	err = printOutput(response.Result, func() {
+		checks, _ := response.Result["checks"].([]interface{})
+		for _, entry := range checks {
+			check, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%-14v %-5v %v\n", check["name"], check["status"], check["message"])
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if response.Result["healthy"] != true {
+		return fmt.Errorf("Access point is not healthy")
+	}
 	return nil
 }
 
+type changesCommand struct{}
+
+func (cmd *changesCommand) Execute(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s status changes [<id>]\n", os.Args[0])
+	}
+
+	if len(args) == 1 {
+		response, err := sendHTTPRequest(getServiceChangesURI()+"/"+args[0], "GET", nil)
+		if err != nil {
+			return err
+		}
+		return printOutput(response.Result, func() {
+			printChange(response.Result)
+		})
+	}
+
+	response, err := sendHTTPRequest(getServiceChangesURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		changes, _ := response.Result["changes"].([]interface{})
+		for _, entry := range changes {
+			change, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%-4v %-6v %v\n", change["id"], change["status"], change["summary"])
+		}
+	})
+}
+
+// printChange prints the details of a single change including the step
+// it is at and why it failed.
+func printChange(change map[string]interface{}) {
+	fmt.Fprintf(os.Stdout, "id: %v\n", change["id"])
+	fmt.Fprintf(os.Stdout, "kind: %v\n", change["kind"])
+	fmt.Fprintf(os.Stdout, "summary: %v\n", change["summary"])
+	fmt.Fprintf(os.Stdout, "status: %v\n", change["status"])
+	if progress, ok := change["progress"].(map[string]interface{}); ok {
+		fmt.Fprintf(os.Stdout, "progress: %v/%v %v\n", progress["done"], progress["total"], progress["label"])
+	}
+	if failure, ok := change["err"].(map[string]interface{}); ok {
+		fmt.Fprintf(os.Stdout, "error: %v\n", failure["message"])
+	}
+}
+
+type scanCommand struct {
+	Refresh bool `long:"refresh" description:"Scan again instead of showing a recent result"`
+	Force   bool `long:"force" description:"Scan even if this interrupts the running access point"`
+}
+
+func (cmd *scanCommand) Execute(args []string) error {
+	query := url.Values{}
+	if cmd.Refresh {
+		query.Set("refresh", "true")
+	}
+	if cmd.Force {
+		query.Set("force", "true")
+	}
+	uri := getServiceScanURI()
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	response, err := sendHTTPRequest(uri, "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(response.Result, func() {
+		networks, _ := response.Result["networks"].([]interface{})
+		printNetworks(os.Stdout, networks)
+	})
+}
+
+// printNetworks prints a table with the given scanned networks.
+func printNetworks(w io.Writer, networks []interface{}) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SSID\tBSSID\tChannel\tWidth\tSignal\tSecurity")
+	for _, entry := range networks {
+		network, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v MHz\t%v dBm\t%v\n", network["ssid"], network["bssid"],
+			network["channel"], network["width"], network["signal"], network["security"])
+	}
+	tw.Flush()
+}
+
+type eventsCommand struct {
+	Follow bool `long:"follow" description:"Wait for new events and print them as they occur"`
+}
+
+func (cmd *eventsCommand) Execute(args []string) error {
+	response, err := sendHTTPRequest(getServiceEventsURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	events, _ := response.Result["events"].([]interface{})
+	if !cmd.Follow {
+		return printOutput(response.Result, func() {
+			printEvents(os.Stdout, events)
+		})
+	}
+
+	after := 0.0
+	for {
+		for _, entry := range events {
+			if err := printOutput(entry, func() {
+				printEvents(os.Stdout, []interface{}{entry})
+			}); err != nil {
+				return err
+			}
+			if event, ok := entry.(map[string]interface{}); ok {
+				after, _ = event["id"].(float64)
+			}
+		}
+
+		uri := fmt.Sprintf("%s?after=%d&wait=60", getServiceEventsURI(), int(after))
+		if response, err = sendHTTPRequest(uri, "GET", nil); err != nil {
+			return err
+		}
+		events, _ = response.Result["events"].([]interface{})
+	}
+}
+
+// printEvents prints one line with time, kind and message per event.
+func printEvents(w io.Writer, events []interface{}) {
+	for _, entry := range events {
+		event, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		when := fmt.Sprint(event["time"])
+		if t, err := time.Parse(time.RFC3339Nano, when); err == nil {
+			when = t.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s %-20v %v\n", when, event["kind"], event["message"])
+	}
+}
+
 func init() {
 	cmd, _ := addCommand("status", "Show various status information about the access point", "", &statusCommand{})
 	cmd.SubcommandsOptional = true
 
 	cmd.AddCommand("restart-ap", "Restart access point", "", &restartCommand{})
+	cmd.AddCommand("health", "Verify the access point is working", "", &healthCommand{})
+	cmd.AddCommand("changes", "Show the changes applied in the background", "", &changesCommand{})
+	cmd.AddCommand("scan", "Show the networks around the access point", "", &scanCommand{})
+	cmd.AddCommand("events", "Show events like radar detections of the access point", "", &eventsCommand{})
 }
@@ -21,6 +21,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
@@ -31,11 +32,13 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 const DefaultPassworthLength = 16
 
-type wizardStep func(map[string]interface{}, *bufio.Reader, bool) error
+type wizardStep func(map[string]interface{}, *bufio.Reader, bool, *wizardAnswers) error
 
 // Go stores both IPv4 and IPv6 as [16]byte
 // with IPv4 addresses stored in the end of the buffer
@@ -73,6 +76,27 @@ func findExistingInterfaces(wifi bool) (wifis []string) {
 	return
 }
 
+// loadAccessPointInterfaces asks the service for the wireless network
+// interfaces whose device can operate an access point.
+var loadAccessPointInterfaces = func() ([]string, error) {
+	response, err := sendHTTPRequest(getServiceHardwareURI(), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := []string{}
+	phys, _ := response.Result["phys"].([]interface{})
+	for _, entry := range phys {
+		if phy, ok := entry.(map[string]interface{}); ok && phy["ap"] == true {
+			names, _ := phy["interfaces"].([]interface{})
+			for _, name := range names {
+				ifaces = append(ifaces, fmt.Sprint(name))
+			}
+		}
+	}
+	return ifaces, nil
+}
+
 func findFreeSubnet(startIp net.IP) (net.IP, error) {
 	curIp := startIp
 
@@ -119,12 +143,166 @@ func askForPassword(reader *bufio.Reader) (string, error) {
 	return key, nil
 }
 
+func validInterfaceName(iface string) bool {
+	return regexp.MustCompile("^[[:alnum:]]+$").MatchString(iface)
+}
+
+// Set the access point address and its default netmask
+func setAccessPointAddress(configuration map[string]interface{}, inputIp string) error {
+	ipv4 := net.ParseIP(inputIp)
+	if ipv4 == nil {
+		return fmt.Errorf("Invalid IP address: %s", inputIp)
+	}
+	if !ipv4.IsGlobalUnicast() {
+		return fmt.Errorf("%s is a reserved IPv4 address", inputIp)
+	}
+	if ipv4.To4() == nil {
+		return fmt.Errorf("%s is not an IPv4 address", inputIp)
+	}
+
+	configuration["wifi.address"] = inputIp
+	// IPMask.String() is hexadecimal, the service expects dotted notation
+	configuration["wifi.netmask"] = net.IP(ipv4.DefaultMask()).String()
+
+	return nil
+}
+
+// Maximum number of hosts the DHCP pool can hold next to the access point address
+func maxDhcpPoolSize(configuration map[string]interface{}) byte {
+	ipv4 := net.ParseIP(configuration["wifi.address"].(string))
+	if ipv4[ipv4Offset+3] <= 128 {
+		return 254 - ipv4[ipv4Offset+3]
+	}
+	return ipv4[ipv4Offset+3] - 1
+}
+
+// Set the DHCP pool to hold the given number of hosts
+func setDhcpRange(configuration map[string]interface{}, hosts int) error {
+	maxpoolsize := maxDhcpPoolSize(configuration)
+	if hosts < 1 || hosts > int(maxpoolsize) {
+		return fmt.Errorf("%d is not within the possible pool size 1-%d", hosts, maxpoolsize)
+	}
+
+	nhosts := byte(hosts)
+	ipv4 := net.ParseIP(configuration["wifi.address"].(string))
+	// Allocate the pool in the bigger half, trying to avoid overlap with access point IP
+	if octect3 := ipv4[ipv4Offset+3]; octect3 <= 128 {
+		ipv4[ipv4Offset+3] = octect3 + 1
+		configuration["dhcp.range-start"] = ipv4.String()
+		ipv4[ipv4Offset+3] = octect3 + nhosts
+		configuration["dhcp.range-stop"] = ipv4.String()
+	} else {
+		ipv4[ipv4Offset+3] = octect3 - nhosts
+		configuration["dhcp.range-start"] = ipv4.String()
+		ipv4[ipv4Offset+3] = octect3 - 1
+		configuration["dhcp.range-stop"] = ipv4.String()
+	}
+
+	return nil
+}
+
+// loadAllowedChannels asks the service for the channels the access
+// point may use with its configured operation mode and country code.
+var loadAllowedChannels = func() ([]int, error) {
+	response, err := sendHTTPRequest(getServiceConfigurationURI(), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	mode := fmt.Sprint(response.Result["wifi.operation-mode"])
+
+	response, err = sendHTTPRequest(getServiceRegulatoryURI(), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	channels, _ := response.Result["channels"].(map[string]interface{})
+	entries, _ := channels[mode].([]interface{})
+
+	allowed := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if channel, ok := entry.(map[string]interface{}); ok {
+			if number, ok := channel["channel"].(float64); ok {
+				allowed = append(allowed, int(number))
+			}
+		}
+	}
+	return allowed, nil
+}
+
+// Set the channel if it is auto or one of the allowed ones
+func setChannel(configuration map[string]interface{}, allowed []int, channel string) error {
+	if channel == "auto" {
+		configuration["wifi.channel"] = channel
+		return nil
+	}
+	number, err := strconv.Atoi(channel)
+	if err == nil {
+		for _, candidate := range allowed {
+			if candidate == number {
+				configuration["wifi.channel"] = channel
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Channel %s is not allowed, allowed are auto and %s", channel, joinChannels(allowed))
+}
+
+func joinChannels(channels []int) string {
+	numbers := make([]string, len(channels))
+	for n, channel := range channels {
+		numbers[n] = strconv.Itoa(channel)
+	}
+	return strings.Join(numbers, ", ")
+}
+
+// wizardAnswers are answers to the steps of the wizard given up front,
+// either as options or in an answers file. Steps with an answer neither
+// ask the user nor pick a value automatically.
+type wizardAnswers struct {
+	Interface      string `yaml:"interface"`
+	Ssid           string `yaml:"ssid"`
+	Channel        string `yaml:"channel"`
+	Security       string `yaml:"security"`
+	Passphrase     string `yaml:"passphrase"`
+	Address        string `yaml:"address"`
+	DhcpHosts      int    `yaml:"dhcp-hosts"`
+	ShareInterface string `yaml:"share-interface"`
+	Enable         *bool  `yaml:"enable"`
+}
+
+// answerError is returned by steps for an invalid answer given up
+// front. Asking again would not help so the wizard stops.
+type answerError struct {
+	error
+}
+
+func readWizardAnswers(path string, answers *wizardAnswers) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, answers); err != nil {
+		return fmt.Errorf("Invalid answers file %s: %s", path, err)
+	}
+	return nil
+}
+
 var allSteps = [...]wizardStep{
 	// determine the WiFi interface
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
-		ifaces := findExistingInterfaces(true)
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		if len(answers.Interface) > 0 {
+			if !validInterfaceName(answers.Interface) {
+				return answerError{fmt.Errorf("Invalid interface name '%s' given", answers.Interface)}
+			}
+			configuration["wifi.interface"] = answers.Interface
+			return nil
+		}
+
+		ifaces, err := loadAccessPointInterfaces()
+		if err != nil {
+			return err
+		}
 		if len(ifaces) == 0 {
-			return fmt.Errorf("There are no valid wireless network interfaces available")
+			return fmt.Errorf("There are no wireless network interfaces available which can operate an access point")
 		} else if len(ifaces) == 1 {
 			fmt.Println("Automatically selected only available wireless network interface " + ifaces[0])
 			return nil
@@ -143,7 +321,7 @@ var allSteps = [...]wizardStep{
 		}
 		fmt.Printf("Available %s %s: ", ifacesVerb, strings.Join(ifaces, ", "))
 		iface := readUserInput(reader)
-		if re := regexp.MustCompile("^[[:alnum:]]+$"); !re.MatchString(iface) {
+		if !validInterfaceName(iface) {
 			return fmt.Errorf("Invalid interface name '%s' given", iface)
 		}
 		configuration["wifi.interface"] = iface
@@ -152,7 +330,14 @@ var allSteps = [...]wizardStep{
 	},
 
 	// Ask for WiFi ESSID
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		if len(answers.Ssid) > 0 {
+			if len(answers.Ssid) > 32 {
+				return answerError{fmt.Errorf("ESSID length must be between 1 and 32 characters")}
+			}
+			configuration["wifi.ssid"] = answers.Ssid
+			return nil
+		}
 		if nonInteractive {
 			configuration["wifi.ssid"] = "Ubuntu"
 			return nil
@@ -160,17 +345,55 @@ var allSteps = [...]wizardStep{
 
 		fmt.Print("Which SSID you want to use for the access point: ")
 		iface := readUserInput(reader)
-		if len(iface) == 0 || len(iface) > 31 {
-			return fmt.Errorf("ESSID length must be between 1 and 31 characters")
+		if len(iface) == 0 || len(iface) > 32 {
+			return fmt.Errorf("ESSID length must be between 1 and 32 characters")
 		}
 		configuration["wifi.ssid"] = iface
 
 		return nil
 	},
 
+	// Select the WiFi channel among the ones allowed in the country
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		// Without an answer the configured channel stays
+		if len(answers.Channel) == 0 && nonInteractive {
+			return nil
+		}
+
+		allowed, err := loadAllowedChannels()
+		if err != nil {
+			return err
+		}
+		if len(answers.Channel) > 0 {
+			if err := setChannel(configuration, allowed, answers.Channel); err != nil {
+				return answerError{err}
+			}
+			return nil
+		}
+
+		fmt.Printf("Which channel do you want to use? Available are auto, %s: ", joinChannels(allowed))
+		return setChannel(configuration, allowed, readUserInput(reader))
+	},
+
 	// Select WiFi encryption type
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
-		if nonInteractive {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		switch answers.Security {
+		case "open":
+			if len(answers.Passphrase) > 0 {
+				return answerError{fmt.Errorf("A passphrase can't be given for an open network")}
+			}
+			configuration["wifi.security"] = answers.Security
+			return nil
+		case "wpa2":
+			configuration["wifi.security"] = answers.Security
+			return nil
+		case "":
+		default:
+			return answerError{fmt.Errorf("Invalid security '%s' given, must be open or wpa2", answers.Security)}
+		}
+
+		// A passphrase is only needed for a protected network
+		if nonInteractive || len(answers.Passphrase) > 0 {
 			configuration["wifi.security"] = "wpa2"
 			return nil
 		}
@@ -189,10 +412,17 @@ var allSteps = [...]wizardStep{
 	},
 
 	// If WPA2 is set, ask for valid password
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
 		if configuration["wifi.security"] == "open" {
 			return nil
 		}
+		if len(answers.Passphrase) > 0 {
+			if len(answers.Passphrase) < 8 || len(answers.Passphrase) > 63 {
+				return answerError{fmt.Errorf("WPA2 passphrase must be between 8 and 63 characters")}
+			}
+			configuration["wifi.security-passphrase"] = answers.Passphrase
+			return nil
+		}
 		if nonInteractive {
 			// Generate a random 16 characters alphanumeric password
 			configuration["wifi.security-passphrase"] = generatePassword(DefaultPassworthLength)
@@ -210,7 +440,13 @@ var allSteps = [...]wizardStep{
 	},
 
 	// Configure WiFi AP IP address
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		if len(answers.Address) > 0 {
+			if err := setAccessPointAddress(configuration, answers.Address); err != nil {
+				return answerError{err}
+			}
+			return nil
+		}
 		if nonInteractive {
 			wifiIp, err := findFreeSubnet(defaultIp)
 			if err != nil {
@@ -225,26 +461,17 @@ var allSteps = [...]wizardStep{
 		}
 
 		fmt.Print("Insert the Access Point IP address: ")
-		inputIp := readUserInput(reader)
-		ipv4 := net.ParseIP(inputIp)
-		if ipv4 == nil {
-			return fmt.Errorf("Invalid IP address: %s", inputIp)
-		}
-		if !ipv4.IsGlobalUnicast() {
-			return fmt.Errorf("%s is a reserved IPv4 address", inputIp)
-		}
-		if ipv4.To4() == nil {
-			return fmt.Errorf("%s is not an IPv4 address", inputIp)
-		}
-
-		configuration["wifi.address"] = inputIp
-		configuration["wifi.netmask"] = ipv4.DefaultMask().String()
-
-		return nil
+		return setAccessPointAddress(configuration, readUserInput(reader))
 	},
 
 	// Configure the DHCP pool
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		if answers.DhcpHosts > 0 {
+			if err := setDhcpRange(configuration, answers.DhcpHosts); err != nil {
+				return answerError{err}
+			}
+			return nil
+		}
 		if nonInteractive {
 			wifiIp := net.ParseIP(configuration["wifi.address"].(string))
 
@@ -259,43 +486,27 @@ var allSteps = [...]wizardStep{
 			return nil
 		}
 
-		var maxpoolsize byte
-		ipv4 := net.ParseIP(configuration["wifi.address"].(string))
-		if ipv4[ipv4Offset+3] <= 128 {
-			maxpoolsize = 254 - ipv4[ipv4Offset+3]
-		} else {
-			maxpoolsize = ipv4[ipv4Offset+3] - 1
-		}
-
-		fmt.Printf("How many host do you want your DHCP pool to hold to? (1-%d) ", maxpoolsize)
+		fmt.Printf("How many host do you want your DHCP pool to hold to? (1-%d) ", maxDhcpPoolSize(configuration))
 		input := readUserInput(reader)
 		inputhost, err := strconv.ParseUint(input, 10, 8)
 		if err != nil {
 			return fmt.Errorf("Invalid answer: %s", input)
 		}
-		if byte(inputhost) > maxpoolsize {
-			return fmt.Errorf("%d is bigger than the maximum pool size %d", inputhost, maxpoolsize)
-		}
-
-		nhosts := byte(inputhost)
-		// Allocate the pool in the bigger half, trying to avoid overlap with access point IP
-		if octect3 := ipv4[ipv4Offset+3]; octect3 <= 128 {
-			ipv4[ipv4Offset+3] = octect3 + 1
-			configuration["dhcp.range-start"] = ipv4.String()
-			ipv4[ipv4Offset+3] = octect3 + nhosts
-			configuration["dhcp.range-stop"] = ipv4.String()
-		} else {
-			ipv4[ipv4Offset+3] = octect3 - nhosts
-			configuration["dhcp.range-start"] = ipv4.String()
-			ipv4[ipv4Offset+3] = octect3 - 1
-			configuration["dhcp.range-stop"] = ipv4.String()
-		}
-
-		return nil
+		return setDhcpRange(configuration, int(inputhost))
 	},
 
 	// Enable or disable connection sharing
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		switch answers.ShareInterface {
+		case "":
+		case "none":
+			configuration["share.disabled"] = true
+			return nil
+		default:
+			configuration["share.disabled"] = false
+			return nil
+		}
+
 		if nonInteractive {
 			configuration["share.disabled"] = false
 			return nil
@@ -315,7 +526,19 @@ var allSteps = [...]wizardStep{
 	},
 
 	// Select the wired interface to share
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		switch answers.ShareInterface {
+		case "":
+		case "none":
+			return nil
+		default:
+			if !validInterfaceName(answers.ShareInterface) {
+				return answerError{fmt.Errorf("Invalid interface name '%s' given", answers.ShareInterface)}
+			}
+			configuration["share.network-interface"] = answers.ShareInterface
+			return nil
+		}
+
 		if nonInteractive {
 			configuration["share.disabled"] = true
 
@@ -391,7 +614,7 @@ var allSteps = [...]wizardStep{
 		fmt.Println("Which network interface you want to use for connection sharing?")
 		fmt.Printf("Available %s %s: ", ifacesVerb, strings.Join(ifaces, ", "))
 		iface := readUserInput(reader)
-		if re := regexp.MustCompile("^[[:alnum:]]+$"); !re.MatchString(iface) {
+		if !validInterfaceName(iface) {
 			return fmt.Errorf("Invalid interface name '%s' given", iface)
 		}
 		configuration["share.network-interface"] = iface
@@ -399,7 +622,11 @@ var allSteps = [...]wizardStep{
 		return nil
 	},
 
-	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool) error {
+	func(configuration map[string]interface{}, reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) error {
+		if answers.Enable != nil {
+			configuration["disabled"] = !*answers.Enable
+			return nil
+		}
 		if nonInteractive {
 			configuration["disabled"] = false
 			return nil
@@ -446,28 +673,71 @@ func applyConfiguration(configuration map[string]interface{}) error {
 }
 
 type wizardCommand struct {
-	Auto bool `long:"auto" description:"Automatically configure the AP"`
+	Auto           bool   `long:"auto" description:"Automatically configure the AP"`
+	Answers        string `long:"answers" value-name:"<file>" description:"Read answers from the given YAML file"`
+	Interface      string `long:"interface" description:"Wireless interface to use"`
+	Ssid           string `long:"ssid" description:"SSID of the access point"`
+	Channel        string `long:"channel" description:"Channel to use, auto to select the least busy one"`
+	Security       string `long:"security" choice:"open" choice:"wpa2" description:"Security of the wireless network"`
+	Passphrase     string `long:"passphrase" description:"WPA2 passphrase"`
+	Address        string `long:"address" description:"IP address of the access point"`
+	DhcpHosts      int    `long:"dhcp-hosts" description:"Number of hosts the DHCP pool holds"`
+	ShareInterface string `long:"share-interface" description:"Network interface whose connection is shared, none to disable sharing"`
+	Enable         string `long:"enable" choice:"true" choice:"false" optional:"yes" optional-value:"true" description:"Enable or disable the AP"`
 }
 
-func (cmd *wizardCommand) Execute(args []string) error {
-	rand.Seed(time.Now().UnixNano())
+// answers returns the answers from the answers file overridden by the
+// ones given as options.
+func (cmd *wizardCommand) answers() (*wizardAnswers, error) {
+	answers := &wizardAnswers{}
+	if len(cmd.Answers) > 0 {
+		if err := readWizardAnswers(cmd.Answers, answers); err != nil {
+			return nil, err
+		}
+	}
 
-	// Setup some sane default values, we don't ask the user for everything
-	configuration := make(map[string]interface{})
+	for _, override := range []struct {
+		value  string
+		answer *string
+	}{
+		{cmd.Interface, &answers.Interface},
+		{cmd.Ssid, &answers.Ssid},
+		{cmd.Channel, &answers.Channel},
+		{cmd.Security, &answers.Security},
+		{cmd.Passphrase, &answers.Passphrase},
+		{cmd.Address, &answers.Address},
+		{cmd.ShareInterface, &answers.ShareInterface},
+	} {
+		if len(override.value) > 0 {
+			*override.answer = override.value
+		}
+	}
+	if cmd.DhcpHosts > 0 {
+		answers.DhcpHosts = cmd.DhcpHosts
+	}
+	if len(cmd.Enable) > 0 {
+		enable := cmd.Enable == "true"
+		answers.Enable = &enable
+	}
+	return answers, nil
+}
 
-	reader := bufio.NewReader(os.Stdin)
+// runWizard goes through all steps and returns the configuration they
+// came up with.
+func runWizard(reader *bufio.Reader, nonInteractive bool, answers *wizardAnswers) (map[string]interface{}, error) {
+	configuration := make(map[string]interface{})
 
 	for _, step := range allSteps {
 		for {
-			if err := step(configuration, reader, cmd.Auto); err != nil {
-				if cmd.Auto {
-					return err
+			if err := step(configuration, reader, nonInteractive, answers); err != nil {
+				if _, ok := err.(answerError); ok || nonInteractive {
+					return nil, err
 				}
 				fmt.Println("Error: ", err)
 				fmt.Print("Do you want to try again? (y/n) ")
 				answer := readUserInput(reader)
 				if strings.ToLower(answer) != "y" {
-					return err
+					return nil, err
 				}
 			} else {
 				// Good answer
@@ -476,6 +746,29 @@ func (cmd *wizardCommand) Execute(args []string) error {
 		}
 	}
 
+	return configuration, nil
+}
+
+func (cmd *wizardCommand) Execute(args []string) error {
+	rand.Seed(time.Now().UnixNano())
+
+	answers, err := cmd.answers()
+	if err != nil {
+		return err
+	}
+
+	configuration, err := runWizard(bufio.NewReader(os.Stdin), cmd.Auto, answers)
+	if err != nil {
+		return err
+	}
+
+	// The outcome has to pass the same schema as set and import
+	if schema, err := loadSchema(); err == nil {
+		if err := validateConfiguration(schema, configuration); err != nil {
+			return err
+		}
+	}
+
 	return applyConfiguration(configuration)
 }
 
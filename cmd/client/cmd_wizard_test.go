@@ -17,7 +17,9 @@ package main
 
 import (
 	"bufio"
+	"io/ioutil"
 	"math/rand"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -60,3 +62,83 @@ func (s *WizardSuite) TestPasswordGeneration(c *C) {
 	c.Assert(password, HasLen, DefaultPassworthLength)
 	c.Assert(password, Matches, passRegExp)
 }
+
+func (s *WizardSuite) TestAnswers(c *C) {
+	oldReadUserInput := readUserInput
+	defer func() { readUserInput = oldReadUserInput }()
+	readUserInput = func(_ *bufio.Reader) string {
+		c.Fatal("Answered steps must not ask the user")
+		return ""
+	}
+
+	oldLoadAllowedChannels := loadAllowedChannels
+	defer func() { loadAllowedChannels = oldLoadAllowedChannels }()
+	loadAllowedChannels = func() ([]int, error) {
+		return []int{1, 6, 11}, nil
+	}
+
+	path := filepath.Join(c.MkDir(), "answers.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("interface: wlan1\nssid: Depot\nchannel: 6\nsecurity: wpa2\n"+
+		"passphrase: Secret123\naddress: 192.168.7.1\ndhcp-hosts: 50\nshare-interface: eth0\nenable: false\n"), 0644), IsNil)
+
+	// Options take precedence over the answers file
+	cmd := &wizardCommand{Answers: path, Ssid: "Office", Enable: "true"}
+	answers, err := cmd.answers()
+	c.Assert(err, IsNil)
+
+	configuration, err := runWizard(nil, false, answers)
+	c.Assert(err, IsNil)
+	c.Assert(configuration, DeepEquals, map[string]interface{}{
+		"wifi.interface":           "wlan1",
+		"wifi.ssid":                "Office",
+		"wifi.channel":             "6",
+		"wifi.security":            "wpa2",
+		"wifi.security-passphrase": "Secret123",
+		"wifi.address":             "192.168.7.1",
+		"wifi.netmask":             "255.255.255.0",
+		"dhcp.range-start":         "192.168.7.2",
+		"dhcp.range-stop":          "192.168.7.51",
+		"share.disabled":           false,
+		"share.network-interface":  "eth0",
+		"disabled":                 false,
+	})
+
+	// Sharing can be disabled and a passphrase implies WPA2
+	answers.ShareInterface = "none"
+	answers.Security = ""
+	configuration, err = runWizard(nil, false, answers)
+	c.Assert(err, IsNil)
+	c.Assert(configuration["share.disabled"], Equals, true)
+	c.Assert(configuration["wifi.security"], Equals, "wpa2")
+	_, ok := configuration["share.network-interface"]
+	c.Assert(ok, Equals, false)
+
+	// The access point can be disabled explicitly as well
+	cmd.Enable = "false"
+	answers, err = cmd.answers()
+	c.Assert(err, IsNil)
+	configuration, err = runWizard(nil, false, answers)
+	c.Assert(err, IsNil)
+	c.Assert(configuration["disabled"], Equals, true)
+
+	// An open network doesn't take a passphrase
+	answers.Security = "open"
+	_, err = runWizard(nil, false, answers)
+	c.Assert(err, ErrorMatches, "A passphrase can't be given for an open network")
+	answers.Security = ""
+
+	// Only channels allowed by the regulatory domain are accepted
+	answers.Channel = "13"
+	_, err = runWizard(nil, false, answers)
+	c.Assert(err, ErrorMatches, "Channel 13 is not allowed, allowed are auto and 1, 6, 11")
+	answers.Channel = "auto"
+
+	// Invalid answers stop the wizard instead of asking again
+	answers.DhcpHosts = 300
+	_, err = runWizard(nil, false, answers)
+	c.Assert(err, ErrorMatches, "300 is not within the possible pool size 1-253")
+
+	c.Assert(ioutil.WriteFile(path, []byte("sid: Depot\n"), 0644), IsNil)
+	_, err = cmd.answers()
+	c.Assert(err, ErrorMatches, "(?s)Invalid answers file .*field sid not found.*")
+}
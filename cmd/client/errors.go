@@ -0,0 +1,129 @@
+//
+// Copyright (C) 2016 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Exit codes of the client, one for each kind of failure so that
+// scripts can react on them.
+const (
+	exitFailure            = 1
+	exitUsage              = 2
+	exitInvalidRequest     = 3
+	exitNotFound           = 4
+	exitConflict           = 5
+	exitApStartFailed      = 6
+	exitUnauthorized       = 7
+	exitServiceUnavailable = 8
+)
+
+// serviceError is an error response received from the service.
+type serviceError struct {
+	StatusCode int
+	Kind       string
+	Message    string
+	Details    map[string]interface{}
+}
+
+func (e *serviceError) Error() string {
+	return "Failed: " + e.Message
+}
+
+func newServiceError(response *serviceResponse) *serviceError {
+	err := &serviceError{
+		StatusCode: response.StatusCode,
+		Message:    fmt.Sprint(response.Result["message"]),
+	}
+	err.Kind, _ = response.Result["kind"].(string)
+	err.Details, _ = response.Result["details"].(map[string]interface{})
+	return err
+}
+
+// describeError returns a message telling the user what went wrong and
+// how it can be fixed together with the exit code for the error.
+func describeError(err error) (string, int) {
+	switch e := err.(type) {
+	case *flags.Error:
+		return e.Message, exitUsage
+	case *url.Error, *net.OpError:
+		return fmt.Sprintf("Cannot reach the service: %s\n"+
+			"Make sure the management-service of the snap is running.", err), exitServiceUnavailable
+	case *serviceError:
+		lines := []string{e.Message}
+
+		fields := make([]string, 0, len(e.Details))
+		for field := range e.Details {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		// A single detail repeats the message already shown
+		if len(fields) > 1 {
+			for _, field := range fields {
+				lines = append(lines, fmt.Sprintf("  %s: %v", field, e.Details[field]))
+			}
+		}
+
+		code := exitFailure
+		switch e.Kind {
+		case "invalid-key":
+			lines = append(lines, "Run 'wifi-ap.config get' to see all valid configuration items.")
+			code = exitInvalidRequest
+		case "invalid-value", "invalid-format":
+			code = exitInvalidRequest
+		case "not-found":
+			code = exitNotFound
+		case "conflict":
+			lines = append(lines, "Wait for the other change to finish and try again.")
+			code = exitConflict
+		case "ap-start-failed":
+			lines = append(lines, "Check 'wifi-ap.status' and the logs of the management-service for details.")
+			code = exitApStartFailed
+		case "locked-key":
+			lines = append(lines, "The item is locked through the locked-keys option of the snap, usually by the image. Remove it from there with 'snap set wifi-ap locked-keys=...' to change it.")
+			code = exitUnauthorized
+		case "unauthorized":
+			lines = append(lines, "Run the command as root, for example with sudo, or ask for access to the service.")
+			code = exitUnauthorized
+		}
+		return strings.Join(lines, "\n"), code
+	}
+	return err.Error(), exitFailure
+}
+
+// errorDocument describes the error for machine-readable output with
+// the same fields the service uses for its errors.
+func errorDocument(err error, code int) map[string]interface{} {
+	document := map[string]interface{}{
+		"message":   err.Error(),
+		"exit-code": code,
+	}
+	if e, ok := err.(*serviceError); ok {
+		document["message"] = e.Message
+		document["kind"] = e.Kind
+		if len(e.Details) > 0 {
+			document["details"] = e.Details
+		}
+	}
+	return document
+}
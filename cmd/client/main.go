@@ -18,16 +18,25 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/user"
 
 	"github.com/jessevdk/go-flags"
 )
 
 type commonOptions struct {
 	Verbose []bool `short:"v" long:"verbose" description:"Verbose output"`
+	Host    string `long:"host" env:"WIFI_AP_HOST" value-name:"HOST:PORT" description:"Manage the access point of a remote device"`
+	Token   string `long:"token" env:"WIFI_AP_TOKEN" description:"Access token for remote management"`
+	CACert  string `long:"ca-cert" value-name:"FILE" description:"CA certificate to verify the remote device with"`
+	Cert    string `long:"cert" value-name:"FILE" description:"Client certificate for remote management"`
+	Key     string `long:"key" value-name:"FILE" description:"Key of the client certificate"`
+	NoWait  bool   `long:"no-wait" description:"Don't wait for changes of the access point to finish"`
+	Format  string `long:"format" choice:"table" choice:"json" choice:"yaml" default:"table" description:"Output format"`
 }
 
-var parser = flags.NewParser(&commonOptions{}, flags.Default)
+var options commonOptions
+
+// Errors are printed by main() together with hints how to fix them
+var parser = flags.NewParser(&options, flags.HelpFlag|flags.PassDoubleDash)
 
 func addCommand(name string, shortHelp string, longHelp string, data interface{}) (*flags.Command, error) {
 	cmd, err := parser.AddCommand(name, shortHelp, longHelp, data)
@@ -38,18 +47,20 @@ func addCommand(name string, shortHelp string, longHelp string, data interface{}
 }
 
 func main() {
-	user, err := user.Current()
-	if err == nil {
-		if user.Uid != "0" {
-			fmt.Println("ERROR: You need to execute this command as root to be allowed to")
-			fmt.Println("talk to the service. Run")
-			fmt.Println(" $ sudo wifi-ap.config get")
-			fmt.Println("for example.")
-			os.Exit(1)
-		}
-	}
-
 	if _, err := parser.Parse(); err != nil {
-		os.Exit(1)
+		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+			fmt.Println(e.Message)
+			os.Exit(0)
+		}
+		message, code := describeError(err)
+		// Errors are machine-readable as well when asked for
+		switch options.Format {
+		case formatJSON, formatYAML:
+			output = os.Stderr
+			printOutput(map[string]interface{}{"error": errorDocument(err, code)}, nil)
+		default:
+			fmt.Fprintln(os.Stderr, "ERROR:", message)
+		}
+		os.Exit(code)
 	}
 }
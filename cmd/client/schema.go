@@ -0,0 +1,195 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// schemaItem describes a configuration item as the service reports it.
+type schemaItem map[string]interface{}
+
+func (item schemaItem) values() []string {
+	values := []string{}
+	list, _ := item["values"].([]interface{})
+	for _, value := range list {
+		values = append(values, fmt.Sprint(value))
+	}
+	if item["type"] == "boolean" {
+		values = []string{"true", "false"}
+	}
+	return values
+}
+
+// validate checks the value the same way the service does.
+func (item schemaItem) validate(key, value string) error {
+	switch item["type"] {
+	case "boolean":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("Invalid value %q for %q: must be true or false", value, key)
+		}
+	case "integer":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("Invalid value %q for %q: must be a number", value, key)
+		}
+	}
+
+	if values, ok := item["values"].([]interface{}); ok && len(values) > 0 {
+		for _, allowed := range values {
+			if value == fmt.Sprint(allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("Invalid value %q for %q: must be one of %v", value, key, values)
+	}
+
+	if len(value) == 0 && item["allow-empty"] == true {
+		return nil
+	}
+	min, _ := item["min-length"].(float64)
+	max, _ := item["max-length"].(float64)
+	if len(value) < int(min) || (max > 0 && len(value) > int(max)) {
+		return fmt.Errorf("Invalid value %q for %q: must be %d to %d characters long", value, key, int(min), int(max))
+	}
+
+	ip := net.ParseIP(value).To4()
+	switch item["format"] {
+	case "ipv4":
+		if ip == nil {
+			return fmt.Errorf("Invalid value %q for %q: must be an IPv4 address", value, key)
+		}
+	case "netmask":
+		if ones, bits := net.IPMask(ip).Size(); ip == nil || (ones == 0 && bits == 0) {
+			return fmt.Errorf("Invalid value %q for %q: must be an IPv4 netmask like 255.255.255.0", value, key)
+		}
+	}
+	return nil
+}
+
+// loadSchema asks the service for the description of all configuration
+// items.
+func loadSchema() (map[string]schemaItem, error) {
+	response, err := sendHTTPRequest(getServiceSchemaURI(), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := make(map[string]schemaItem)
+	items, _ := response.Result["items"].([]interface{})
+	for _, entry := range items {
+		if item, ok := entry.(map[string]interface{}); ok {
+			schema[fmt.Sprint(item["key"])] = item
+		}
+	}
+	return schema, nil
+}
+
+// validateItems checks the given configuration items against the
+// schema before they are sent to the service. Returns an error in the
+// format the service uses listing every invalid item.
+func validateItems(schema map[string]schemaItem, items map[string]string) error {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	e := &serviceError{Kind: "invalid-value", Details: make(map[string]interface{})}
+	for _, key := range keys {
+		message := ""
+		if item, ok := schema[key]; !ok {
+			e.Kind = "invalid-key"
+			message = fmt.Sprintf("Invalid key %q", key)
+		} else if err := item.validate(key, items[key]); err != nil {
+			message = err.Error()
+		} else {
+			continue
+		}
+		if len(e.Details) == 0 {
+			e.Message = message
+		}
+		e.Details[key] = message
+	}
+
+	if len(e.Details) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateConfiguration checks a configuration with values of any type,
+// like the one of an import file, against the schema.
+func validateConfiguration(schema map[string]schemaItem, config map[string]interface{}) error {
+	items := make(map[string]string, len(config))
+	for key, value := range config {
+		items[key] = fmt.Sprint(value)
+	}
+	return validateItems(schema, items)
+}
+
+// Completion of configuration items on the command line. No items are
+// completed if the service can't be asked for them.
+
+type configKey string
+
+func (k configKey) Complete(match string) []flags.Completion {
+	schema, err := loadSchema()
+	if err != nil {
+		return nil
+	}
+
+	completions := []flags.Completion{}
+	for key, item := range schema {
+		if strings.HasPrefix(key, match) {
+			completions = append(completions, flags.Completion{Item: key, Description: fmt.Sprint(item["description"])})
+		}
+	}
+	return completions
+}
+
+// configAssignment is a key=value argument.
+type configAssignment string
+
+func (a configAssignment) Complete(match string) []flags.Completion {
+	i := strings.IndexRune(match, '=')
+	if i < 0 {
+		completions := configKey("").Complete(match)
+		for n := range completions {
+			completions[n].Item += "="
+		}
+		return completions
+	}
+
+	schema, err := loadSchema()
+	if err != nil {
+		return nil
+	}
+
+	key, value := match[:i], match[i+1:]
+	completions := []flags.Completion{}
+	for _, allowed := range schema[key].values() {
+		if strings.HasPrefix(allowed, value) {
+			completions = append(completions, flags.Completion{Item: key + "=" + allowed})
+		}
+	}
+	return completions
+}
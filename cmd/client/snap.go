@@ -0,0 +1,143 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runSnapctl runs snapctl with the given arguments and returns its
+// output.
+var runSnapctl = func(args ...string) ([]byte, error) {
+	output, err := exec.Command("snapctl", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("snapctl %s failed: %s", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
+
+// checkSnapConfig validates the snap configuration with the schema
+// built into the service without the service running.
+var checkSnapConfig = func() error {
+	cmd := exec.Command(filepath.Join(os.Getenv("SNAP"), "bin", "service"), "check-snap-config")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Invalid snap configuration")
+	}
+	return nil
+}
+
+// flattenSnapConfiguration converts the nested document snapctl returns
+// into configuration items with dotted keys.
+func flattenSnapConfiguration(prefix string, document map[string]interface{}, config map[string]string) {
+	for key, value := range document {
+		if len(prefix) > 0 {
+			key = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSnapConfiguration(key, nested, config)
+		} else {
+			config[key] = fmt.Sprint(value)
+		}
+	}
+}
+
+// applySnapConfigCommand is run by the configure hook to forward items
+// set with snap set to the service. It fails, and with it snap set,
+// if any of them is invalid.
+type applySnapConfigCommand struct{}
+
+func (cmd *applySnapConfigCommand) Execute(args []string) error {
+	output, err := runSnapctl("get", "-d")
+	if err != nil {
+		return err
+	}
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(output, &document); err != nil {
+		return err
+	}
+	snapConfig := make(map[string]string)
+	flattenSnapConfiguration("", document, snapConfig)
+
+	schema, err := loadSchema()
+	if err != nil {
+		// The service takes over the snap configuration when it starts
+		// but ignores invalid items then, so they are checked now
+		if _, code := describeError(err); code == exitServiceUnavailable {
+			if err := checkSnapConfig(); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Service not running, the configuration is applied when it starts")
+			return nil
+		}
+		return err
+	}
+
+	response, err := sendHTTPRequest(getServiceConfigurationURI(), "GET", nil)
+	if err != nil {
+		return err
+	}
+
+	// Only send what changed to not restart the access point needlessly
+	items := make(map[string]string)
+	for key, value := range snapConfig {
+		if _, ok := schema[key]; !ok {
+			continue
+		}
+		if current, ok := response.Result[key]; !ok || fmt.Sprint(current) != value {
+			items[key] = value
+		}
+	}
+	if len(items) > 0 {
+		if err := validateItems(schema, items); err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+
+		if _, err := sendHTTPRequest(getServiceConfigurationURI(), "POST", bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+
+	return unsetSnapSecrets(snapConfig)
+}
+
+// unsetSnapSecrets removes secrets from the snap configuration once the
+// service has taken them over. The service doesn't mirror them back, so
+// a secret left behind would revert a newer one on the next snap set.
+func unsetSnapSecrets(snapConfig map[string]string) error {
+	var keys []string
+	for _, key := range secretKeys {
+		if _, ok := snapConfig[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := runSnapctl(append([]string{"unset"}, keys...)...)
+	return err
+}
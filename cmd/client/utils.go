@@ -16,11 +16,58 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats selectable with --format
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
 )
 
+// Where machine-readable output is written to
+var output io.Writer = os.Stdout
+
+// printOutput prints the data as JSON or YAML document if asked for
+// with --format and calls the table function to print it for humans
+// otherwise. The field names of the data are the ones of the REST API
+// so that scripts can rely on them.
+func printOutput(data interface{}, table func()) error {
+	// Print an empty document rather than null for empty results
+	if m, ok := data.(map[string]interface{}); ok && m == nil {
+		data = map[string]interface{}{}
+	}
+
+	var b []byte
+	var err error
+	switch options.Format {
+	case formatJSON:
+		if b, err = json.MarshalIndent(data, "", "  "); err == nil {
+			b = append(b, '\n')
+		}
+	case formatYAML:
+		b, err = yaml.Marshal(data)
+	default:
+		if table != nil {
+			table()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = output.Write(b)
+	return err
+}
+
 func printMapSorted(m map[string]interface{}) {
 	sortedKeys := make([]string, 0, len(m))
 	for key := range m {
@@ -16,120 +16,482 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"time"
 
-	"github.com/snapcore/snapd/osutil"
+	"github.com/gorilla/mux"
 )
 
 var api = []*serviceCommand{
 	configurationCmd,
 	statusCmd,
+	healthCmd,
+	historyCmd,
+	historyEntryCmd,
+	historyRestoreCmd,
+	profilesCmd,
+	profileCmd,
+	configurationKeyCmd,
+	changesCmd,
+	changeCmd,
+	schemaCmd,
+	scanCmd,
+	regulatoryCmd,
+	hardwareCmd,
+	eventsCmd,
 }
 
 var (
 	configurationCmd = &serviceCommand{
-		Path: "/v1/configuration",
-		GET:  getConfiguration,
-		POST: postConfiguration,
+		Path:       "/v1/configuration",
+		GET:        getConfiguration,
+		POST:       postConfiguration,
+		PUT:        putConfiguration,
+		DELETE:     deleteConfiguration,
+		ReadAccess: true,
+	}
+	configurationKeyCmd = &serviceCommand{
+		Path:   "/v1/configuration/{key}",
+		DELETE: deleteConfigurationKey,
 	}
 	statusCmd = &serviceCommand{
-		Path: "/v1/status",
-		GET:  getStatus,
-		POST: postStatus,
+		Path:       "/v1/status",
+		GET:        getStatus,
+		POST:       postStatus,
+		ReadAccess: true,
+	}
+	healthCmd = &serviceCommand{
+		Path:       "/v1/health",
+		GET:        getHealth,
+		ReadAccess: true,
+	}
+	historyCmd = &serviceCommand{
+		Path:   "/v1/configuration/history",
+		GET:    getHistory,
+		DELETE: deleteHistory,
+	}
+	historyEntryCmd = &serviceCommand{
+		Path: "/v1/configuration/history/{id}",
+		GET:  getHistoryEntry,
+	}
+	historyRestoreCmd = &serviceCommand{
+		Path: "/v1/configuration/history/{id}/restore",
+		POST: postHistoryRestore,
+	}
+	profilesCmd = &serviceCommand{
+		Path: "/v1/profiles",
+		GET:  getProfiles,
+	}
+	profileCmd = &serviceCommand{
+		Path:   "/v1/profiles/{name}",
+		GET:    getProfile,
+		PUT:    putProfile,
+		POST:   postProfile,
+		DELETE: deleteProfile,
+	}
+	changesCmd = &serviceCommand{
+		Path: "/v1/changes",
+		GET:  getChanges,
+	}
+	changeCmd = &serviceCommand{
+		Path: "/v1/changes/{id}",
+		GET:  getChange,
+	}
+	schemaCmd = &serviceCommand{
+		Path:       "/v1/schema",
+		GET:        getSchema,
+		ReadAccess: true,
+	}
+	scanCmd = &serviceCommand{
+		Path:       "/v1/scan",
+		GET:        getScan,
+		ReadAccess: true,
+	}
+	regulatoryCmd = &serviceCommand{
+		Path:       "/v1/regulatory",
+		GET:        getRegulatory,
+		ReadAccess: true,
+	}
+	hardwareCmd = &serviceCommand{
+		Path:       "/v1/hardware",
+		GET:        getHardware,
+		ReadAccess: true,
+	}
+	eventsCmd = &serviceCommand{
+		Path:       "/v1/events",
+		GET:        getEvents,
+		ReadAccess: true,
 	}
 	validTokens map[string]bool
 )
 
 func getConfiguration(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	// Only the system configuration is returned, without the defaults,
+	// when asked for
+	paths := configurationPaths
+	if value := request.URL.Query().Get("system"); len(value) > 0 {
+		system, err := strconv.ParseBool(value)
+		if err != nil {
+			sendHTTPResponse(writer, makeErrorResponse(http.StatusBadRequest,
+				`Invalid value "`+value+`" for "system"`, errorKindInvalidValue))
+			return
+		}
+		if system {
+			paths = []string{getConfigOnPath(os.Getenv("SNAP_DATA"))}
+		}
+	}
+
 	config := make(map[string]interface{})
-	if err := readConfiguration(configurationPaths, config); err == nil {
+	if err := readConfiguration(paths, config); err == nil {
+		// Secrets are only shown to administrators
+		if access, ok := grantedAccess(request); ok && access < accessAdmin {
+			for _, key := range secretKeys {
+				delete(config, key)
+			}
+		}
 		sendHTTPResponse(writer, makeResponse(http.StatusOK, config))
 	} else {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read configuration data", "internal-error")
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read configuration data", errorKindInternal)
 		sendHTTPResponse(writer, resp)
 	}
 }
 
 func postConfiguration(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
-	configPath := getConfigOnPath(os.Getenv("SNAP_DATA"))
-	config := make(map[string]interface{})
-	if readConfiguration([]string{configPath}, config) != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError,
-			"Failed to read existing configuration file", "internal-error")
+	items := readConfigurationRequest(writer, request)
+	if items == nil {
+		return
+	}
+
+	// Values are merged into an existing configuration, each of them
+	// has to be valid on its own
+	if resp := validateConfiguration(items, true); resp != nil {
 		sendHTTPResponse(writer, resp)
 		return
 	}
 
+	resp := changeConfiguration(c, request, "Change configuration", func(previous map[string]interface{}) map[string]interface{} {
+		config := make(map[string]interface{})
+		for key, value := range previous {
+			config[key] = value
+		}
+		// Add the items in the config, all of them are known to be valid
+		for key, value := range items {
+			config[key] = value
+		}
+		return config
+	}, nil)
+	sendHTTPResponse(writer, resp)
+}
+
+// parseConfigurationRequest reads a complete configuration from the
+// request body and verifies all of its keys and values. Sends an error
+// response and returns nil if it is not valid.
+func parseConfigurationRequest(writer http.ResponseWriter, request *http.Request) map[string]interface{} {
+	config := readConfigurationRequest(writer, request)
+	if config == nil {
+		return nil
+	}
+
+	if resp := validateConfiguration(config, true); resp != nil {
+		sendHTTPResponse(writer, resp)
+		return nil
+	}
+
+	return config
+}
+
+// readConfigurationRequest decodes the configuration items of the
+// request body. Sends an error response and returns nil if it is not
+// a JSON object.
+func readConfigurationRequest(writer http.ResponseWriter, request *http.Request) map[string]interface{} {
 	if validTokens == nil || len(validTokens) == 0 {
-		errResponse := makeErrorResponse(http.StatusInternalServerError, "No default configuration file available", "internal-error")
+		errResponse := makeErrorResponse(http.StatusInternalServerError, "No default configuration file available", errorKindInternal)
 		sendHTTPResponse(writer, errResponse)
-		return
+		return nil
 	}
 
 	if request.Body == nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Error reading the request body", "internal-error")
+		resp := makeErrorResponse(http.StatusBadRequest, "Error reading the request body", errorKindInvalidFormat)
 		sendHTTPResponse(writer, resp)
-		return
+		return nil
 	}
 
 	body, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Error reading the request body", "internal-error")
+		resp := makeErrorResponse(http.StatusBadRequest, "Error reading the request body", errorKindInvalidFormat)
 		sendHTTPResponse(writer, resp)
-		return
+		return nil
 	}
 
-	var items map[string]interface{}
-	if err := json.Unmarshal(body, &items); err != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Malformed request", "internal-error")
+	var config map[string]interface{}
+	if err := json.Unmarshal(body, &config); err != nil || config == nil {
+		resp := makeErrorResponse(http.StatusBadRequest, "Malformed request", errorKindInvalidFormat)
 		sendHTTPResponse(writer, resp)
-		return
+		return nil
 	}
 
-	// Add the items in the config, but only if all are in the whitelist
-	for key, value := range items {
+	return config
+}
+
+// validateConfiguration checks all keys and, if asked to, all values of
+// the given configuration. Returns an error response listing every
+// invalid item or nil if there is none.
+func validateConfiguration(config map[string]interface{}, values bool) *serviceResponse {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kind := errorKindInvalidValue
+	var fields []fieldError
+	for _, key := range keys {
 		if _, present := validTokens[key]; !present {
-			errResponse := makeErrorResponse(http.StatusInternalServerError, `Invalid key "`+key+`"`, "internal-error")
-			sendHTTPResponse(writer, errResponse)
-			return
+			kind = errorKindInvalidKey
+			fields = append(fields, fieldError{key, `Invalid key "` + key + `"`})
+		} else if !values {
+			continue
+		} else if err := validateConfigurationValue(key, config[key]); err != nil {
+			fields = append(fields, fieldError{key, err.Error()})
 		}
-		config[key] = value
 	}
 
-	var b bytes.Buffer
-	for key, value := range config {
-		key = convertKeyToStorageFormat(key)
-		value = escapeTextForShell(value)
-		b.Write([]byte(fmt.Sprintf("%s=%s\n", key, value)))
+	if len(fields) == 0 {
+		return nil
 	}
+	return makeErrorResponse(http.StatusBadRequest, fields[0].Message, kind, fields...)
+}
 
-	// Always use an atomic write for the configuration file to ensure
-	// it's state is always persistent and kept in error cases.
-	if err := osutil.AtomicWriteFile(configPath, b.Bytes(), 0644, osutil.AtomicWriteFlags(0)); err != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Can't write configuration file", "internal-error")
-		sendHTTPResponse(writer, resp)
+// putConfiguration replaces the whole system configuration with the
+// one given in the request instead of merging it into the existing one.
+func putConfiguration(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	config := parseConfigurationRequest(writer, request)
+	if config == nil {
 		return
 	}
 
-	if err := restartAccessPoint(c); err != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to restart AP process", "internal-error")
-		sendHTTPResponse(writer, resp)
+	resp := changeConfiguration(c, request, "Replace configuration", func(previous map[string]interface{}) map[string]interface{} {
+		// Exported configurations leave out secrets by default, the
+		// device keeps its own then
+		for _, key := range secretKeys {
+			if _, present := config[key]; present {
+				continue
+			}
+			if value, present := previous[key]; present {
+				config[key] = value
+			}
+		}
+		return config
+	}, nil)
+	sendHTTPResponse(writer, resp)
+}
+
+// deleteConfiguration resets the whole system configuration so that
+// only the default values apply again.
+func deleteConfiguration(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	// The device keeps what its gadget snap provides and has locked
+	defaults, err := readGadgetDefaults()
+	if err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+		return
+	}
+	locked, err := readLockedKeys()
+	if err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
 		return
 	}
 
-	sendHTTPResponse(writer, makeResponse(http.StatusOK, nil))
+	resp := changeConfiguration(c, request, "Reset configuration", func(previous map[string]interface{}) map[string]interface{} {
+		config := make(map[string]interface{})
+		for key, value := range defaults {
+			if findSchemaItem(key) != nil {
+				config[key] = fmt.Sprint(value)
+			}
+		}
+		for key, value := range previous {
+			if isLockedKey(locked, key) {
+				config[key] = value
+			}
+		}
+		for _, key := range locked {
+			if _, ok := previous[key]; !ok {
+				delete(config, key)
+			}
+		}
+		return config
+	}, nil)
+	sendHTTPResponse(writer, resp)
+}
+
+// deleteConfigurationKey removes a single item from the system
+// configuration which brings back its default value.
+func deleteConfigurationKey(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	key := mux.Vars(request)["key"]
+	if _, present := validTokens[key]; !present {
+		sendHTTPResponse(writer, makeUnknownKeyResponse(key))
+		return
+	}
+
+	resp := changeConfiguration(c, request, "Reset "+key, func(previous map[string]interface{}) map[string]interface{} {
+		// Nothing to do if the key isn't set in the system configuration
+		if _, present := previous[key]; !present {
+			return nil
+		}
+
+		config := make(map[string]interface{})
+		for k, v := range previous {
+			if k != key {
+				config[k] = v
+			}
+		}
+		return config
+	}, nil)
+	sendHTTPResponse(writer, resp)
+}
+
+// deleteHistory answers DELETE /v1/configuration/history, which the
+// history route takes away from the configuration item route, like
+// for any other unknown configuration item.
+func deleteHistory(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	sendHTTPResponse(writer, makeUnknownKeyResponse("history"))
+}
+
+func makeUnknownKeyResponse(key string) *serviceResponse {
+	return makeErrorResponse(http.StatusBadRequest, `Invalid key "`+key+`"`, errorKindInvalidKey, fieldError{key, "Unknown configuration item"})
+}
+
+// summarizeChanges describes which keys were added, changed or removed
+// between both configurations.
+func summarizeChanges(previous, config map[string]interface{}) map[string]interface{} {
+	summary := map[string]interface{}{
+		"added":   []string{},
+		"changed": []string{},
+		"removed": []string{},
+	}
+	for _, key := range changedKeys(previous, config) {
+		category := "changed"
+		if _, ok := previous[key]; !ok {
+			category = "added"
+		} else if _, ok := config[key]; !ok {
+			category = "removed"
+		}
+		summary[category] = append(summary[category].([]string), key)
+	}
+	return summary
+}
+
+// changeConfiguration replaces the system configuration in the
+// background with the one the derive function returns for the current
+// one. A nil configuration means there is nothing to change. The done
+// function, if given, is called once the change succeeded. Returns the
+// response for the client.
+func changeConfiguration(c *serviceCommand, request *http.Request, summary string,
+	derive func(previous map[string]interface{}) map[string]interface{}, done func()) *serviceResponse {
+	// The lock is held until the change is finished
+	if !c.s.configMutex.TryLock() {
+		return makeErrorResponse(http.StatusConflict, errConfigurationBusy.Error(), errorKindConflict)
+	}
+
+	previous := make(map[string]interface{})
+	if readConfiguration([]string{getConfigOnPath(os.Getenv("SNAP_DATA"))}, previous) != nil {
+		c.s.configMutex.Unlock()
+		return makeErrorResponse(http.StatusInternalServerError,
+			"Failed to read existing configuration file", errorKindInternal)
+	}
+
+	config := derive(previous)
+	if config == nil {
+		c.s.configMutex.Unlock()
+		return makeResponse(http.StatusOK, summarizeChanges(previous, previous))
+	}
+
+	if resp := checkLockedKeys(previous, config); resp != nil {
+		c.s.configMutex.Unlock()
+		return resp
+	}
+
+	// The schema applies to every way the configuration is changed,
+	// like restoring history entries or activating profiles
+	changed := make(map[string]interface{})
+	for _, key := range changedKeys(previous, config) {
+		if value, ok := config[key]; ok {
+			changed[key] = value
+		}
+	}
+	if resp := validateConfiguration(changed, true); resp != nil {
+		c.s.configMutex.Unlock()
+		return resp
+	}
+
+	if field := validateDependencies(previous, config); field != nil {
+		c.s.configMutex.Unlock()
+		return makeErrorResponse(http.StatusBadRequest, field.Message, errorKindInvalidValue, *field)
+	}
+
+	if field := validateHardware(previous, config); field != nil {
+		c.s.configMutex.Unlock()
+		return makeErrorResponse(http.StatusBadRequest, field.Message, errorKindInvalidValue, *field)
+	}
+
+	var uid *uint32
+	if id, ok := requestUID(request); ok {
+		uid = &id
+	}
+
+	change := c.s.changes.start("configure", summary, configurationSteps,
+		func(change *change) (map[string]interface{}, *serviceResponse) {
+			defer c.s.configMutex.Unlock()
+
+			switch err := c.s.updateConfigurationLocked(config, uid, change); err.(type) {
+			case nil:
+			case *rollbackError:
+				return nil, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindApStartFailed)
+			default:
+				return nil, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal)
+			}
+
+			if done != nil {
+				done()
+			}
+			return summarizeChanges(previous, config), nil
+		})
+
+	return makeAsyncResponse(change)
+}
+
+// checkLockedKeys returns an error response listing every locked
+// configuration item the change would modify or nil if there is none.
+func checkLockedKeys(previous, config map[string]interface{}) *serviceResponse {
+	locked, err := readLockedKeys()
+	if err != nil {
+		return makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal)
+	}
+
+	var fields []fieldError
+	for _, key := range changedKeys(previous, config) {
+		if isLockedKey(locked, key) {
+			fields = append(fields, fieldError{key, `Configuration item "` + key + `" is locked`})
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return makeErrorResponse(http.StatusForbidden, fields[0].Message, errorKindLockedKey, fields...)
 }
 
 func restartAccessPoint(c *serviceCommand) error {
 	if c.s.ap != nil {
 		// Now that we have all configuration changes successfully applied
 		// we can safely restart the service.
-		if err := c.s.ap.Restart(); err != nil {
+		if err := c.s.restartAccessPoint(); err != nil {
 			return err
 		}
 	}
@@ -137,50 +499,447 @@ func restartAccessPoint(c *serviceCommand) error {
 }
 
 func getStatus(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
-	status := make(map[string]interface{})
+	status := c.s.status.toMap()
 
 	status["ap.active"] = false
 	if c.s.ap != nil && c.s.ap.Running() {
 		status["ap.active"] = true
 	}
+	for key, value := range c.s.radioStatus() {
+		status[key] = value
+	}
+	for key, value := range c.s.schedule.toMap(apScheduleItems.schedule) {
+		status[key] = value
+	}
+	for key, value := range c.s.radio2Schedule.toMap(radio2ScheduleItems.schedule) {
+		status[key] = value
+	}
 
 	sendHTTPResponse(writer, makeResponse(http.StatusOK, status))
 }
 
 func postStatus(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
-	body, err := ioutil.ReadAll(request.Body)
+	var items map[string]string
+	if request.Body == nil || json.NewDecoder(request.Body).Decode(&items) != nil {
+		resp := makeErrorResponse(http.StatusBadRequest, "Malformed request", errorKindInvalidFormat)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	switch items["action"] {
+	case "restart-ap":
+		// Don't restart the access point while a configuration is applied
+		if !c.s.configMutex.TryLock() {
+			resp := makeErrorResponse(http.StatusConflict, errConfigurationBusy.Error(), errorKindConflict)
+			sendHTTPResponse(writer, resp)
+			return
+		}
+
+		change := c.s.changes.start("restart-ap", "Restart access point", 2,
+			func(change *change) (map[string]interface{}, *serviceResponse) {
+				defer c.s.configMutex.Unlock()
+
+				change.step("Restart access point")
+				if err := restartAccessPoint(c); err != nil {
+					return nil, makeErrorResponse(http.StatusInternalServerError, "Failed to restart AP process", errorKindApStartFailed)
+				}
+				if c.s.ap != nil {
+					change.step("Wait for access point to become healthy")
+					if err := c.s.waitUntilHealthy(); err != nil {
+						return nil, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindApStartFailed)
+					}
+				}
+				return nil, nil
+			})
+		sendHTTPResponse(writer, makeAsyncResponse(change))
+	default:
+		resp := makeErrorResponse(http.StatusBadRequest, "Invalid action", errorKindInvalidValue,
+			fieldError{"action", `Unknown action "` + items["action"] + `"`})
+		sendHTTPResponse(writer, resp)
+	}
+}
+
+func getHealth(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	report := c.s.checkHealth()
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"healthy": report.Healthy,
+		"checks":  report.Checks,
+	}))
+}
+
+func getHistory(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	entries, err := listHistory()
 	if err != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Error reading the request body", "internal-error")
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read configuration history", errorKindInternal)
 		sendHTTPResponse(writer, resp)
 		return
 	}
 
-	var items map[string]string
-	if json.Unmarshal(body, &items) != nil {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Malformed request", "internal-error")
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	}))
+}
+
+// historyEntryFromRequest loads the history entry the request refers to
+// and sends an error response if there is none.
+func historyEntryFromRequest(writer http.ResponseWriter, request *http.Request) *historyEntry {
+	id, err := strconv.Atoi(mux.Vars(request)["id"])
+	if err != nil {
+		resp := makeErrorResponse(http.StatusBadRequest, "Invalid history entry ID", errorKindInvalidValue)
+		sendHTTPResponse(writer, resp)
+		return nil
+	}
+
+	entry, err := loadHistoryEntry(id)
+	if os.IsNotExist(err) {
+		resp := makeErrorResponse(http.StatusNotFound, "History entry "+strconv.Itoa(id)+" does not exist", errorKindNotFound)
 		sendHTTPResponse(writer, resp)
+		return nil
+	} else if err != nil {
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read configuration history", errorKindInternal)
+		sendHTTPResponse(writer, resp)
+		return nil
+	}
+
+	return entry
+}
+
+func getHistoryEntry(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	entry := historyEntryFromRequest(writer, request)
+	if entry == nil {
 		return
 	}
 
-	action, ok := items["action"]
-	if !ok {
-		resp := makeErrorResponse(http.StatusInternalServerError, "Mailformed request", "internal-error")
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, entry.toMap()))
+}
+
+func postHistoryRestore(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	entry := historyEntryFromRequest(writer, request)
+	if entry == nil {
+		return
+	}
+
+	summary := "Restore configuration from history entry " + strconv.Itoa(entry.ID)
+	resp := changeConfiguration(c, request, summary, func(previous map[string]interface{}) map[string]interface{} {
+		return entry.Config
+	}, nil)
+	sendHTTPResponse(writer, resp)
+}
+
+func getProfiles(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	names, err := listProfiles()
+	if err != nil {
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read profiles", errorKindInternal)
 		sendHTTPResponse(writer, resp)
 		return
 	}
 
-	switch action {
-	case "restart-ap":
-		if err = restartAccessPoint(c); err != nil {
-			resp := makeErrorResponse(http.StatusInternalServerError, "Failed to restart AP process", "internal-error")
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"profiles": names,
+		"active":   activeProfile(),
+	}))
+}
+
+// profileNameFromRequest returns the profile name the request refers
+// to and sends an error response if it is not a valid one.
+func profileNameFromRequest(writer http.ResponseWriter, request *http.Request) string {
+	name := mux.Vars(request)["name"]
+	if !validProfileName.MatchString(name) {
+		resp := makeErrorResponse(http.StatusBadRequest, `Invalid profile name "`+name+`"`, errorKindInvalidValue)
+		sendHTTPResponse(writer, resp)
+		return ""
+	}
+	return name
+}
+
+// profileFromRequest loads the profile the request refers to and sends
+// an error response if it doesn't exist.
+func profileFromRequest(writer http.ResponseWriter, request *http.Request) (string, map[string]interface{}) {
+	name := profileNameFromRequest(writer, request)
+	if len(name) == 0 {
+		return "", nil
+	}
+
+	config, err := loadProfile(name)
+	if os.IsNotExist(err) {
+		resp := makeErrorResponse(http.StatusNotFound, `Profile "`+name+`" does not exist`, errorKindNotFound)
+		sendHTTPResponse(writer, resp)
+		return "", nil
+	} else if err != nil {
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to read profile", errorKindInternal)
+		sendHTTPResponse(writer, resp)
+		return "", nil
+	}
+
+	return name, config
+}
+
+func getProfile(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	_, config := profileFromRequest(writer, request)
+	if config == nil {
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, config))
+}
+
+// putProfile stores the configuration given in the request as profile.
+func putProfile(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	name := profileNameFromRequest(writer, request)
+	if len(name) == 0 {
+		return
+	}
+
+	config := parseConfigurationRequest(writer, request)
+	if config == nil {
+		return
+	}
+
+	if err := saveProfile(name, config); err != nil {
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to write profile", errorKindInternal)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, nil))
+}
+
+func postProfile(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	var items map[string]string
+	if request.Body == nil || json.NewDecoder(request.Body).Decode(&items) != nil {
+		resp := makeErrorResponse(http.StatusBadRequest, "Malformed request", errorKindInvalidFormat)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	switch items["action"] {
+	case "save":
+		// Store the current configuration as profile
+		name := profileNameFromRequest(writer, request)
+		if len(name) == 0 {
+			return
+		}
+
+		config := make(map[string]interface{})
+		if readConfiguration([]string{getConfigOnPath(os.Getenv("SNAP_DATA"))}, config) != nil {
+			resp := makeErrorResponse(http.StatusInternalServerError,
+				"Failed to read existing configuration file", errorKindInternal)
 			sendHTTPResponse(writer, resp)
 			return
 		}
 
-		resp := makeResponse(http.StatusOK, nil)
+		if err := saveProfile(name, config); err != nil {
+			resp := makeErrorResponse(http.StatusInternalServerError, "Failed to write profile", errorKindInternal)
+			sendHTTPResponse(writer, resp)
+			return
+		}
+	case "activate":
+		name, config := profileFromRequest(writer, request)
+		if config == nil {
+			return
+		}
+
+		resp := changeConfiguration(c, request, `Activate profile "`+name+`"`, func(previous map[string]interface{}) map[string]interface{} {
+			return config
+		}, func() {
+			if err := setActiveProfile(name); err != nil {
+				log.Printf("Failed to store active profile: %s", err)
+			}
+		})
+		sendHTTPResponse(writer, resp)
+		return
+	default:
+		resp := makeErrorResponse(http.StatusBadRequest, "Invalid action", errorKindInvalidValue)
 		sendHTTPResponse(writer, resp)
+		return
 	}
 
-	resp := makeErrorResponse(http.StatusInternalServerError, "Invalid request", "internal-error")
-	sendHTTPResponse(writer, resp)
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, nil))
+}
+
+func deleteProfile(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	name, config := profileFromRequest(writer, request)
+	if config == nil {
+		return
+	}
+
+	if err := removeProfile(name); err != nil {
+		resp := makeErrorResponse(http.StatusInternalServerError, "Failed to delete profile", errorKindInternal)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, nil))
+}
+
+func getChanges(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	changes := []map[string]interface{}{}
+	for _, change := range c.s.changes.list() {
+		changes = append(changes, change.toMap())
+	}
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"changes": changes,
+	}))
+}
+
+func getChange(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(request)["id"])
+	if err != nil {
+		resp := makeErrorResponse(http.StatusBadRequest, "Invalid change ID", errorKindInvalidValue)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	change := c.s.changes.get(id)
+	if change == nil {
+		resp := makeErrorResponse(http.StatusNotFound, "Change "+strconv.Itoa(id)+" does not exist", errorKindNotFound)
+		sendHTTPResponse(writer, resp)
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, change.toMap()))
+}
+
+func getSchema(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	locked, err := readLockedKeys()
+	if err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+		return
+	}
+
+	items := []map[string]interface{}{}
+	for n := range schema {
+		item := schema[n].toMap()
+		item["locked"] = isLockedKey(locked, schema[n].Key)
+		items = append(items, item)
+	}
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"items": items,
+	}))
+}
+
+func getScan(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	flags := make(map[string]bool)
+	for _, name := range []string{"refresh", "force"} {
+		if value := request.URL.Query().Get(name); len(value) > 0 {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				sendHTTPResponse(writer, makeErrorResponse(http.StatusBadRequest,
+					`Invalid value "`+value+`" for "`+name+`"`, errorKindInvalidValue))
+				return
+			}
+			flags[name] = flag
+		}
+	}
+
+	// Interrupting the access point is up to administrators
+	if access, ok := grantedAccess(request); ok && access < accessAdmin && flags["force"] {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusForbidden,
+			"Forcing a scan requires administrator access", errorKindUnauthorized))
+		return
+	}
+
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+		return
+	}
+	iface := fmt.Sprint(config["wifi.interface"])
+
+	// A virtual access point interface leaves the radio free to scan
+	state := c.s.status.State()
+	apRunning := config["wifi.interface-mode"] != "virtual" && (state == apStateStarting || state == apStateRunning)
+
+	scanned, networks, err := c.s.scans.scan(iface, apRunning, flags["force"], flags["refresh"])
+	if err == errAccessPointBusy {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusConflict, err.Error(), errorKindConflict))
+		return
+	} else if err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"time":      scanned.Format(time.RFC3339),
+		"interface": iface,
+		"networks":  networks,
+	}))
+}
+
+func getRegulatory(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	countryCode := request.URL.Query().Get("country-code")
+	if len(countryCode) == 0 {
+		config := make(map[string]interface{})
+		if err := readConfiguration(configurationPaths, config); err != nil {
+			sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+			return
+		}
+		if value, ok := config["wifi.country-code"]; ok {
+			countryCode = fmt.Sprint(value)
+		}
+	}
+
+	// A stored country code may come from a version which accepted any
+	if err := validateConfigurationValue("wifi.country-code", countryCode); err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusBadRequest, err.Error(), errorKindInvalidValue))
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, regulatoryInformation(countryCode)))
+}
+
+func getHardware(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	phys, err := loadHardware()
+	if err != nil {
+		sendHTTPResponse(writer, makeErrorResponse(http.StatusInternalServerError, err.Error(), errorKindInternal))
+		return
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"phys": phys,
+	}))
+}
+
+func getEvents(c *serviceCommand, writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	after, wait := 0, 0
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"after", &after},
+		{"wait", &wait},
+	} {
+		text := query.Get(param.name)
+		if len(text) == 0 {
+			continue
+		}
+		value, err := strconv.Atoi(text)
+		if err != nil || value < 0 {
+			sendHTTPResponse(writer, makeErrorResponse(http.StatusBadRequest,
+				`Invalid value "`+text+`" for "`+param.name+`"`, errorKindInvalidValue))
+			return
+		}
+		*param.value = value
+	}
+
+	timeout := time.Duration(wait) * time.Second
+	if timeout > maxEventWait {
+		timeout = maxEventWait
+	}
+
+	// Clients following the events wait for the next one
+	events, added := c.s.events.since(after)
+	if len(events) == 0 && timeout > 0 {
+		select {
+		case <-added:
+			events, _ = c.s.events.since(after)
+		case <-time.After(timeout):
+		case <-request.Context().Done():
+		}
+	}
+
+	sendHTTPResponse(writer, makeResponse(http.StatusOK, map[string]interface{}{
+		"events": events,
+	}))
 }
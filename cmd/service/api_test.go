@@ -17,6 +17,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -26,22 +27,66 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"gopkg.in/check.v1"
 )
 
 // gopkg.in/check.v1 stuff
 func Test(t *testing.T) { check.TestingT(t) }
 
-type S struct{}
+type S struct {
+	configurationPaths []string
+	snapData           string
+}
 
 var _ = check.Suite(&S{})
 
+func (s *S) SetUpTest(c *check.C) {
+	s.configurationPaths = configurationPaths
+	s.snapData = os.Getenv("SNAP_DATA")
+	checkAccessPointHealth = func(s *service) *healthReport {
+		return &healthReport{Healthy: true}
+	}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	configurationPaths = s.configurationPaths
+	os.Setenv("SNAP_DATA", s.snapData)
+
+	// Goroutines of a test must not see the globals the next one changes
+	for _, svc := range mockServices {
+		svc.radio2Monitors.stop()
+		svc.apMonitors.stop()
+	}
+	mockServices = nil
+}
+
+// setUpConfiguration points $SNAP_DATA to a new directory holding the
+// given configuration on top of the default one and loads the valid
+// tokens and default values. It returns the directory.
+func (s *S) setUpConfiguration(c *check.C, config string) string {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	configurationPaths = []string{"../../conf/default-config", getConfigOnPath(dir)}
+	if len(config) > 0 {
+		c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte(config), 0644), check.IsNil)
+	}
+
+	validTokens = schemaTokens()
+	defaultValues = make(map[string]interface{})
+	c.Assert(readConfigurationFile("../../conf/default-config", defaultValues), check.IsNil)
+	return dir
+}
+
 type mockBackgroundProcess struct {
 	running bool
+	pid     int
+	handler processExitHandler
 }
 
 func (p *mockBackgroundProcess) Start() error {
 	p.running = true
+	p.pid++
 	return nil
 }
 
@@ -59,12 +104,27 @@ func (p *mockBackgroundProcess) Running() bool {
 	return p.running
 }
 
+func (p *mockBackgroundProcess) Pid() int {
+	return p.pid
+}
+
+func (p *mockBackgroundProcess) SetExitHandler(handler processExitHandler) {
+	p.handler = handler
+}
+
+// Services created by the current test
+var mockServices []*service
+
+// newMockService returns a service with a mocked access point process
+// whose goroutines are stopped at the end of the test.
+func newMockService() *service {
+	svc := &service{ap: &mockBackgroundProcess{}}
+	mockServices = append(mockServices, svc)
+	return svc
+}
+
 func newMockServiceCommand() *serviceCommand {
-	return &serviceCommand{
-		s: &service{
-			ap: &mockBackgroundProcess{},
-		},
-	}
+	return &serviceCommand{s: newMockService()}
 }
 
 func (s *S) TestGetConfiguration(c *check.C) {
@@ -142,7 +202,7 @@ func (s *S) TestNoRequestBody(c *check.C) {
 
 	postConfiguration(cmd, rec, req)
 
-	c.Assert(rec.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
 
 	body, err := ioutil.ReadAll(rec.Body)
 	c.Assert(err, check.IsNil)
@@ -152,11 +212,11 @@ func (s *S) TestNoRequestBody(c *check.C) {
 	err = json.Unmarshal(body, &resp)
 	c.Assert(err, check.IsNil)
 
-	// Check for 500 status code and other error fields
-	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusInternalServerError))
-	c.Assert(resp.StatusCode, check.Equals, http.StatusInternalServerError)
+	// Check for 400 status code and other error fields
+	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusBadRequest))
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
 	c.Assert(resp.Type, check.Equals, "error")
-	c.Assert(resp.Result["kind"], check.Equals, "internal-error")
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-format")
 	c.Assert(resp.Result["message"], check.Equals, "Error reading the request body")
 }
 
@@ -171,7 +231,7 @@ func (s *S) TestInvalidJSON(c *check.C) {
 
 	postConfiguration(cmd, rec, req)
 
-	c.Assert(rec.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
 
 	body, err := ioutil.ReadAll(rec.Body)
 	c.Assert(err, check.IsNil)
@@ -181,11 +241,11 @@ func (s *S) TestInvalidJSON(c *check.C) {
 	err = json.Unmarshal(body, &resp)
 	c.Assert(err, check.IsNil)
 
-	// Check for 500 status code and other error fields
-	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusInternalServerError))
-	c.Assert(resp.StatusCode, check.Equals, http.StatusInternalServerError)
+	// Check for 400 status code and other error fields
+	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusBadRequest))
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
 	c.Assert(resp.Type, check.Equals, "error")
-	c.Assert(resp.Result["kind"], check.Equals, "internal-error")
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-format")
 	c.Assert(resp.Result["message"], check.Equals, "Malformed request")
 }
 
@@ -216,7 +276,7 @@ func (s *S) TestInvalidToken(c *check.C) {
 	// Do the request
 	postConfiguration(cmd, rec, req)
 
-	c.Assert(rec.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
 
 	// Read the result JSON
 	body, err := ioutil.ReadAll(rec.Body)
@@ -227,10 +287,14 @@ func (s *S) TestInvalidToken(c *check.C) {
 	err = json.Unmarshal(body, &resp)
 	c.Assert(err, check.IsNil)
 
-	// Check for 500 status code and other succesful fields
-	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusInternalServerError))
-	c.Assert(resp.StatusCode, check.Equals, http.StatusInternalServerError)
+	// Check for 400 status code and other error fields
+	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusBadRequest))
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
 	c.Assert(resp.Type, check.Equals, "error")
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-key")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"bad.token": `Invalid key "bad.token"`,
+	})
 }
 
 func (s *S) TestChangeConfiguration(c *check.C) {
@@ -238,7 +302,7 @@ func (s *S) TestChangeConfiguration(c *check.C) {
 
 	// Values to be used in the config
 	values := map[string]string{
-		"disabled":                 "0",
+		"disabled":                 "false",
 		"wifi.security":            "wpa2",
 		"wifi.ssid":                "UbuntuAP",
 		"wifi.security-passphrase": "12345678",
@@ -261,21 +325,15 @@ func (s *S) TestChangeConfiguration(c *check.C) {
 	// Do the request
 	postConfiguration(cmd, rec, req)
 
-	c.Assert(rec.Code, check.Equals, http.StatusOK)
-
-	// Read the result JSON
-	body, err := ioutil.ReadAll(rec.Body)
-	c.Assert(err, check.IsNil)
-
-	// Parse the returned JSON
-	resp := serviceResponse{}
-	err = json.Unmarshal(body, &resp)
-	c.Assert(err, check.IsNil)
-
-	// Check for 200 status code and other succesful fields
-	c.Assert(resp.Status, check.Equals, http.StatusText(http.StatusOK))
-	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
-	c.Assert(resp.Type, check.Equals, "sync")
+	// The configuration is applied in the background
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["kind"], check.Equals, "configure")
+	c.Assert(change["status"], check.Equals, changeDone)
+	c.Assert(change["progress"], check.DeepEquals, map[string]interface{}{
+		"label": "Wait for access point to become healthy",
+		"done":  float64(configurationSteps),
+		"total": float64(configurationSteps),
+	})
 
 	// Read the generated config and check that values were set
 	config, err := ioutil.ReadFile(getConfigOnPath(os.Getenv("SNAP_DATA")))
@@ -283,7 +341,7 @@ func (s *S) TestChangeConfiguration(c *check.C) {
 
 	for key, value := range values {
 		c.Assert(strings.Contains(string(config),
-			convertKeyToStorageFormat(key)+"="+value+"\n"),
+			convertKeyToStorageFormat(key)+"='"+value+"'\n"),
 			check.Equals, true)
 	}
 
@@ -294,6 +352,7 @@ func (s *S) TestChangeConfiguration(c *check.C) {
 
 	// Don't leave garbage in /tmp
 	os.Remove(getConfigOnPath(os.Getenv("SNAP_DATA")))
+	os.RemoveAll(historyDir())
 }
 
 func (s *S) TestGetStatusDefaultOk(c *check.C) {
@@ -344,3 +403,464 @@ func (s *S) TestGetStatusReturnsCorrectApStatus(c *check.C) {
 
 	c.Assert(resp.Result["ap.active"], check.Equals, true)
 }
+
+func (s *S) TestGetStatusReportsState(c *check.C) {
+	req, err := http.NewRequest(http.MethodGet, "/v1/status", nil)
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+
+	cmd := newMockServiceCommand()
+	cmd.s.ap.Start()
+	cmd.s.status.launched(cmd.s.ap.Pid(), false, "Ubuntu", "6", "wlan0")
+	cmd.s.status.running(cmd.s.ap.Pid())
+
+	getStatus(cmd, rec, req)
+
+	var resp serviceResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(resp.Result["ap.state"], check.Equals, "running")
+	c.Assert(resp.Result["ap.ssid"], check.Equals, "Ubuntu")
+	c.Assert(resp.Result["ap.channel"], check.Equals, "6")
+	c.Assert(resp.Result["ap.interface"], check.Equals, "wlan0")
+	c.Assert(resp.Result["ap.pid"], check.Equals, float64(cmd.s.ap.Pid()))
+	c.Assert(resp.Result["ap.history"], check.HasLen, 2)
+}
+
+func (s *S) TestChangeConfigurationRollsBack(c *check.C) {
+	previous := []byte("DISABLED=false\nAPPLY_TIMEOUT=1\nWIFI_CHANNEL=6\n")
+	dir := s.setUpConfiguration(c, string(previous))
+
+	checkAccessPointHealth = func(s *service) *healthReport {
+		report := &healthReport{Healthy: true}
+		report.add("hostapd", healthFail, "hostapd reports state DISABLED")
+		return report
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "11"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeError)
+	c.Assert(change["progress"].(map[string]interface{})["label"], check.Equals, "Restore previous configuration")
+	c.Assert(change["err"], check.DeepEquals, map[string]interface{}{
+		"message": "Access point failed to come up with the new configuration (hostapd reports state DISABLED), previous configuration restored",
+		"kind":    "ap-start-failed",
+	})
+
+	// The previous configuration is back and the AP runs with it
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, previous)
+	c.Assert(cmd.s.ap.Running(), check.Equals, true)
+}
+
+func (s *S) TestChangeConfigurationWithoutUplink(c *check.C) {
+	dir := s.setUpConfiguration(c, "DISABLED=false\nAPPLY_TIMEOUT=1\nWIFI_CHANNEL=6\n")
+
+	// Without an uplink nothing can be shared, which is no reason to
+	// roll back. dnsmasq still answers DNS queries on its own and the
+	// NAT rules don't need the shared interface to be up.
+	checkAccessPointHealth = func(s *service) *healthReport {
+		report := &healthReport{Healthy: true}
+		report.add("hostapd", healthPass, "hostapd reports state ENABLED")
+		report.add("dns", healthPass, "DNS server answers on 10.0.60.1")
+		report.add("nat", healthPass, "NAT rules for sharing eth0 are present")
+		return report
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "11"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{getConfigOnPath(dir)}, config), check.IsNil)
+	c.Assert(config["wifi.channel"], check.Equals, "11")
+}
+
+func (s *S) TestChangeConfigurationRollsBackWithoutDNS(c *check.C) {
+	previous := []byte("DISABLED=false\nAPPLY_TIMEOUT=1\nWIFI_CHANNEL=6\n")
+	dir := s.setUpConfiguration(c, string(previous))
+
+	// Any answer counts, so a timeout means dnsmasq failed on the device
+	// itself, e.g. because it couldn't bind port 53
+	checkAccessPointHealth = func(s *service) *healthReport {
+		report := &healthReport{Healthy: true}
+		report.add("hostapd", healthPass, "hostapd reports state ENABLED")
+		report.add("dns", healthFail, "No DNS answer from 10.0.60.1: timeout")
+		report.add("nat", healthPass, "NAT rules for sharing eth0 are present")
+		return report
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "11"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeError)
+	c.Assert(change["err"], check.DeepEquals, map[string]interface{}{
+		"message": "Access point failed to come up with the new configuration (No DNS answer from 10.0.60.1: timeout), previous configuration restored",
+		"kind":    "ap-start-failed",
+	})
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, previous)
+}
+
+func (s *S) TestChangeConfigurationRollsBackWithoutNAT(c *check.C) {
+	previous := []byte("DISABLED=false\nAPPLY_TIMEOUT=1\nWIFI_CHANNEL=6\n")
+	dir := s.setUpConfiguration(c, string(previous))
+
+	// The rules are added by the device itself, with or without an uplink
+	checkAccessPointHealth = func(s *service) *healthReport {
+		report := &healthReport{Healthy: true}
+		report.add("hostapd", healthPass, "hostapd reports state ENABLED")
+		report.add("dns", healthPass, "DNS server answers on 10.0.60.1")
+		report.add("nat", healthFail, "NAT rules for sharing eth0 are missing")
+		return report
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "11"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeError)
+	c.Assert(change["err"], check.DeepEquals, map[string]interface{}{
+		"message": "Access point failed to come up with the new configuration (NAT rules for sharing eth0 are missing), previous configuration restored",
+		"kind":    "ap-start-failed",
+	})
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, previous)
+}
+
+func (s *S) TestPutConfigurationReplacesConfiguration(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Old\nWIFI_CHANNEL=6\n")
+
+	req, err := http.NewRequest(http.MethodPut, "/v1/configuration",
+		strings.NewReader(`{"wifi.ssid": "New", "disabled": false, "wifi.channel": 11}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	putConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["summary"], check.Equals, "Replace configuration")
+	c.Assert(change["result"], check.DeepEquals, map[string]interface{}{
+		"added":   []interface{}{"disabled"},
+		"changed": []interface{}{"wifi.channel", "wifi.ssid"},
+		"removed": []interface{}{},
+	})
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "DISABLED='false'\nWIFI_CHANNEL='11'\nWIFI_SSID='New'\n")
+	c.Assert(cmd.s.ap.Running(), check.Equals, true)
+}
+
+func (s *S) TestGetSystemConfiguration(c *check.C) {
+	s.setUpConfiguration(c, "WIFI_SSID=Depot\n")
+
+	// The interface is a default value which only the merged
+	// configuration contains
+	for query, iface := range map[string]interface{}{
+		"":              "wlan0",
+		"?system=false": "wlan0",
+		"?system=true":  nil,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "/v1/configuration"+query, nil)
+		c.Assert(err, check.IsNil)
+
+		rec := httptest.NewRecorder()
+		getConfiguration(newMockServiceCommand(), rec, req)
+		c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		c.Assert(resp.Result["wifi.ssid"], check.Equals, "Depot")
+		c.Assert(resp.Result["wifi.interface"], check.Equals, iface, check.Commentf(query))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/configuration?system=maybe", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	getConfiguration(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestPutConfigurationKeepsSecrets(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Old\nWIFI_SECURITY=wpa2\nWIFI_SECURITY_PASSPHRASE=secret123\n")
+
+	// An exported configuration without the passphrase
+	req, err := http.NewRequest(http.MethodPut, "/v1/configuration",
+		strings.NewReader(`{"wifi.ssid": "New", "wifi.security": "wpa2"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	putConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+	c.Assert(change["result"], check.DeepEquals, map[string]interface{}{
+		"added":   []interface{}{},
+		"changed": []interface{}{"wifi.ssid"},
+		"removed": []interface{}{},
+	})
+
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{getConfigOnPath(dir)}, config), check.IsNil)
+	c.Assert(config["wifi.security-passphrase"], check.Equals, "secret123")
+}
+
+func (s *S) TestDeleteConfigurationKey(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Old\nWIFI_CHANNEL=6\n")
+
+	cmd := newMockServiceCommand()
+	for key, code := range map[string]int{
+		"wifi.channel":      http.StatusAccepted,
+		"wifi.country-code": http.StatusOK,
+		"bad.token":         http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest(http.MethodDelete, "/v1/configuration/"+key, nil)
+		c.Assert(err, check.IsNil)
+		req = mux.SetURLVars(req, map[string]string{"key": key})
+
+		rec := httptest.NewRecorder()
+		deleteConfigurationKey(cmd, rec, req)
+		c.Assert(rec.Code, check.Equals, code)
+		if code == http.StatusAccepted {
+			waitForChange(c, cmd, rec)
+		}
+	}
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "WIFI_SSID='Old'\n")
+
+	entries, err := listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].ChangedKeys, check.DeepEquals, []string{"wifi.channel"})
+}
+
+func (s *S) TestDeleteConfiguration(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_SSID=Old\nWIFI_CHANNEL=6\n"), 0644), check.IsNil)
+
+	req, err := http.NewRequest(http.MethodDelete, "/v1/configuration", nil)
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	deleteConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["result"].(map[string]interface{})["removed"], check.DeepEquals, []interface{}{"wifi.channel", "wifi.ssid"})
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.HasLen, 0)
+}
+
+func (s *S) TestPutConfigurationValidates(c *check.C) {
+	previous := []byte("WIFI_SSID=Old\n")
+	dir := s.setUpConfiguration(c, string(previous))
+
+	for body, message := range map[string]string{
+		`{"bad.token": "xyz"}`:             `Invalid key "bad.token"`,
+		`{"disabled": "maybe"}`:            `Invalid value "maybe" for "disabled": must be true or false`,
+		`{"wifi.channel": "six"}`:          `Invalid value "six" for "wifi.channel": must be a number or auto`,
+		`{"wifi.ssid": {"nested": "map"}}`: `Invalid value for "wifi.ssid": must be a string, number or boolean`,
+		`[]`:                               "Malformed request",
+	} {
+		req, err := http.NewRequest(http.MethodPut, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+
+		rec := httptest.NewRecorder()
+		putConfiguration(newMockServiceCommand(), rec, req)
+		c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		c.Assert(resp.Result["message"], check.Equals, message)
+	}
+
+	// Nothing was written
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, previous)
+}
+
+func (s *S) TestPutConfigurationReportsAllInvalidItems(c *check.C) {
+	s.setUpConfiguration(c, "")
+
+	req, err := http.NewRequest(http.MethodPut, "/v1/configuration",
+		strings.NewReader(`{"disabled": "maybe", "wifi.channel": "six", "wifi.ssid": "Ubuntu"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	putConfiguration(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"disabled":     `Invalid value "maybe" for "disabled": must be true or false`,
+		"wifi.channel": `Invalid value "six" for "wifi.channel": must be a number or auto`,
+	})
+}
+
+func (s *S) TestPostConfigurationReportsInvalidValues(c *check.C) {
+	dir := s.setUpConfiguration(c, "")
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration",
+		strings.NewReader(`{"disabled": "maybe", "schedule": "garbage", "apply.timeout": "soon", "wifi.ssid": "Ubuntu"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	postConfiguration(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	details := resp.Result["details"].(map[string]interface{})
+	c.Assert(details, check.HasLen, 3)
+	c.Assert(details["disabled"], check.Equals, `Invalid value "maybe" for "disabled": must be true or false`)
+	c.Assert(details["apply.timeout"], check.Equals, `Invalid value "soon" for "apply.timeout": must be a number`)
+	c.Assert(details["schedule"], check.Matches, `Invalid value "garbage" for "schedule": .*`)
+
+	// Nothing was written
+	_, err = os.Stat(getConfigOnPath(dir))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestPostConfigurationChecksSchema(c *check.C) {
+	s.setUpConfiguration(c, "")
+
+	// REST clients don't get around the schema the client checks as well
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration",
+		strings.NewReader(`{"wifi.security": "wep", "wifi.operation-mode": "n"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	postConfiguration(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.security":       `Invalid value "wep" for "wifi.security": must be one of [open wpa2]`,
+		"wifi.operation-mode": `Invalid value "n" for "wifi.operation-mode": must be one of [a b g ad]`,
+	})
+}
+
+func (s *S) TestConcurrentConfigurationChangeConflicts(c *check.C) {
+	cmd := newMockServiceCommand()
+	cmd.s.configMutex.Lock()
+	defer cmd.s.configMutex.Unlock()
+
+	req, err := http.NewRequest(http.MethodDelete, "/v1/configuration", nil)
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	deleteConfiguration(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusConflict)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "conflict")
+
+	// Restarting the access point has to wait as well
+	req, err = http.NewRequest(http.MethodPost, "/v1/status", strings.NewReader(`{"action": "restart-ap"}`))
+	c.Assert(err, check.IsNil)
+
+	rec = httptest.NewRecorder()
+	postStatus(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestPostStatus(c *check.C) {
+	for body, code := range map[string]int{
+		`{"action": "restart-ap"}`: http.StatusAccepted,
+		`{"action": "reboot"}`:     http.StatusBadRequest,
+		`{}`:                       http.StatusBadRequest,
+		`not a JSON content`:       http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest(http.MethodPost, "/v1/status", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+
+		rec := httptest.NewRecorder()
+		cmd := newMockServiceCommand()
+		postStatus(cmd, rec, req)
+		c.Assert(rec.Code, check.Equals, code)
+
+		// Exactly one response is sent
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil, check.Commentf("body %q", body))
+		c.Assert(resp.StatusCode, check.Equals, code)
+
+		if code == http.StatusAccepted {
+			change := waitForChange(c, cmd, rec)
+			c.Assert(change["kind"], check.Equals, "restart-ap")
+			c.Assert(change["status"], check.Equals, changeDone)
+			c.Assert(cmd.s.ap.Running(), check.Equals, true)
+		}
+	}
+}
+
+func (s *S) TestUnknownRoutesAndMethods(c *check.C) {
+	svc := newMockService()
+	svc.addRoutes()
+
+	for _, t := range []struct {
+		method string
+		path   string
+		code   int
+		kind   string
+	}{
+		{http.MethodGet, "/v1/unknown", http.StatusNotFound, "not-found"},
+		{http.MethodDelete, "/v1/status", http.StatusMethodNotAllowed, "method-not-allowed"},
+		// The history isn't a configuration item which could be reset
+		{http.MethodDelete, "/v1/configuration/history", http.StatusBadRequest, "invalid-key"},
+	} {
+		req, err := http.NewRequest(t.method, t.path, nil)
+		c.Assert(err, check.IsNil)
+		req = req.WithContext(context.WithValue(req.Context(), remoteContextKey, true))
+
+		rec := httptest.NewRecorder()
+		svc.router.ServeHTTP(rec, req)
+		c.Assert(rec.Code, check.Equals, t.code)
+
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		c.Assert(resp.Result["kind"], check.Equals, t.kind)
+	}
+}
@@ -16,9 +16,12 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -26,12 +29,33 @@ import (
 	"gopkg.in/tomb.v2"
 )
 
+// Number of output lines we keep around from a background process
+// so that we can report why it terminated.
+const maxRecordedOutputLines = 20
+
+// processExit describes how a background process terminated.
+type processExit struct {
+	Pid      int
+	ExitCode int
+	// Last lines the process wrote to stdout or stderr
+	Output []string
+}
+
+type processExitHandler func(exit processExit)
+
 type backgroundProcessImpl struct {
-	path    string
-	args    []string
-	command *exec.Cmd
-	tomb    *tomb.Tomb
-	mutex   sync.Mutex
+	path        string
+	args        []string
+	tomb        *tomb.Tomb
+	mutex       sync.Mutex
+	output      *outputRecorder
+	exitHandler processExitHandler
+
+	// The goroutine waiting for the process updates these while
+	// Start or Stop may hold the mutex above
+	stateMutex sync.Mutex
+	command    *exec.Cmd
+	pid        int
 }
 
 // BackgroundProcess provides control over a process running in the
@@ -41,6 +65,63 @@ type BackgroundProcess interface {
 	Stop() error
 	Restart() error
 	Running() bool
+	Pid() int
+	SetExitHandler(handler processExitHandler)
+}
+
+// outputRecorder forwards all output of a process to stdout and
+// keeps the last lines of it.
+type outputRecorder struct {
+	mutex sync.Mutex
+	lines []string
+	done  chan struct{}
+}
+
+func newOutputRecorder() *outputRecorder {
+	return &outputRecorder{done: make(chan struct{})}
+}
+
+func (r *outputRecorder) consume(reader io.ReadCloser) {
+	defer close(r.done)
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(os.Stdout, line)
+
+		r.mutex.Lock()
+		r.lines = append(r.lines, line)
+		if len(r.lines) > maxRecordedOutputLines {
+			r.lines = r.lines[1:]
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// Lines waits a short moment for any pending output and returns
+// the recorded lines. Children of the process may still hold the
+// output open so we can't wait until everything is consumed.
+func (r *outputRecorder) Lines() []string {
+	select {
+	case <-r.done:
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// lastErrorLine returns the last line of the given output which
+// reports an error or an empty string if there is none.
+func lastErrorLine(output []string) string {
+	for n := len(output) - 1; n >= 0; n-- {
+		if strings.HasPrefix(output[n], "ERROR:") {
+			return strings.TrimSpace(strings.TrimPrefix(output[n], "ERROR:"))
+		}
+	}
+	return ""
 }
 
 func NewBackgroundProcess(path string, args ...string) (BackgroundProcess, error) {
@@ -63,37 +144,70 @@ func (p *backgroundProcessImpl) Start() error {
 
 	p.mutex.Lock()
 
-	p.command = exec.Command(p.path, p.args...)
-	if p.command == nil {
+	command := exec.Command(p.path, p.args...)
+	if command == nil {
+		p.mutex.Unlock()
 		return fmt.Errorf("Failed to create background process")
 	}
 
-	// Forward output to regular stdout/stderr
-	p.command.Stdout = os.Stdout
-	p.command.Stderr = os.Stderr
+	// Forward output to regular stdout but record it on the way
+	// through. We pass our own pipe here as otherwise waiting for the
+	// process would also wait for any of its children still having
+	// the output open.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		p.mutex.Unlock()
+		return err
+	}
+	command.Stdout = writer
+	command.Stderr = writer
+	p.output = newOutputRecorder()
 
 	// Create a new process group
-	p.command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	p.setCommand(command)
 
 	// We need to recreate the tomb here everytime as otherwise
 	// it will not cleanup its state from the last time.
 	p.tomb = &tomb.Tomb{}
 
-	c := make(chan int)
+	c := make(chan error)
+	output := p.output
 	p.tomb.Go(func() error {
-		err := p.command.Start()
+		err := command.Start()
+		writer.Close()
 		if err != nil {
+			reader.Close()
 			fmt.Printf("Failed to execute process for binary '%s'", p.path)
+			c <- err
 			return err
 		}
-		c <- 1
-		p.command.Wait()
-		p.command = nil
+		go output.consume(reader)
+		p.setPid(command.Process.Pid)
+		c <- nil
+		command.Wait()
+		p.setCommand(nil)
+
+		exit := processExit{
+			Pid:      command.Process.Pid,
+			ExitCode: -1,
+			Output:   output.Lines(),
+		}
+		if status, ok := command.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exit.ExitCode = status.ExitStatus()
+		}
+		if p.exitHandler != nil {
+			p.exitHandler(exit)
+		}
 		return nil
 	})
 
 	// Wait until the process is really started
-	_ = <-c
+	if err := <-c; err != nil {
+		p.setCommand(nil)
+		p.mutex.Unlock()
+		return err
+	}
 
 	p.mutex.Unlock()
 
@@ -111,16 +225,20 @@ func (p *backgroundProcessImpl) Restart() error {
 }
 
 func (p *backgroundProcessImpl) killProcess(signal syscall.Signal) error {
-	if p == nil || p.command == nil {
+	if p == nil {
+		return fmt.Errorf("Process is not running")
+	}
+	command := p.currentCommand()
+	if command == nil || command.Process == nil {
 		return fmt.Errorf("Process is not running")
 	}
 	// We need to kill the whole process group as otherwise some
 	// child processes are still around
-	pgid, err := syscall.Getpgid(p.command.Process.Pid)
+	pgid, err := syscall.Getpgid(command.Process.Pid)
 	if err == nil {
 		syscall.Kill(-pgid, signal)
 	} else {
-		syscall.Kill(p.command.Process.Pid, signal)
+		syscall.Kill(command.Process.Pid, signal)
 	}
 	return nil
 }
@@ -137,11 +255,42 @@ func (p *backgroundProcessImpl) Stop() error {
 	p.tomb.Kill(nil)
 	p.tomb.Wait()
 	timer.Stop()
+	p.setCommand(nil)
 	p.mutex.Unlock()
-	p.command = nil
 	return nil
 }
 
+func (p *backgroundProcessImpl) currentCommand() *exec.Cmd {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.command
+}
+
+func (p *backgroundProcessImpl) setCommand(command *exec.Cmd) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.command = command
+}
+
+func (p *backgroundProcessImpl) setPid(pid int) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.pid = pid
+}
+
 func (p *backgroundProcessImpl) Running() bool {
-	return p.command != nil
+	return p.currentCommand() != nil
+}
+
+// Pid returns the process ID of the last started process.
+func (p *backgroundProcessImpl) Pid() int {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.pid
+}
+
+// SetExitHandler installs a handler which is called whenever the
+// process terminates, regardless whether it was stopped or not.
+func (p *backgroundProcessImpl) SetExitHandler(handler processExitHandler) {
+	p.exitHandler = handler
 }
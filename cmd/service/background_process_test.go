@@ -34,3 +34,20 @@ func (s *S) TestBackgroundProcessStartStop(c *check.C) {
 	c.Assert(p.Start(), check.DeepEquals, fmt.Errorf("Background process is already running"))
 	c.Assert(p.Running(), check.Equals, true)
 }
+
+func (s *S) TestBackgroundProcessExitHandler(c *check.C) {
+	p, err := NewBackgroundProcess("/bin/sh", "-c", "echo 'ERROR: something broke'; exit 3")
+	c.Assert(err, check.IsNil)
+
+	exits := make(chan processExit, 1)
+	p.SetExitHandler(func(exit processExit) {
+		exits <- exit
+	})
+	c.Assert(p.Start(), check.IsNil)
+
+	exit := <-exits
+	c.Assert(exit.Pid, check.Equals, p.Pid())
+	c.Assert(exit.ExitCode, check.Equals, 3)
+	c.Assert(exit.Output, check.DeepEquals, []string{"ERROR: something broke"})
+	c.Assert(lastErrorLine(exit.Output), check.Equals, "something broke")
+}
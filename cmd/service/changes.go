@@ -0,0 +1,204 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status of a change
+const (
+	changeDoing = "Doing"
+	changeDone  = "Done"
+	changeError = "Error"
+)
+
+// Number of changes we keep once they are ready
+const maxChanges = 50
+
+// change tracks a long running operation the service performs in the
+// background on behalf of a client.
+type change struct {
+	mutex     sync.Mutex
+	id        int
+	kind      string
+	summary   string
+	status    string
+	label     string
+	done      int
+	total     int
+	spawnTime time.Time
+	readyTime time.Time
+	err       *serviceResponse
+	result    map[string]interface{}
+	ready     chan struct{}
+}
+
+// step records that the change proceeds with the next of its steps.
+// Calling it on a nil change does nothing.
+func (c *change) step(label string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.label != "" {
+		c.done++
+	}
+	if c.done >= c.total {
+		c.total = c.done + 1
+	}
+	c.label = label
+}
+
+func (c *change) finish(result map[string]interface{}, err *serviceResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readyTime = time.Now()
+	c.result = result
+	c.err = err
+	if err != nil {
+		c.status = changeError
+	} else {
+		c.status = changeDone
+		c.done = c.total
+	}
+	close(c.ready)
+}
+
+// Ready returns whether the change finished.
+func (c *change) Ready() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// toMap returns the change in the format used by the REST API.
+func (c *change) toMap() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	m := map[string]interface{}{
+		"id":         c.id,
+		"kind":       c.kind,
+		"summary":    c.summary,
+		"status":     c.status,
+		"ready":      c.status != changeDoing,
+		"spawn-time": c.spawnTime.Format(time.RFC3339),
+		"progress": map[string]interface{}{
+			"label": c.label,
+			"done":  c.done,
+			"total": c.total,
+		},
+	}
+	if !c.readyTime.IsZero() {
+		m["ready-time"] = c.readyTime.Format(time.RFC3339)
+	}
+	if c.err != nil {
+		m["err"] = c.err.Result
+	}
+	if c.result != nil {
+		m["result"] = c.result
+	}
+	return m
+}
+
+// changeTracker runs changes and keeps them around so that clients can
+// follow them.
+type changeTracker struct {
+	mutex   sync.Mutex
+	lastID  int
+	changes map[int]*change
+}
+
+// start runs the given function as a new change in the background. The
+// function reports its steps on the change and returns the result or
+// an error response.
+func (t *changeTracker) start(kind, summary string, steps int, run func(c *change) (map[string]interface{}, *serviceResponse)) *change {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.changes == nil {
+		t.changes = make(map[int]*change)
+	}
+	t.lastID++
+	c := &change{
+		id:        t.lastID,
+		kind:      kind,
+		summary:   summary,
+		status:    changeDoing,
+		total:     steps,
+		spawnTime: time.Now(),
+		ready:     make(chan struct{}),
+	}
+	t.changes[c.id] = c
+	t.pruneLocked()
+
+	go func() {
+		result, err := run(c)
+		c.finish(result, err)
+	}()
+
+	return c
+}
+
+// pruneLocked forgets the oldest ready changes beyond the limit.
+func (t *changeTracker) pruneLocked() {
+	if len(t.changes) <= maxChanges {
+		return
+	}
+	for _, id := range t.idsLocked() {
+		if len(t.changes) <= maxChanges {
+			break
+		}
+		if t.changes[id].Ready() {
+			delete(t.changes, id)
+		}
+	}
+}
+
+func (t *changeTracker) idsLocked() []int {
+	ids := make([]int, 0, len(t.changes))
+	for id := range t.changes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// get returns the change with the given ID or nil if there is none.
+func (t *changeTracker) get(id int) *change {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.changes[id]
+}
+
+// list returns all known changes, oldest first.
+func (t *changeTracker) list() []*change {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	changes := []*change{}
+	for _, id := range t.idsLocked() {
+		changes = append(changes, t.changes[id])
+	}
+	return changes
+}
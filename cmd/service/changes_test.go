@@ -0,0 +1,150 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/check.v1"
+)
+
+// waitForChange checks that the recorded response refers to a change,
+// waits for it to finish and returns it as the REST API reports it.
+func waitForChange(c *check.C, cmd *serviceCommand, rec *httptest.ResponseRecorder) map[string]interface{} {
+	c.Assert(rec.Code, check.Equals, http.StatusAccepted)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Type, check.Equals, "async")
+
+	id, ok := resp.Result["change"].(float64)
+	c.Assert(ok, check.Equals, true)
+	change := cmd.s.changes.get(int(id))
+	c.Assert(change, check.NotNil)
+
+	select {
+	case <-change.ready:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("change %d did not finish", change.id)
+	}
+
+	data, err := json.Marshal(change.toMap())
+	c.Assert(err, check.IsNil)
+	m := make(map[string]interface{})
+	c.Assert(json.Unmarshal(data, &m), check.IsNil)
+	return m
+}
+
+func (s *S) TestChangeSteps(c *check.C) {
+	var t changeTracker
+	proceed := make(chan bool)
+	change := t.start("test", "Test change", 2, func(change *change) (map[string]interface{}, *serviceResponse) {
+		change.step("First")
+		<-proceed
+		change.step("Second")
+		change.step("Unplanned")
+		return map[string]interface{}{"answer": 42}, nil
+	})
+
+	proceed <- true
+	<-change.ready
+
+	m := change.toMap()
+	c.Assert(m["kind"], check.Equals, "test")
+	c.Assert(m["summary"], check.Equals, "Test change")
+	c.Assert(m["status"], check.Equals, changeDone)
+	c.Assert(m["ready"], check.Equals, true)
+	c.Assert(m["progress"], check.DeepEquals, map[string]interface{}{
+		"label": "Unplanned",
+		"done":  3,
+		"total": 3,
+	})
+	c.Assert(m["result"], check.DeepEquals, map[string]interface{}{"answer": 42})
+	c.Assert(m["err"], check.IsNil)
+}
+
+func (s *S) TestChangeError(c *check.C) {
+	var t changeTracker
+	change := t.start("test", "Failing change", 1, func(change *change) (map[string]interface{}, *serviceResponse) {
+		change.step("Fail")
+		return nil, makeErrorResponse(http.StatusInternalServerError, "Failed", errorKindInternal)
+	})
+	<-change.ready
+
+	m := change.toMap()
+	c.Assert(m["status"], check.Equals, changeError)
+	c.Assert(m["ready"], check.Equals, true)
+	c.Assert(m["err"], check.DeepEquals, map[string]interface{}{
+		"message": "Failed",
+		"kind":    errorKindInternal,
+	})
+	_, ok := m["result"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestChangesArePruned(c *check.C) {
+	var t changeTracker
+	for n := 0; n < maxChanges+5; n++ {
+		change := t.start("test", "Test change", 0, func(change *change) (map[string]interface{}, *serviceResponse) {
+			return nil, nil
+		})
+		<-change.ready
+	}
+
+	changes := t.list()
+	c.Assert(changes, check.HasLen, maxChanges)
+	c.Assert(changes[0].id, check.Equals, 6)
+	c.Assert(t.get(5), check.IsNil)
+}
+
+func (s *S) TestGetChanges(c *check.C) {
+	cmd := newMockServiceCommand()
+	change := cmd.s.changes.start("test", "Test change", 0, func(change *change) (map[string]interface{}, *serviceResponse) {
+		return nil, nil
+	})
+	<-change.ready
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/changes", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	getChanges(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	changes, ok := resp.Result["changes"].([]interface{})
+	c.Assert(ok, check.Equals, true)
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].(map[string]interface{})["summary"], check.Equals, "Test change")
+
+	for id, code := range map[string]int{
+		"1":   http.StatusOK,
+		"42":  http.StatusNotFound,
+		"abc": http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "/v1/changes/"+id, nil)
+		c.Assert(err, check.IsNil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+
+		rec := httptest.NewRecorder()
+		getChange(cmd, rec, req)
+		c.Assert(rec.Code, check.Equals, code)
+	}
+}
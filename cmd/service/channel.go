@@ -0,0 +1,315 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// autoChannel is the value of wifi.channel which lets the service pick
+// the least busy channel whenever the access point starts.
+const autoChannel = "auto"
+
+// File in $SNAP_DATA ap.sh reads the selected channel from
+const autoChannelFileSuffix = "auto-channel"
+
+func autoChannelPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), autoChannelFileSuffix)
+}
+
+// runIw runs the iw utility shipped with the snap and returns its
+// output. Replaced in tests.
+var runIw = func(args ...string) ([]byte, error) {
+	output, err := exec.Command(filepath.Join(os.Getenv("SNAP"), "bin", "iw"), args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iw %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Channels considered on each band if the hardware doesn't tell which
+// ones it supports. 1, 6 and 11 come first as they don't overlap and
+// win ties. DFS channels on 5 GHz are left out as they can't be used
+// right away.
+var (
+	defaultChannels24 = []int{1, 6, 11, 2, 3, 4, 5, 7, 8, 9, 10, 12, 13}
+	defaultChannels5  = []int{36, 40, 44, 48, 149, 153, 157, 161, 165}
+)
+
+// Channels on 2.4 GHz are 20 MHz wide but only 5 MHz apart so networks
+// up to this many channels away interfere.
+const channelOverlap24 = 4
+
+// channelFromFrequency returns the channel number of the given center
+// frequency in MHz or 0 if it is none of the 2.4 or 5 GHz band.
+func channelFromFrequency(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5000 && freq < 5900:
+		return (freq - 5000) / 5
+	}
+	return 0
+}
+
+func is5GHzChannel(channel int) bool {
+	return channel >= 32
+}
+
+// channelSurvey is the survey data the driver collected for a channel.
+type channelSurvey struct {
+	Channel int
+	// Time in ms the channel was observed and found busy
+	ActiveTime int
+	BusyTime   int
+}
+
+// parseSurvey parses the output of iw dev <interface> survey dump.
+func parseSurvey(output []byte) []channelSurvey {
+	var surveys []channelSurvey
+	var current *channelSurvey
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Survey data from") {
+			surveys = append(surveys, channelSurvey{})
+			current = &surveys[len(surveys)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		i := strings.IndexRune(line, ':')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		switch line[:i] {
+		case "frequency":
+			current.Channel = channelFromFrequency(value)
+		case "channel active time":
+			current.ActiveTime = value
+		case "channel busy time":
+			current.BusyTime = value
+		}
+	}
+
+	result := surveys[:0]
+	for _, survey := range surveys {
+		if survey.Channel > 0 {
+			result = append(result, survey)
+		}
+	}
+	return result
+}
+
+// scoreChannels rates every candidate channel of the band by how
+// strongly neighbouring networks on it or overlapping channels are
+// received and, if known, by how busy the driver found it. Lower
+// scores are better.
+func scoreChannels(candidates []int, networks []scannedNetwork, surveys []channelSurvey) map[int]float64 {
+	scores := make(map[int]float64, len(candidates))
+	for _, channel := range candidates {
+		score := 0.0
+		for _, network := range networks {
+			// A network received at -100 dBm or less hardly matters
+			weight := network.Signal + 100
+			if weight < 1 {
+				weight = 1
+			}
+
+			distance := channel - network.Channel
+			if distance < 0 {
+				distance = -distance
+			}
+			if is5GHzChannel(channel) {
+				if distance == 0 {
+					score += weight
+				}
+			} else if distance <= channelOverlap24 {
+				score += weight * float64(channelOverlap24+1-distance) / float64(channelOverlap24+1)
+			}
+		}
+		for _, survey := range surveys {
+			if survey.Channel == channel && survey.ActiveTime > 0 {
+				score += 100 * float64(survey.BusyTime) / float64(survey.ActiveTime)
+			}
+		}
+		scores[channel] = score
+	}
+	return scores
+}
+
+// candidateChannels returns the channels of the band the operation
+// mode uses which the country allows with the configured channel
+// width. Channels the driver has survey
+// data for are preferred over the default list as they are the ones the
+// hardware supports.
+func candidateChannels(config map[string]interface{}, surveys []channelSurvey) []int {
+	operationMode := fmt.Sprint(config["wifi.operation-mode"])
+	defaults := defaultChannels24
+	if operationMode == "a" {
+		defaults = defaultChannels5
+	}
+
+	countryCode := ""
+	if value, ok := config["wifi.country-code"]; ok {
+		countryCode = fmt.Sprint(value)
+	}
+	allowed := lookupRegulatoryDomain(countryCode).channels(operationMode)
+	var legal []int
+	for _, channel := range defaults {
+		// Wide channels have to be allowed as a whole and must not
+		// need radar detection
+		occupied := occupiedChannels(config, channel)
+		usable := containsChannel(occupied, channel)
+		for _, other := range occupied {
+			usable = usable && containsChannel(allowed, other) && !isDFSChannel(other)
+		}
+		if usable {
+			legal = append(legal, channel)
+		}
+	}
+
+	supported := make(map[int]bool)
+	for _, survey := range surveys {
+		supported[survey.Channel] = true
+	}
+
+	var candidates []int
+	for _, channel := range legal {
+		if supported[channel] {
+			candidates = append(candidates, channel)
+		}
+	}
+	if len(candidates) == 0 {
+		return legal
+	}
+	return candidates
+}
+
+// channelSelection is the outcome of an automatic channel selection.
+type channelSelection struct {
+	Channel int
+	Scores  map[int]float64
+	// Why the default channel was used if the survey failed
+	Error string
+}
+
+// bestChannel returns the candidate with the lowest score, earlier
+// candidates win ties.
+func bestChannel(candidates []int, scores map[int]float64) int {
+	best := candidates[0]
+	for _, channel := range candidates[1:] {
+		if scores[channel] < scores[best] {
+			best = channel
+		}
+	}
+	return best
+}
+
+// selectChannel surveys the spectrum with the given interface and
+// picks the least busy channel of the band the country allows for the
+// given configuration. If
+// scanning fails the first default channel of the band is used.
+// Returns nil if the country allows no channel at all.
+func selectChannel(iface string, config map[string]interface{}) *channelSelection {
+	// Survey data is optional, not all drivers provide it
+	var surveys []channelSurvey
+	if output, err := runIw("dev", iface, "survey", "dump"); err == nil {
+		surveys = parseSurvey(output)
+	}
+	candidates := candidateChannels(config, surveys)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	output, err := runIw("dev", iface, "scan")
+	if err != nil {
+		return &channelSelection{Channel: candidates[0], Error: err.Error()}
+	}
+
+	scores := scoreChannels(candidates, parseScan(output), surveys)
+	return &channelSelection{Channel: bestChannel(candidates, scores), Scores: scores}
+}
+
+// toMap returns the selection in the format used by the REST API.
+func (selection *channelSelection) toMap() map[string]interface{} {
+	scores := make(map[string]interface{}, len(selection.Scores))
+	for channel, score := range selection.Scores {
+		scores[strconv.Itoa(channel)] = score
+	}
+
+	m := map[string]interface{}{
+		"channel": selection.Channel,
+		"scores":  scores,
+	}
+	if len(selection.Error) > 0 {
+		m["error"] = selection.Error
+	}
+	return m
+}
+
+// prepareChannel selects a channel if the configuration asks for it or
+// the configured one has to be avoided as radar was detected on it and
+// hands it to ap.sh or radio.sh in the given file. Returns the selection
+// or nil if the configured channel is used.
+func prepareChannel(config map[string]interface{}, iface, path string, avoidDFS bool) *channelSelection {
+	// The selection of a previous start must not override the configured channel
+	os.Remove(path)
+
+	fallback := avoidDFS && usesDFSChannel(config)
+	if (fmt.Sprint(config["wifi.channel"]) != autoChannel && !fallback) || config["disabled"] == true {
+		return nil
+	}
+
+	selection := selectChannel(iface, config)
+	if selection == nil {
+		log.Printf("No channel of operation mode %v is allowed, not selecting one", config["wifi.operation-mode"])
+		return nil
+	}
+	if len(selection.Error) > 0 {
+		log.Printf("Failed to survey channels, using channel %d: %s", selection.Channel, selection.Error)
+	} else if fallback {
+		log.Printf("Selected channel %d instead of channel %v radar was detected on", selection.Channel, config["wifi.channel"])
+	} else {
+		log.Printf("Selected channel %d", selection.Channel)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(selection.Channel)+"\n"), 0644); err != nil {
+		log.Printf("Failed to write selected channel: %s", err)
+	}
+	return selection
+}
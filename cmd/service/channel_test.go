@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+const iwScanOutput = `BSS 00:11:22:33:44:55(on wlan0)
+	TSF: 1234 usec (0d, 00:00:00)
+	freq: 2412
+	beacon interval: 100 TUs
+	capability: ESS Privacy ShortSlotTime (0x0411)
+	signal: -40.00 dBm
+	SSID: Neighbour
+	DS Parameter set: channel 1
+	RSN:	 * Version: 1
+		 * Group cipher: CCMP
+		 * Pairwise ciphers: CCMP
+		 * Authentication suites: PSK
+	HT operation:
+		 * primary channel: 1
+		 * secondary channel offset: above
+		 * STA channel width: any
+BSS 00:11:22:33:44:66(on wlan0)
+	freq: 2437
+	capability: ESS Privacy (0x0011)
+	signal: -85.00 dBm
+	SSID: Far away
+BSS 00:11:22:33:44:77(on wlan0) -- associated
+	freq: 5180.0
+	capability: ESS Privacy (0x0011)
+	signal: -60.00 dBm
+	SSID: Fast
+	RSN:	 * Version: 1
+		 * Authentication suites: SAE
+	VHT operation:
+		 * channel width: 1 (80 MHz)
+		 * center freq segment 1: 42
+BSS 00:11:22:33:44:88(on wlan0)
+	freq: 60480
+	signal: -30.00 dBm
+	SSID: Unknown band
+`
+
+const iwSurveyOutput = `Survey data from wlan0
+	frequency:			2412 MHz [in use]
+	noise:				-95 dBm
+	channel active time:		1000 ms
+	channel busy time:		600 ms
+Survey data from wlan0
+	frequency:			2437 MHz
+	channel active time:		1000 ms
+	channel busy time:		100 ms
+Survey data from wlan0
+	frequency:			2462 MHz
+	channel active time:		1000 ms
+	channel busy time:		200 ms
+`
+
+// mockIw replaces iw with a function returning the given output for
+// the scan and survey commands.
+func mockIw(scan, survey string, scanErr error) (restore func()) {
+	oldRunIw := runIw
+	runIw = func(args ...string) ([]byte, error) {
+		switch strings.Join(args[2:], " ") {
+		case "scan", "scan ap-force":
+			return []byte(scan), scanErr
+		case "survey dump":
+			return []byte(survey), nil
+		}
+		return nil, fmt.Errorf("unexpected iw call %v", args)
+	}
+	return func() { runIw = oldRunIw }
+}
+
+func (s *S) TestChannelFromFrequency(c *check.C) {
+	c.Assert(channelFromFrequency(2412), check.Equals, 1)
+	c.Assert(channelFromFrequency(2472), check.Equals, 13)
+	c.Assert(channelFromFrequency(2484), check.Equals, 14)
+	c.Assert(channelFromFrequency(5180), check.Equals, 36)
+	c.Assert(channelFromFrequency(5825), check.Equals, 165)
+	c.Assert(channelFromFrequency(60480), check.Equals, 0)
+}
+
+func (s *S) TestParseSurvey(c *check.C) {
+	c.Assert(parseSurvey([]byte(iwSurveyOutput)), check.DeepEquals, []channelSurvey{
+		{Channel: 1, ActiveTime: 1000, BusyTime: 600},
+		{Channel: 6, ActiveTime: 1000, BusyTime: 100},
+		{Channel: 11, ActiveTime: 1000, BusyTime: 200},
+	})
+}
+
+func (s *S) TestScoreChannels(c *check.C) {
+	networks := parseScan([]byte(iwScanOutput))
+	scores := scoreChannels([]int{1, 3, 6, 36, 40}, networks, nil)
+	// A strong network interferes with overlapping channels less the
+	// further away they are, 5 GHz channels don't overlap
+	c.Assert(scores[1], check.Equals, 60.0)
+	c.Assert(scores[3], check.Equals, 60.0*3/5+15.0*2/5)
+	c.Assert(scores[6], check.Equals, 15.0)
+	c.Assert(scores[36], check.Equals, 40.0)
+	c.Assert(scores[40], check.Equals, 0.0)
+
+	// Busy time adds to the score
+	scores = scoreChannels([]int{6}, nil, parseSurvey([]byte(iwSurveyOutput)))
+	c.Assert(scores[6], check.Equals, 10.0)
+}
+
+func (s *S) TestSelectChannel(c *check.C) {
+	restore := mockIw(iwScanOutput, iwSurveyOutput, nil)
+	defer restore()
+
+	// Only the channels the driver surveyed are candidates
+	selection := selectChannel("wlan0", map[string]interface{}{"wifi.operation-mode": "g"})
+	c.Assert(selection.Channel, check.Equals, 11)
+	c.Assert(selection.Scores, check.HasLen, 3)
+	c.Assert(selection.Error, check.Equals, "")
+
+	selection = selectChannel("wlan0", map[string]interface{}{"wifi.operation-mode": "a", "wifi.country-code": "US"})
+	c.Assert(selection.Channel, check.Equals, 40)
+	c.Assert(selection.Scores, check.HasLen, len(defaultChannels5))
+
+	// Channel 165 can not be part of an 80 MHz wide channel
+	selection = selectChannel("wlan0", map[string]interface{}{
+		"wifi.operation-mode": "a", "wifi.country-code": "US", "wifi.channel-width": "80",
+	})
+	c.Assert(selection.Scores, check.HasLen, len(defaultChannels5)-1)
+	_, ok := selection.Scores[165]
+	c.Assert(ok, check.Equals, false)
+
+	// The first default channel is used if scanning fails
+	restore = mockIw("", "", fmt.Errorf("Device or resource busy"))
+	selection = selectChannel("wlan0", map[string]interface{}{"wifi.operation-mode": "g"})
+	c.Assert(selection.Channel, check.Equals, 1)
+	c.Assert(selection.Error, check.Equals, "Device or resource busy")
+
+	// Without a country code no 5 GHz channel is allowed
+	c.Assert(selectChannel("wlan0", map[string]interface{}{"wifi.operation-mode": "a"}), check.IsNil)
+}
+
+func (s *S) TestAutoChannelStatus(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	restore := mockIw(iwScanOutput, iwSurveyOutput, nil)
+	defer restore()
+
+	// Static channels are left to ap.sh
+	config := map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "g"}
+	c.Assert(prepareChannel(config, "wlan0", autoChannelPath(), false), check.IsNil)
+
+	config["wifi.channel"] = "auto"
+	selection := prepareChannel(config, "wlan0", autoChannelPath(), false)
+	c.Assert(selection, check.NotNil)
+	data, err := ioutil.ReadFile(autoChannelPath())
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "11\n")
+
+	var status apStatus
+	status.channelSelected(selection)
+	status.launched(42, false, "Ubuntu", "11", "wlan0")
+	m := status.toMap()
+	c.Assert(m["ap.channel"], check.Equals, "11")
+	c.Assert(m["ap.channel-selection"], check.DeepEquals, map[string]interface{}{
+		"channel": 11,
+		"scores":  map[string]interface{}{"1": 120.0, "6": 25.0, "11": 20.0},
+	})
+
+	c.Assert(validateConfigurationValue("wifi.channel", "auto"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.channel", float64(11)), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.channel", "best"), check.NotNil)
+}
@@ -17,10 +17,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -88,30 +90,156 @@ func readConfiguration(paths []string, config map[string]interface{}) (err error
 	return nil
 }
 
-// Escape shell special characters, avoid injection
+// Default values as found in the default configuration file
+var defaultValues map[string]interface{}
+
+// loadDefaultValues reads the default values from the default
+// configuration file of the snap.
+func loadDefaultValues() error {
+	defaultValues = make(map[string]interface{})
+	return readConfigurationFile(filepath.Join(os.Getenv("SNAP"), "conf", "default-config"), defaultValues)
+}
+
+// validateConfigurationValue checks that the value has a type the
+// configuration item can hold and is allowed by its schema.
+func validateConfigurationValue(key string, value interface{}) error {
+	switch value.(type) {
+	case string, bool, float64:
+	default:
+		return fmt.Errorf("Invalid value for %q: must be a string, number or boolean", key)
+	}
+
+	text := fmt.Sprint(value)
+	if item := findSchemaItem(key); item != nil {
+		if err := item.validate(text); err != nil {
+			return err
+		}
+	}
+
+	if (key == "wifi.channel" || key == "radio2.channel") && text != autoChannel {
+		if _, err := strconv.Atoi(text); err != nil {
+			return fmt.Errorf("Invalid value %q for %q: must be a number or %s", text, key, autoChannel)
+		}
+	}
+
+	if key == "wifi.country-code" && len(text) > 0 {
+		if !countryCodePattern.MatchString(text) {
+			return fmt.Errorf("Invalid value %q for %q: must be an ISO 3166-1 country code like US", text, key)
+		}
+		if lookupRegulatoryDomain(text) == nil {
+			return fmt.Errorf("Invalid value %q for %q: %s", text, key, unsupportedCountry(text))
+		}
+	}
+
+	if err := validateCapabilities(key, text); err != nil {
+		return err
+	}
+
+	if key == "wifi.center-channel" && text != autoChannel {
+		if _, err := strconv.Atoi(text); err != nil {
+			return fmt.Errorf("Invalid value %q for %q: must be a number or %s", text, key, autoChannel)
+		}
+	}
+
+	if key == "schedule" || key == "radio2.schedule" {
+		if _, err := parseSchedule(text); err != nil {
+			return fmt.Errorf("Invalid value %q for %q: %s", text, key, err)
+		}
+	}
+	return nil
+}
+
+// validateDependencies checks the items of the given system
+// configuration which depend on each other, like the DHCP range on the
+// network of the access point or the channel on the country code. Each
+// group is only checked if one of its items differs from the previous
+// configuration, so that a configuration stored by an older version
+// doesn't prevent unrelated changes.
+func validateDependencies(previous, config map[string]interface{}) *fieldError {
+	changed := changedKeys(previous, config)
+	effective := effectiveConfiguration(config)
+	if changesAny(changed, networkKeys) {
+		if field := validateNetworkConfiguration(effective); field != nil {
+			return field
+		}
+	}
+	if changesAny(changed, channelKeys) {
+		return validateChannelConfiguration(effective)
+	}
+	return nil
+}
+
+// changesAny returns whether one of the given items is among the
+// changed ones.
+func changesAny(changed, keys []string) bool {
+	for _, key := range keys {
+		for _, item := range changed {
+			if item == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatConfiguration converts the given configuration into the
+// KEY=VALUE format the ap.sh script can source.
+func formatConfiguration(config map[string]interface{}) []byte {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", convertKeyToStorageFormat(key), escapeTextForShell(config[key]))
+	}
+	return b.Bytes()
+}
+
+// Quote values for the shell, avoid injection
 // eg. SSID set to "My AP$(nc -lp 2323 -e /bin/sh)"
-// to get a root shell
+// to get a root shell. Nothing is special within single
+// quotes, so every value is put in them and single quotes
+// within it are closed, escaped and opened again.
 func escapeTextForShell(input interface{}) string {
-	data := fmt.Sprint(input)
-	if strings.ContainsAny(data, "\\\"'`$\n\t #") {
-		data = strings.Replace(data, `\`, `\\`, -1)
-		data = strings.Replace(data, `"`, `\"`, -1)
-		data = strings.Replace(data, "`", "\\`", -1)
-		data = strings.Replace(data, `$`, `\$`, -1)
-		data = `"` + data + `"`
-	}
-	return data
+	return "'" + strings.Replace(fmt.Sprint(input), "'", `'\''`, -1) + "'"
 }
 
-// Do the reverse of escapeTextForShell() here
-// strip any \ followed by \$`"
+// Do the reverse of escapeTextForShell() here. Values
+// are parsed like a shell word so that the unquoted and
+// double quoted values of older and hand written files
+// keep working.
 func unescapeTextByShell(input string) string {
-	input = strings.Trim(input, `"'`)
-	if strings.ContainsAny(input, "\\") {
-		re := regexp.MustCompile("\\\\([\\\\$\\`\\\"])")
-		input = re.ReplaceAllString(input, "$1")
+	var b bytes.Buffer
+	for i := 0; i < len(input); i++ {
+		switch ch := input[i]; ch {
+		case '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end < 0 {
+				end = len(input) - i - 1
+			}
+			b.WriteString(input[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			for i++; i < len(input) && input[i] != '"'; i++ {
+				// Within double quotes only these are escaped
+				if input[i] == '\\' && i+1 < len(input) && strings.IndexByte("\\$`\"", input[i+1]) >= 0 {
+					i++
+				}
+				b.WriteByte(input[i])
+			}
+		case '\\':
+			if i+1 < len(input) {
+				i++
+			}
+			b.WriteByte(input[i])
+		default:
+			b.WriteByte(ch)
+		}
 	}
-	return input
+	return b.String()
 }
 
 func loadValidTokens(path string) (map[string]bool, error) {
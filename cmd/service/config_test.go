@@ -16,6 +16,8 @@
 package main
 
 import (
+	"os/exec"
+
 	"gopkg.in/check.v1"
 )
 
@@ -53,14 +55,41 @@ func (s *S) TestConvertKeyToStorageFormat(c *check.C) {
 // List of malicious tokens which needs to be escaped
 func (s *S) TestEscapeShell(c *check.C) {
 	cmds := [...][2]string{
-		{"my_ap", "my_ap"},
-		{`my ap`, `"my ap"`},
-		{`my "ap"`, `"my \"ap\""`},
-		{`$(ps ax)`, `"\$(ps ax)"`},
-		{"`ls /`", "\"\\`ls /\\`\""},
-		{`c:\dir`, `"c:\\dir"`},
+		{"my_ap", `'my_ap'`},
+		{`my ap`, `'my ap'`},
+		{`my "ap"`, `'my "ap"'`},
+		{`it's`, `'it'\''s'`},
+		{`$(ps ax)`, `'$(ps ax)'`},
+		{"`ls /`", "'`ls /`'"},
+		{`c:\dir`, `'c:\dir'`},
+		{"a;reboot", `'a;reboot'`},
 	}
 	for _, st := range cmds {
 		c.Assert(escapeTextForShell(st[0]), check.Equals, st[1])
+		c.Assert(unescapeTextByShell(st[1]), check.Equals, st[0])
+	}
+
+	// Values written by older versions and by hand stay readable
+	for input, value := range map[string]string{
+		`plain`:          "plain",
+		`"my ap"`:        "my ap",
+		`"my \"ap\""`:    `my "ap"`,
+		`"\$(ps ax)"`:    "$(ps ax)",
+		"\"\\`ls /\\`\"": "`ls /`",
+		`"c:\\dir"`:      `c:\dir`,
+		`""`:             "",
+		`'a'"b"c`:        "abc",
+	} {
+		c.Assert(unescapeTextByShell(input), check.Equals, value, check.Commentf("input %s", input))
+	}
+}
+
+// Every shell meta character comes out of the shell as it went in
+func (s *S) TestEscapeShellMetaCharacters(c *check.C) {
+	for _, ch := range []string{"|", "&", ";", "<", ">", "(", ")", "$", "`", "\\", "\"", "'", " ", "\t", "\n", "*", "?", "[", "]", "#", "~", "=", "%", "{", "}", "!"} {
+		value := "x" + ch + "reboot" + ch
+		output, err := exec.Command("sh", "-c", "VALUE="+escapeTextForShell(value)+"\nprintf %s \"$VALUE\"").CombinedOutput()
+		c.Assert(err, check.IsNil, check.Commentf("character %q", ch))
+		c.Assert(string(output), check.Equals, value, check.Commentf("character %q", ch))
 	}
 }
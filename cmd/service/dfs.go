@@ -0,0 +1,305 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DFS states of the channel the access point operates on
+const (
+	dfsStateCAC           = "cac"
+	dfsStateCACFailed     = "cac-failed"
+	dfsStateAvailable     = "available"
+	dfsStateRadarDetected = "radar-detected"
+)
+
+// Time a channel radar was detected on must not be used
+const nonOccupancyPeriod = 30 * time.Minute
+
+// dfsStatus is the state of a channel which requires radar detection.
+type dfsStatus struct {
+	State   string
+	Channel int
+	// End of the channel availability check if one is running
+	CACEnd time.Time
+}
+
+// toMap returns the DFS state in the format used by the REST API.
+func (dfs *dfsStatus) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"state":   dfs.State,
+		"channel": dfs.Channel,
+	}
+	if dfs.State == dfsStateCAC {
+		remaining := int(time.Until(dfs.CACEnd).Seconds())
+		if remaining < 0 {
+			remaining = 0
+		}
+		m["cac-remaining"] = remaining
+	}
+	return m
+}
+
+// radarDetection is a radar hit reported by hostapd.
+type radarDetection struct {
+	Time    time.Time
+	Channel int
+	// Whether the access point moves to a channel without DFS
+	Fallback bool
+}
+
+// toMap returns the radar detection in the format used by the REST API.
+func (radar *radarDetection) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"time":     radar.Time.Format(time.RFC3339),
+		"channel":  radar.Channel,
+		"fallback": radar.Fallback,
+	}
+}
+
+// usesDFSChannel returns whether the configured static channel
+// occupies a channel which requires radar detection.
+func usesDFSChannel(config map[string]interface{}) bool {
+	channel, err := strconv.Atoi(fmt.Sprint(config["wifi.channel"]))
+	if err != nil || config["wifi.operation-mode"] != "a" {
+		return false
+	}
+	for _, occupied := range occupiedChannels(config, channel) {
+		if isDFSChannel(occupied) {
+			return true
+		}
+	}
+	return false
+}
+
+// Time we wait for replies of hostapd and between attempts to connect
+var hostapdInterval = time.Second
+
+// Directory of the hostapd control sockets, see ctrl_interface in ap.sh
+func hostapdControlPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "hostapd")
+}
+
+// hostapdConn is a connection to the control socket of hostapd.
+type hostapdConn struct {
+	conn  *net.UnixConn
+	local string
+}
+
+// dialHostapd connects to the control socket of the hostapd serving
+// the given interface. hostapd sends its replies to the address of the
+// client so the connection is bound to a socket of its own named after
+// the given id.
+func dialHostapd(iface string, id int) (*hostapdConn, error) {
+	local := filepath.Join(os.Getenv("SNAP_DATA"), fmt.Sprintf("hostapd-monitor-%d", id))
+	os.Remove(local)
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: filepath.Join(hostapdControlPath(), iface), Net: "unixgram"})
+	if err != nil {
+		os.Remove(local)
+		return nil, err
+	}
+	return &hostapdConn{conn: conn, local: local}, nil
+}
+
+func (h *hostapdConn) close() {
+	h.conn.Close()
+	os.Remove(h.local)
+}
+
+// request sends a command to hostapd and returns its reply.
+func (h *hostapdConn) request(command string) (string, error) {
+	h.conn.SetDeadline(time.Now().Add(hostapdInterval))
+	if _, err := h.conn.Write([]byte(command)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := h.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		// Events start with their level like <3>
+		if reply := string(buf[:n]); !strings.HasPrefix(reply, "<") {
+			return reply, nil
+		}
+	}
+}
+
+// readEvent waits for the next event hostapd sends. Returns an empty
+// event if none arrived in time.
+func (h *hostapdConn) readEvent() (string, error) {
+	h.conn.SetReadDeadline(time.Now().Add(hostapdInterval))
+	buf := make([]byte, 4096)
+	n, err := h.conn.Read(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return "", nil
+	}
+	return string(buf[:n]), err
+}
+
+// parseHostapdEvent splits an event like
+// "<3>DFS-CAC-START freq=5260 chan=52 cac_time=60s" into its name and
+// parameters.
+func parseHostapdEvent(message string) (string, map[string]string) {
+	if i := strings.Index(message, ">"); strings.HasPrefix(message, "<") && i > 0 {
+		message = message[i+1:]
+	}
+	params := make(map[string]string)
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return "", params
+	}
+	for _, field := range fields[1:] {
+		if param := strings.SplitN(strings.TrimSuffix(field, ","), "=", 2); len(param) == 2 {
+			params[param[0]] = param[1]
+		}
+	}
+	return fields[0], params
+}
+
+// parseHostapdStatus parses the key=value lines hostapd replies to
+// the STATUS command with.
+func parseHostapdStatus(reply string) map[string]string {
+	status := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if item := strings.SplitN(line, "=", 2); len(item) == 2 {
+			status[item[0]] = item[1]
+		}
+	}
+	return status
+}
+
+// monitorHostapd follows the DFS events of the hostapd the access point
+// process with the given pid starts for as long as the process is the
+// current one of the given status or until stop is closed.
+func (s *service) monitorHostapd(status *apStatus, pid int, iface string, stop <-chan struct{}) {
+	var conn *hostapdConn
+	for conn == nil {
+		if !status.current(pid) {
+			return
+		}
+		var err error
+		if conn, err = dialHostapd(iface, pid); err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(hostapdInterval):
+			}
+		}
+	}
+	defer conn.close()
+
+	// A channel availability check might have started before we got here
+	if reply, err := conn.request("STATUS"); err == nil {
+		state := parseHostapdStatus(reply)
+		if state["state"] == "DFS" {
+			channel, _ := strconv.Atoi(state["channel"])
+			left, _ := strconv.Atoi(state["cac_time_left_seconds"])
+			status.cacStarted(pid, channel, time.Duration(left)*time.Second)
+		}
+	}
+
+	if reply, err := conn.request("ATTACH"); err != nil || strings.TrimSpace(reply) != "OK" {
+		log.Printf("Failed to attach to hostapd: %v %s", err, reply)
+		return
+	}
+
+	for status.current(pid) {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		message, err := conn.readEvent()
+		if err != nil {
+			log.Printf("Failed to receive hostapd events: %s", err)
+			return
+		}
+		if len(message) > 0 {
+			s.handleHostapdEvent(status, pid, message)
+		}
+	}
+}
+
+// handleHostapdEvent updates the given status with the DFS events of
+// hostapd and reports them as events.
+func (s *service) handleHostapdEvent(status *apStatus, pid int, message string) {
+	name, params := parseHostapdEvent(message)
+	frequency, _ := strconv.Atoi(params["freq"])
+	channel := channelFromFrequency(frequency)
+	data := map[string]interface{}{"channel": channel, "frequency": frequency}
+
+	switch name {
+	case "DFS-CAC-START":
+		duration, _ := strconv.Atoi(strings.TrimSuffix(params["cac_time"], "s"))
+		data["cac-time"] = duration
+		status.cacStarted(pid, channel, time.Duration(duration)*time.Second)
+		s.events.add("dfs-cac-started", data,
+			"Channel availability check on channel %d started, takes %d seconds", channel, duration)
+	case "DFS-CAC-COMPLETED":
+		if params["success"] == "1" {
+			status.cacFinished(pid, true)
+			s.events.add("dfs-cac-completed", data, "Channel availability check on channel %d completed", channel)
+		} else {
+			status.cacFinished(pid, false)
+			s.events.add("dfs-cac-failed", data, "Channel availability check on channel %d failed", channel)
+		}
+	case "DFS-RADAR-DETECTED":
+		fallback := s.dfsFallbackEnabled()
+		data["fallback"] = fallback
+		status.radarDetected(pid, channel, fallback)
+		s.events.add("dfs-radar-detected", data, "Radar detected on channel %d", channel)
+		if fallback {
+			go s.restartAfterRadar()
+		}
+	case "DFS-NEW-CHANNEL":
+		status.channelMoved(pid, channel)
+		s.events.add("dfs-channel-moved", data, "Moved to channel %d after radar detection", channel)
+	case "DFS-NOP-FINISHED":
+		s.events.add("dfs-nop-finished", data,
+			"Non-occupancy period of channel %d ended, it may be used again", channel)
+	}
+}
+
+func (s *service) dfsFallbackEnabled() bool {
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		return false
+	}
+	return isEnabled(config, "wifi.dfs-fallback")
+}
+
+// restartAfterRadar restarts the access point so that it moves to a
+// channel without DFS.
+func (s *service) restartAfterRadar() {
+	// A configuration change in progress restarts the access point anyway
+	if !s.configMutex.TryLock() {
+		return
+	}
+	defer s.configMutex.Unlock()
+	if err := s.restartAccessPoint(); err != nil {
+		log.Printf("Failed to restart access point after radar detection: %s", err)
+	}
+}
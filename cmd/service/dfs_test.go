@@ -0,0 +1,201 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseHostapdEvent(c *check.C) {
+	name, params := parseHostapdEvent("<3>DFS-CAC-START freq=5260 chan=52 sec_chan=1, width=1, seg0=58, seg1=0, cac_time=60s")
+	c.Assert(name, check.Equals, "DFS-CAC-START")
+	c.Assert(params, check.DeepEquals, map[string]string{
+		"freq": "5260", "chan": "52", "sec_chan": "1", "width": "1", "seg0": "58", "seg1": "0", "cac_time": "60s",
+	})
+
+	name, params = parseHostapdEvent("")
+	c.Assert(name, check.Equals, "")
+	c.Assert(params, check.HasLen, 0)
+}
+
+func (s *S) TestHostapdEvents(c *check.C) {
+	dir := c.MkDir()
+	oldConfigPaths := configurationPaths
+	configurationPaths = []string{"../../conf/default-config", getConfigOnPath(dir)}
+	defer func() { configurationPaths = oldConfigPaths }()
+
+	svc := newMockService()
+	svc.status.launched(42, false, "Ubuntu", "52", "wlan0")
+
+	svc.handleHostapdEvent(&svc.status, 42, "<3>DFS-CAC-START freq=5260 chan=52 sec_chan=0, width=0, seg0=0, seg1=0, cac_time=60s")
+	status := svc.status.toMap()
+	dfs := status["ap.dfs"].(map[string]interface{})
+	c.Assert(dfs["state"], check.Equals, dfsStateCAC)
+	c.Assert(dfs["channel"], check.Equals, 52)
+	c.Assert(dfs["cac-remaining"].(int) > 50, check.Equals, true)
+	c.Assert(svc.status.cacEnd().After(time.Now().Add(50*time.Second)), check.Equals, true)
+
+	// Events of previous processes are ignored
+	svc.handleHostapdEvent(&svc.status, 41, "<3>DFS-CAC-COMPLETED success=0 freq=5260")
+	c.Assert(svc.status.toMap()["ap.dfs"].(map[string]interface{})["state"], check.Equals, dfsStateCAC)
+
+	svc.handleHostapdEvent(&svc.status, 42, "<3>DFS-CAC-COMPLETED success=1 freq=5260 ht_enabled=0 chan_offset=0 chan_width=0 cf1=5260 cf2=0")
+	c.Assert(svc.status.toMap()["ap.dfs"], check.DeepEquals, map[string]interface{}{
+		"state":   dfsStateAvailable,
+		"channel": 52,
+	})
+	c.Assert(svc.status.cacEnd().IsZero(), check.Equals, true)
+
+	svc.handleHostapdEvent(&svc.status, 42, "<3>DFS-RADAR-DETECTED freq=5260 ht_enabled=0 chan_offset=0 chan_width=0 cf1=5260 cf2=0")
+	status = svc.status.toMap()
+	c.Assert(status["ap.dfs"].(map[string]interface{})["state"], check.Equals, dfsStateRadarDetected)
+	radar := status["ap.last-radar"].(map[string]interface{})
+	c.Assert(radar["channel"], check.Equals, 52)
+	c.Assert(radar["fallback"], check.Equals, false)
+	c.Assert(svc.status.radarFallback(), check.Equals, false)
+
+	svc.handleHostapdEvent(&svc.status, 42, "<3>DFS-NEW-CHANNEL freq=5180 chan=36 sec_chan=0")
+	status = svc.status.toMap()
+	c.Assert(status["ap.channel"], check.Equals, "36")
+	_, ok := status["ap.dfs"]
+	c.Assert(ok, check.Equals, false)
+
+	events, _ := svc.events.since(0)
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	c.Assert(kinds, check.DeepEquals, []string{
+		"dfs-cac-started", "dfs-cac-failed", "dfs-cac-completed", "dfs-radar-detected", "dfs-channel-moved",
+	})
+	c.Assert(events[0].Message, check.Equals, "Channel availability check on channel 52 started, takes 60 seconds")
+	c.Assert(events[3].Data, check.DeepEquals, map[string]interface{}{"channel": 52, "frequency": 5260, "fallback": false})
+}
+
+func (s *S) TestMonitorHostapd(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	oldHostapdInterval := hostapdInterval
+	hostapdInterval = 100 * time.Millisecond
+	defer func() { hostapdInterval = oldHostapdInterval }()
+
+	c.Assert(os.Mkdir(hostapdControlPath(), 0755), check.IsNil)
+	hostapd, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(hostapdControlPath(), "wlan0"), Net: "unixgram"})
+	c.Assert(err, check.IsNil)
+	defer hostapd.Close()
+
+	// Behave like hostapd checking the channel for radar
+	go func() {
+		replies := map[string]string{
+			"STATUS": "state=DFS\nchannel=52\ncac_time_seconds=60\ncac_time_left_seconds=42\n",
+			"ATTACH": "OK\n",
+		}
+		buf := make([]byte, 4096)
+		for range replies {
+			n, client, err := hostapd.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			hostapd.WriteToUnix([]byte(replies[string(buf[:n])]), client)
+			if string(buf[:n]) == "ATTACH" {
+				hostapd.WriteToUnix([]byte("<3>DFS-CAC-COMPLETED success=1 freq=5260"), client)
+			}
+		}
+	}()
+
+	svc := newMockService()
+	svc.status.launched(42, false, "Ubuntu", "52", "wlan0")
+	done := make(chan struct{})
+	go func() {
+		svc.monitorHostapd(&svc.status, 42, "wlan0", make(chan struct{}))
+		close(done)
+	}()
+
+	for n := 0; n < 50; n++ {
+		if events, _ := svc.events.since(0); len(events) > 0 {
+			break
+		}
+		time.Sleep(hostapdInterval)
+	}
+	c.Assert(svc.status.toMap()["ap.dfs"], check.DeepEquals, map[string]interface{}{
+		"state":   dfsStateAvailable,
+		"channel": 52,
+	})
+
+	// The monitor stops with the access point
+	svc.status.transition(apStateStopping, "")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Monitor did not stop")
+	}
+	_, err = os.Stat(filepath.Join(dir, "hostapd-monitor-42"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestMonitorsStopWithAccessPoint(c *check.C) {
+	s.setUpConfiguration(c, "DISABLED=false\n")
+	svc := newMockService()
+	c.Assert(svc.restartAccessPoint(), check.IsNil)
+
+	// Stopping waits for the goroutines following hostapd
+	stopped := false
+	svc.apMonitors.start(func(stop <-chan struct{}) {
+		<-stop
+		stopped = true
+	})
+	c.Assert(svc.stopAccessPoint(), check.IsNil)
+	c.Assert(stopped, check.Equals, true)
+}
+
+func (s *S) TestRadarFallback(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	restore := mockIw(iwScanOutput, iwSurveyOutput, nil)
+	defer restore()
+
+	config := map[string]interface{}{"wifi.channel": "52", "wifi.operation-mode": "a", "wifi.country-code": "DE"}
+	c.Assert(prepareChannel(config, "wlan0", autoChannelPath(), false), check.IsNil)
+
+	// Without DFS channel there is nothing to avoid
+	config["wifi.channel"] = "36"
+	c.Assert(prepareChannel(config, "wlan0", autoChannelPath(), true), check.IsNil)
+
+	config["wifi.channel"] = "52"
+	selection := prepareChannel(config, "wlan0", autoChannelPath(), true)
+	c.Assert(selection, check.NotNil)
+	c.Assert(isDFSChannel(selection.Channel), check.Equals, false)
+	_, err := ioutil.ReadFile(autoChannelPath())
+	c.Assert(err, check.IsNil)
+
+	// A later start with the configured channel drops the selection
+	c.Assert(prepareChannel(config, "wlan0", autoChannelPath(), false), check.IsNil)
+	_, err = os.Stat(autoChannelPath())
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	var status apStatus
+	status.launched(42, false, "Ubuntu", "52", "wlan0")
+	status.radarDetected(42, 52, true)
+	c.Assert(status.radarFallback(), check.Equals, true)
+	status.lastRadar.Time = time.Now().Add(-nonOccupancyPeriod)
+	c.Assert(status.radarFallback(), check.Equals, false)
+}
@@ -0,0 +1,92 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Number of events we keep for clients catching up
+const maxEvents = 100
+
+// Longest time clients may wait for new events
+const maxEventWait = 60 * time.Second
+
+// event is something which happened to the access point clients may
+// want to react on, like radar detected on its channel.
+type event struct {
+	ID      int                    `json:"id"`
+	Time    time.Time              `json:"time"`
+	Kind    string                 `json:"kind"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// eventLog keeps the most recent events. The zero value is an empty
+// log.
+type eventLog struct {
+	mutex  sync.Mutex
+	lastID int
+	events []event
+	// Closed when the next event is added
+	added chan struct{}
+}
+
+// add records a new event and wakes up the clients waiting for one.
+func (l *eventLog) add(kind string, data map[string]interface{}, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.lastID++
+	e := event{
+		ID:      l.lastID,
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Data:    data,
+	}
+	log.Printf("%s: %s", kind, e.Message)
+
+	l.events = append(l.events, e)
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+	if l.added != nil {
+		close(l.added)
+		l.added = nil
+	}
+}
+
+// since returns the events after the one with the given id and a
+// channel which is closed when the next event is added.
+func (l *eventLog) since(after int) ([]event, <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := []event{}
+	for _, e := range l.events {
+		if e.ID > after {
+			events = append(events, e)
+		}
+	}
+	if l.added == nil {
+		l.added = make(chan struct{})
+	}
+	return events, l.added
+}
@@ -0,0 +1,79 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestGetEvents(c *check.C) {
+	cmd := newMockServiceCommand()
+	cmd.s.events.add("dfs-cac-started", nil, "first")
+	cmd.s.events.add("dfs-cac-completed", map[string]interface{}{"channel": 52}, "second")
+
+	get := func(path string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		getEvents(cmd, rec, req)
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		return rec.Code, resp.Result
+	}
+
+	code, result := get("/v1/events")
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(result["events"], check.HasLen, 2)
+
+	code, result = get("/v1/events?after=1")
+	c.Assert(code, check.Equals, http.StatusOK)
+	events := result["events"].([]interface{})
+	c.Assert(events, check.HasLen, 1)
+	e := events[0].(map[string]interface{})
+	c.Assert(e["id"], check.Equals, 2.0)
+	c.Assert(e["kind"], check.Equals, "dfs-cac-completed")
+	c.Assert(e["message"], check.Equals, "second")
+	c.Assert(e["data"], check.DeepEquals, map[string]interface{}{"channel": 52.0})
+
+	code, _ = get("/v1/events?after=first")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	code, _ = get("/v1/events?wait=-1")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	// Waiting clients get the next event as soon as it is added
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cmd.s.events.add("dfs-radar-detected", nil, "third")
+	}()
+	code, result = get("/v1/events?after=2&wait=10")
+	c.Assert(code, check.Equals, http.StatusOK)
+	events = result["events"].([]interface{})
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].(map[string]interface{})["kind"], check.Equals, "dfs-radar-detected")
+
+	// Only the most recent events are kept
+	for n := 0; n < maxEvents; n++ {
+		cmd.s.events.add("dfs-nop-finished", nil, "more")
+	}
+	all, _ := cmd.s.events.since(0)
+	c.Assert(all, check.HasLen, maxEvents)
+	c.Assert(all[0].ID, check.Equals, 4)
+}
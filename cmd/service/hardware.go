@@ -0,0 +1,381 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where the kernel lists the wireless devices
+var sysClassIeee80211 = "/sys/class/ieee80211"
+
+// phyChannel is a channel a band of a wireless device supports.
+type phyChannel struct {
+	Channel   int  `json:"channel"`
+	Frequency int  `json:"frequency"`
+	Disabled  bool `json:"disabled"`
+	DFS       bool `json:"dfs"`
+}
+
+// phyBand is a frequency band a wireless device supports with the
+// capabilities it has there. HT and VHT hold the capabilities as
+// printed by iw and are nil if the band does not support them.
+type phyBand struct {
+	Band     string       `json:"band"`
+	Channels []phyChannel `json:"channels"`
+	HT       []string     `json:"ht"`
+	VHT      []string     `json:"vht"`
+	HE       bool         `json:"he"`
+}
+
+// interfaceLimit is the maximum number of interfaces of the given
+// types in an interface combination.
+type interfaceLimit struct {
+	Types []string `json:"types"`
+	Max   int      `json:"max"`
+}
+
+// interfaceCombination is a set of interfaces a wireless device can
+// operate at the same time.
+type interfaceCombination struct {
+	Limits   []interfaceLimit `json:"limits"`
+	Total    int              `json:"total"`
+	Channels int              `json:"channels"`
+}
+
+// allows returns if interfaces of the given types can be operated
+// together. Trying the limits in order is sufficient as drivers list
+// each interface type in one limit only.
+func (combination interfaceCombination) allows(types ...string) bool {
+	if len(types) > combination.Total {
+		return false
+	}
+	used := make([]int, len(combination.Limits))
+	for _, ifaceType := range types {
+		found := false
+		for n, limit := range combination.Limits {
+			if used[n] < limit.Max && containsString(limit.Types, ifaceType) {
+				used[n]++
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// wirelessPhy is a wireless device as reported by iw list.
+type wirelessPhy struct {
+	Name       string   `json:"name"`
+	Driver     string   `json:"driver"`
+	Interfaces []string `json:"interfaces"`
+	// Supported interface modes like managed or AP
+	Modes []string `json:"modes"`
+	// Whether an access point can be operated
+	AccessPoint bool `json:"ap"`
+	// Whether an access point can be operated next to a managed
+	// connection, as needed for wifi.interface-mode=virtual
+	VirtualAccessPoint bool `json:"virtual-ap"`
+	// Maximum number of stations in AP mode, 0 if unknown
+	MaxStations  int                    `json:"max-stations"`
+	Bands        []phyBand              `json:"bands"`
+	Combinations []interfaceCombination `json:"combinations"`
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	iwFrequencyPattern   = regexp.MustCompile(`^\* ([0-9]+)(?:\.[0-9]+)? MHz \[([0-9]+)\](.*)$`)
+	iwLimitPattern       = regexp.MustCompile(`#\{\s*([^}]*)\}\s*<=\s*([0-9]+)`)
+	iwTotalPattern       = regexp.MustCompile(`total <= ([0-9]+)`)
+	iwNumChannelsPattern = regexp.MustCompile(`#channels <= ([0-9]+)`)
+)
+
+// Name of the band the frequency in MHz belongs to
+func bandName(frequency int) string {
+	switch {
+	case frequency < 3000:
+		return "2.4GHz"
+	case frequency < 5925:
+		return "5GHz"
+	case frequency < 7200:
+		return "6GHz"
+	}
+	return "60GHz"
+}
+
+func parseCombination(text string) interfaceCombination {
+	combination := interfaceCombination{Limits: []interfaceLimit{}}
+	for _, match := range iwLimitPattern.FindAllStringSubmatch(text, -1) {
+		limit := interfaceLimit{Types: []string{}}
+		for _, ifaceType := range strings.Split(match[1], ",") {
+			limit.Types = append(limit.Types, strings.TrimSpace(ifaceType))
+		}
+		limit.Max, _ = strconv.Atoi(match[2])
+		combination.Limits = append(combination.Limits, limit)
+	}
+	if match := iwTotalPattern.FindStringSubmatch(text); match != nil {
+		combination.Total, _ = strconv.Atoi(match[1])
+	}
+	if match := iwNumChannelsPattern.FindStringSubmatch(text); match != nil {
+		combination.Channels, _ = strconv.Atoi(match[1])
+	}
+	return combination
+}
+
+// parsePhys parses the output of iw list. The sections of a device are
+// nested by indentation with tabs.
+func parsePhys(output []byte) []wirelessPhy {
+	var phys []wirelessPhy
+	var phy *wirelessPhy
+	var band *phyBand
+	var combinations []string
+	// Sections of the current device and band the lines belong to
+	section, bandSection := "", ""
+
+	finish := func() {
+		if phy == nil {
+			return
+		}
+		for _, text := range combinations {
+			combination := parseCombination(text)
+			phy.Combinations = append(phy.Combinations, combination)
+			if combination.allows("managed", "AP") {
+				phy.VirtualAccessPoint = true
+			}
+		}
+		phy.AccessPoint = containsString(phy.Modes, "AP")
+		phy.VirtualAccessPoint = phy.VirtualAccessPoint && phy.AccessPoint
+		combinations = nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		content := strings.TrimSpace(line)
+
+		if depth == 0 {
+			if strings.HasPrefix(content, "Wiphy ") {
+				finish()
+				phys = append(phys, wirelessPhy{
+					Name:         strings.TrimPrefix(content, "Wiphy "),
+					Interfaces:   []string{},
+					Modes:        []string{},
+					Bands:        []phyBand{},
+					Combinations: []interfaceCombination{},
+				})
+				phy = &phys[len(phys)-1]
+				band = nil
+			}
+			continue
+		}
+		if phy == nil {
+			continue
+		}
+
+		switch {
+		case depth == 1:
+			bandSection = ""
+			switch {
+			case strings.HasPrefix(content, "Band "):
+				section = "band"
+				phy.Bands = append(phy.Bands, phyBand{Channels: []phyChannel{}})
+				band = &phy.Bands[len(phy.Bands)-1]
+			case content == "Supported interface modes:":
+				section = "modes"
+			case content == "valid interface combinations:":
+				section = "combinations"
+			case strings.HasPrefix(content, "Maximum associated stations in AP mode:"):
+				section = ""
+				phy.MaxStations, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(content,
+					"Maximum associated stations in AP mode:")))
+			default:
+				section = ""
+			}
+		case section == "modes" && strings.HasPrefix(content, "* "):
+			phy.Modes = append(phy.Modes, strings.TrimPrefix(content, "* "))
+		case section == "combinations":
+			// Long combinations continue on the following lines
+			if strings.HasPrefix(content, "* ") {
+				combinations = append(combinations, strings.TrimPrefix(content, "* "))
+			} else if len(combinations) > 0 {
+				combinations[len(combinations)-1] += " " + content
+			}
+		case section == "band" && depth == 2:
+			switch {
+			case strings.HasPrefix(content, "Capabilities:"):
+				bandSection = "ht"
+				band.HT = []string{}
+			case strings.HasPrefix(content, "VHT Capabilities"):
+				bandSection = "vht"
+				band.VHT = []string{}
+			case strings.HasPrefix(content, "HE Iftypes:"):
+				bandSection = ""
+				for _, ifaceType := range strings.Split(strings.TrimPrefix(content, "HE Iftypes:"), ",") {
+					if strings.TrimSpace(ifaceType) == "AP" {
+						band.HE = true
+					}
+				}
+			case content == "Frequencies:":
+				bandSection = "frequencies"
+			default:
+				bandSection = ""
+			}
+		case section == "band" && depth == 3:
+			switch bandSection {
+			case "ht":
+				band.HT = append(band.HT, content)
+			case "vht":
+				band.VHT = append(band.VHT, content)
+			case "frequencies":
+				match := iwFrequencyPattern.FindStringSubmatch(content)
+				if match == nil {
+					continue
+				}
+				channel := phyChannel{
+					Disabled: strings.Contains(match[3], "(disabled)"),
+					DFS:      strings.Contains(match[3], "(radar detection)"),
+				}
+				channel.Frequency, _ = strconv.Atoi(match[1])
+				channel.Channel, _ = strconv.Atoi(match[2])
+				if len(band.Channels) == 0 {
+					band.Band = bandName(channel.Frequency)
+				}
+				band.Channels = append(band.Channels, channel)
+			}
+		}
+	}
+	finish()
+
+	return phys
+}
+
+// parsePhyInterfaces parses the output of iw dev into the names of the
+// network interfaces of each device.
+func parsePhyInterfaces(output []byte) map[string][]string {
+	interfaces := make(map[string][]string)
+	phy := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "phy#") {
+			phy = "phy" + strings.TrimPrefix(line, "phy#")
+		} else if content := strings.TrimSpace(line); len(phy) > 0 && strings.HasPrefix(content, "Interface ") {
+			interfaces[phy] = append(interfaces[phy], strings.TrimPrefix(content, "Interface "))
+		}
+	}
+
+	return interfaces
+}
+
+// loadHardware returns the wireless devices of the system together
+// with their network interfaces and drivers.
+func loadHardware() ([]wirelessPhy, error) {
+	output, err := runIw("list")
+	if err != nil {
+		return nil, err
+	}
+	phys := parsePhys(output)
+
+	output, err = runIw("dev")
+	if err != nil {
+		return nil, err
+	}
+	interfaces := parsePhyInterfaces(output)
+
+	for n := range phys {
+		if names, ok := interfaces[phys[n].Name]; ok {
+			sort.Strings(names)
+			phys[n].Interfaces = names
+		}
+		if driver, err := os.Readlink(filepath.Join(sysClassIeee80211, phys[n].Name, "device", "driver")); err == nil {
+			phys[n].Driver = filepath.Base(driver)
+		}
+	}
+
+	sort.Slice(phys, func(i, j int) bool { return phys[i].Name < phys[j].Name })
+	return phys, nil
+}
+
+// validateHardware checks that the wireless device of wifi.interface
+// can operate the access point the way wifi.interface-mode and the
+// 802.11n/ac settings ask for. Only the virtual mode needs more than
+// AP support which the device is checked for when the access point
+// starts. The second radio is checked as well.
+func validateHardware(previous, config map[string]interface{}) *fieldError {
+	previous = effectiveConfiguration(previous)
+	config = effectiveConfiguration(config)
+	if field := validateRadioHardware(previous, config); field != nil {
+		return field
+	}
+
+	iface := fmt.Sprint(config["wifi.interface"])
+	checkVirtual := config["wifi.interface-mode"] == "virtual" &&
+		(previous["wifi.interface-mode"] != "virtual" || fmt.Sprint(previous["wifi.interface"]) != iface)
+	checkThroughput := throughputChanged(previous, config)
+	if !checkVirtual && !checkThroughput {
+		return nil
+	}
+
+	phys, err := loadHardware()
+	if err != nil {
+		log.Printf("Can not check the wireless hardware: %s", err)
+		return nil
+	}
+
+	for n, phy := range phys {
+		if !containsString(phy.Interfaces, iface) {
+			continue
+		}
+		if checkThroughput {
+			if field := validateThroughputHardware(&phys[n], config); field != nil {
+				return field
+			}
+		}
+		if checkVirtual && !phy.VirtualAccessPoint {
+			return &fieldError{
+				Field: "wifi.interface-mode",
+				Message: fmt.Sprintf("Interface %s (%s) can not operate an access point next to a managed connection",
+					iface, phy.Name),
+			}
+		}
+		return nil
+	}
+
+	// The device might not be plugged in yet
+	return nil
+}
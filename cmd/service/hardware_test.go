@@ -0,0 +1,204 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+var iwListOutput = `Wiphy phy0
+	max # scan SSIDs: 4
+	Supported interface modes:
+		 * IBSS
+		 * managed
+		 * AP
+		 * monitor
+	Band 1:
+		Capabilities: 0x1862
+			HT20/HT40
+			Static SM Power Save
+			RX HT40 SGI
+		Maximum RX AMPDU length 65535 bytes (exponent: 0x003)
+		Frequencies:
+			* 2412 MHz [1] (20.0 dBm)
+			* 2467 MHz [12] (disabled)
+	Band 2:
+		Capabilities: 0x1862
+			HT20/HT40
+		VHT Capabilities (0x338001b2):
+			Max MPDU length: 11454
+			short GI (80 MHz)
+		VHT RX MCS set:
+			1 streams: MCS 0-9
+		HE Iftypes: managed, AP
+			HE MAC Capabilities (0x000801185018):
+				+HTC HE Supported
+		Frequencies:
+			* 5180.0 MHz [36] (23.0 dBm)
+			* 5260.0 MHz [52] (20.0 dBm) (radar detection)
+	Supported commands:
+		 * new_interface
+	valid interface combinations:
+		 * #{ managed } <= 1, #{ AP, P2P-client, P2P-GO } <= 1, #{ P2P-device } <= 1,
+		   total <= 3, #channels <= 1
+	Maximum associated stations in AP mode: 128
+Wiphy phy1
+	Supported interface modes:
+		 * managed
+		 * AP
+	Band 1:
+		Frequencies:
+			* 2412 MHz [1] (20.0 dBm)
+	valid interface combinations:
+		 * #{ managed, AP } <= 1,
+		   total <= 1, #channels <= 1
+`
+
+var iwDevOutput = `phy#1
+	Interface wlx0
+		ifindex 5
+		type managed
+phy#0
+	Interface wlan0
+		ifindex 3
+		type managed
+	Unnamed/non-netdev interface
+		wdev 0x2
+`
+
+func mockIwHardware(list, dev string) (restore func()) {
+	oldRunIw := runIw
+	runIw = func(args ...string) ([]byte, error) {
+		switch strings.Join(args, " ") {
+		case "list":
+			return []byte(list), nil
+		case "dev":
+			return []byte(dev), nil
+		}
+		return nil, fmt.Errorf("unexpected iw call %v", args)
+	}
+	return func() { runIw = oldRunIw }
+}
+
+func (s *S) TestParsePhys(c *check.C) {
+	phys := parsePhys([]byte(iwListOutput))
+	c.Assert(phys, check.HasLen, 2)
+
+	c.Assert(phys[0].Name, check.Equals, "phy0")
+	c.Assert(phys[0].Modes, check.DeepEquals, []string{"IBSS", "managed", "AP", "monitor"})
+	c.Assert(phys[0].AccessPoint, check.Equals, true)
+	c.Assert(phys[0].VirtualAccessPoint, check.Equals, true)
+	c.Assert(phys[0].MaxStations, check.Equals, 128)
+	c.Assert(phys[0].Bands, check.DeepEquals, []phyBand{
+		{
+			Band: "2.4GHz",
+			Channels: []phyChannel{
+				{Channel: 1, Frequency: 2412},
+				{Channel: 12, Frequency: 2467, Disabled: true},
+			},
+			HT: []string{"HT20/HT40", "Static SM Power Save", "RX HT40 SGI"},
+		},
+		{
+			Band: "5GHz",
+			Channels: []phyChannel{
+				{Channel: 36, Frequency: 5180},
+				{Channel: 52, Frequency: 5260, DFS: true},
+			},
+			HT:  []string{"HT20/HT40"},
+			VHT: []string{"Max MPDU length: 11454", "short GI (80 MHz)"},
+			HE:  true,
+		},
+	})
+	c.Assert(phys[0].Combinations, check.DeepEquals, []interfaceCombination{
+		{
+			Limits: []interfaceLimit{
+				{Types: []string{"managed"}, Max: 1},
+				{Types: []string{"AP", "P2P-client", "P2P-GO"}, Max: 1},
+				{Types: []string{"P2P-device"}, Max: 1},
+			},
+			Total:    3,
+			Channels: 1,
+		},
+	})
+
+	// One interface at a time only
+	c.Assert(phys[1].AccessPoint, check.Equals, true)
+	c.Assert(phys[1].VirtualAccessPoint, check.Equals, false)
+	c.Assert(phys[1].MaxStations, check.Equals, 0)
+}
+
+func (s *S) TestGetHardware(c *check.C) {
+	defer mockIwHardware(iwListOutput, iwDevOutput)()
+
+	oldSysClassIeee80211 := sysClassIeee80211
+	sysClassIeee80211 = c.MkDir()
+	defer func() { sysClassIeee80211 = oldSysClassIeee80211 }()
+	device := filepath.Join(sysClassIeee80211, "phy0", "device")
+	c.Assert(os.MkdirAll(device, 0755), check.IsNil)
+	c.Assert(os.Symlink("../../../bus/pci/drivers/iwlwifi", filepath.Join(device, "driver")), check.IsNil)
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/hardware", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	getHardware(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	phys := resp.Result["phys"].([]interface{})
+	c.Assert(phys, check.HasLen, 2)
+	phy := phys[0].(map[string]interface{})
+	c.Assert(phy["name"], check.Equals, "phy0")
+	c.Assert(phy["driver"], check.Equals, "iwlwifi")
+	c.Assert(phy["interfaces"], check.DeepEquals, []interface{}{"wlan0"})
+	c.Assert(phy["virtual-ap"], check.Equals, true)
+	c.Assert(phys[1].(map[string]interface{})["interfaces"], check.DeepEquals, []interface{}{"wlx0"})
+}
+
+func (s *S) TestVirtualInterfaceModeValidation(c *check.C) {
+	defer mockIwHardware(iwListOutput, iwDevOutput)()
+
+	s.setUpConfiguration(c, "WIFI_INTERFACE=wlx0\n")
+
+	cmd := newMockServiceCommand()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		postConfiguration(cmd, rec, req)
+		return rec
+	}
+
+	rec := post(`{"wifi.interface-mode": "virtual"}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.interface-mode": "Interface wlx0 (phy1) can not operate an access point next to a managed connection",
+	})
+
+	rec = post(`{"wifi.interface-mode": "virtual", "wifi.interface": "wlan0"}`)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+}
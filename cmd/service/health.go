@@ -0,0 +1,362 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	healthPass = "pass"
+	healthFail = "fail"
+	healthSkip = "skip"
+)
+
+// Time we wait for dnsmasq to answer our DNS query
+const dnsQueryTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type healthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []healthCheck `json:"checks"`
+}
+
+func (r *healthReport) add(name, status, format string, args ...interface{}) {
+	if status == healthFail {
+		r.Healthy = false
+	}
+	r.Checks = append(r.Checks, healthCheck{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Failed returns the first failed check or nil if all passed.
+func (r *healthReport) Failed() *healthCheck {
+	for n := range r.Checks {
+		if r.Checks[n].Status == healthFail {
+			return &r.Checks[n]
+		}
+	}
+	return nil
+}
+
+// Checks which only depend on the device itself and not on its uplink.
+// The NAT rules are set up by the device even if the interface to share
+// has no connection.
+var localHealthChecks = map[string]bool{
+	"configuration": true,
+	"access-point":  true,
+	"hostapd":       true,
+	"radio2":        true,
+	"interface":     true,
+	"dns":           true,
+	"dhcp":          true,
+	"nat":           true,
+}
+
+// FailedLocally returns the first failed check which only depends on
+// the device itself or nil if all of them passed.
+func (r *healthReport) FailedLocally() *healthCheck {
+	for n := range r.Checks {
+		if r.Checks[n].Status == healthFail && localHealthChecks[r.Checks[n].Name] {
+			return &r.Checks[n]
+		}
+	}
+	return nil
+}
+
+// runCommand executes an external command and returns its combined
+// output. Overridden in tests.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+var interfaceAddresses = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// Location of the UDP socket table of the kernel
+var procNetUDPPath = "/proc/net/udp"
+
+// Location of the per process information of the kernel
+var procPath = "/proc"
+
+// Port DNS queries are sent to
+var dnsPort = "53"
+
+// queryDNS sends a DNS query for an A record to the given server and
+// waits for an answer to it. Any answer to the query counts, as without
+// an uplink the server can't resolve names it doesn't know itself.
+var queryDNS = func(server string, name string) error {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, dnsPort), dnsQueryTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(rand.Intn(0xffff))
+	// Header with the recursion desired flag set and one question
+	query := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// Terminating root label, type A and class IN
+	query = append(query, 0x00, 0x00, 0x01, 0x00, 0x01)
+
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 512)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return err
+	}
+	// The answer has to be a response to our query
+	if n < 12 || binary.BigEndian.Uint16(answer) != id || answer[2]&0x80 == 0 {
+		return fmt.Errorf("Received invalid answer")
+	}
+	return nil
+}
+
+// udpSocketInodes checks the kernel socket table for sockets bound to
+// the given local UDP port on the given address or on all addresses
+// and returns their inodes.
+func udpSocketInodes(address string, port int) ([]string, error) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address %q", address)
+	}
+
+	file, err := os.Open(procNetUDPPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The kernel prints addresses in host byte order
+	locals := []string{
+		fmt.Sprintf("%02X%02X%02X%02X:%04X", ip[3], ip[2], ip[1], ip[0], port),
+		fmt.Sprintf("00000000:%04X", port),
+	}
+
+	var inodes []string
+	scanner := bufio.NewScanner(file)
+	// Skip the first line with table header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 9 && (fields[1] == locals[0] || fields[1] == locals[1]) {
+			inodes = append(inodes, fields[9])
+		}
+	}
+	return inodes, scanner.Err()
+}
+
+// ownsSocket returns whether the process with the given pid has one of
+// the sockets with the given inodes open.
+func ownsSocket(pid int, inodes []string) (bool, error) {
+	fdPath := filepath.Join(procPath, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdPath)
+	if err != nil {
+		return false, err
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdPath, fd.Name()))
+		if err != nil {
+			continue
+		}
+		for _, inode := range inodes {
+			if target == "socket:["+inode+"]" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkDHCPServer verifies that dnsmasq serves DHCP on the address of
+// the access point. Another process bound to the port doesn't count.
+func checkDHCPServer(report *healthReport, address string) {
+	inodes, err := udpSocketInodes(address, 67)
+	if err != nil {
+		report.add("dhcp", healthFail, "Failed to check DHCP server: %s", err)
+		return
+	}
+	if len(inodes) == 0 {
+		report.add("dhcp", healthFail, "No DHCP server is listening on %s port 67", address)
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(os.Getenv("SNAP_DATA"), "dnsmasq.pid"))
+	if err != nil {
+		report.add("dhcp", healthFail, "Failed to read pid of dnsmasq: %s", err)
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		report.add("dhcp", healthFail, "Invalid pid of dnsmasq: %s", err)
+		return
+	}
+
+	if owned, err := ownsSocket(pid, inodes); err != nil {
+		report.add("dhcp", healthFail, "Failed to check sockets of dnsmasq (pid %d): %s", pid, err)
+	} else if !owned {
+		report.add("dhcp", healthFail, "Port 67 on %s is not bound by dnsmasq (pid %d)", address, pid)
+	} else {
+		report.add("dhcp", healthPass, "dnsmasq is listening on %s port 67", address)
+	}
+}
+
+func hasAddress(addrs []net.Addr, address string) bool {
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			ip = net.ParseIP(addr.String())
+		}
+		if ip != nil && ip.String() == address {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHealth actively verifies that all parts of the access point
+// are in place and working. The checks are always all performed so
+// that the report gives a complete picture.
+func (s *service) checkHealth() *healthReport {
+	report := &healthReport{Healthy: true}
+
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		report.add("configuration", healthFail, "%s", err)
+		return report
+	}
+
+	if config["disabled"] == true {
+		report.Healthy = false
+		report.add("access-point", healthSkip, "Access point is disabled")
+		return report
+	}
+
+	iface := fmt.Sprint(config["wifi.interface"])
+	if config["wifi.interface-mode"] == "virtual" {
+		iface = "ap0"
+	}
+	address := fmt.Sprint(config["wifi.address"])
+	// With a second radio the address is on the bridge joining both
+	network := iface
+	if dualBandEnabled(config) {
+		network = dualBandBridge
+	}
+
+	if state := s.status.State(); state != apStateRunning {
+		report.add("access-point", healthFail, "Access point is %s", state)
+	} else {
+		report.add("access-point", healthPass, "Access point is running")
+	}
+
+	hostapdCli := filepath.Join(os.Getenv("SNAP"), "bin", "hostapd_cli")
+	ctrlPath := filepath.Join(os.Getenv("SNAP_DATA"), "hostapd")
+	if output, err := runCommand(hostapdCli, "-p", ctrlPath, "-i", iface, "status"); err != nil {
+		report.add("hostapd", healthFail, "Failed to query hostapd: %s", strings.TrimSpace(string(output)))
+	} else if state := parseHostapdState(string(output)); state == "DFS" {
+		report.add("hostapd", healthFail, "hostapd checks the channel for radar before operating on it")
+	} else if state != "ENABLED" {
+		report.add("hostapd", healthFail, "hostapd reports state %s", state)
+	} else {
+		report.add("hostapd", healthPass, "hostapd reports state ENABLED")
+	}
+
+	if dualBandEnabled(config) {
+		radioIface := fmt.Sprint(config["radio2.interface"])
+		if state := s.radio2Status.State(); state != apStateRunning {
+			report.add("radio2", healthFail, "Access point on %s is %s", radioIface, state)
+		} else if output, err := runCommand(hostapdCli, "-p", ctrlPath, "-i", radioIface, "status"); err != nil {
+			report.add("radio2", healthFail, "Failed to query hostapd on %s: %s", radioIface, strings.TrimSpace(string(output)))
+		} else if state := parseHostapdState(string(output)); state != "ENABLED" {
+			report.add("radio2", healthFail, "hostapd reports state %s on %s", state, radioIface)
+		} else {
+			report.add("radio2", healthPass, "hostapd reports state ENABLED on %s", radioIface)
+		}
+	}
+
+	if addrs, err := interfaceAddresses(network); err != nil {
+		report.add("interface", healthFail, "Failed to get addresses of %s: %s", network, err)
+	} else if !hasAddress(addrs, address) {
+		report.add("interface", healthFail, "Interface %s does not carry address %s", network, address)
+	} else {
+		report.add("interface", healthPass, "Interface %s carries address %s", network, address)
+	}
+
+	if err := queryDNS(address, "ubuntu.com"); err != nil {
+		report.add("dns", healthFail, "No DNS answer from %s: %s", address, err)
+	} else {
+		report.add("dns", healthPass, "DNS server answers on %s", address)
+	}
+
+	checkDHCPServer(report, address)
+
+	if config["share.disabled"] == true {
+		report.add("nat", healthSkip, "Connection sharing is disabled")
+	} else {
+		shareIface := fmt.Sprint(config["share.network-interface"])
+		_, natErr := runCommand("iptables", "--table", "nat", "--check", "POSTROUTING", "--out-interface", shareIface, "-j", "MASQUERADE")
+		_, fwdErr := runCommand("iptables", "--check", "FORWARD", "--in-interface", network, "-j", "ACCEPT")
+		if natErr != nil || fwdErr != nil {
+			report.add("nat", healthFail, "NAT rules for sharing %s are missing", shareIface)
+		} else {
+			report.add("nat", healthPass, "NAT rules for sharing %s are present", shareIface)
+		}
+	}
+
+	return report
+}
+
+// parseHostapdState extracts the interface state from the output
+// of 'hostapd_cli status'.
+func parseHostapdState(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "state=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "state="))
+		}
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,289 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type HealthSuite struct {
+	commands  []string
+	failing   []string
+	hostapd   string
+	addresses []net.Addr
+	dnsErr    error
+
+	oldRunCommand         func(string, ...string) ([]byte, error)
+	oldInterfaceAddresses func(string) ([]net.Addr, error)
+	oldQueryDNS           func(string, string) error
+	oldProcNetUDPPath     string
+	oldProcPath           string
+	oldConfigPaths        []string
+	oldSnapData           string
+	dir                   string
+	configPath            string
+}
+
+var _ = check.Suite(&HealthSuite{})
+
+const procNetUDPWithDHCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  1: 00000000:0043 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 5678 2 0000000000000000 0
+  2: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 5679 2 0000000000000000 0
+`
+
+func (s *HealthSuite) SetUpTest(c *check.C) {
+	s.commands = nil
+	s.failing = nil
+	s.hostapd = "state=ENABLED\nphy=phy0\nfreq=2437\n"
+	s.addresses = []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.60.1"), Mask: net.CIDRMask(24, 32)}}
+	s.dnsErr = nil
+
+	s.oldRunCommand = runCommand
+	s.oldInterfaceAddresses = interfaceAddresses
+	s.oldQueryDNS = queryDNS
+	s.oldProcNetUDPPath = procNetUDPPath
+	s.oldProcPath = procPath
+	s.oldConfigPaths = configurationPaths
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		command := strings.Join(append([]string{filepath.Base(name)}, args...), " ")
+		s.commands = append(s.commands, command)
+		for _, prefix := range s.failing {
+			if strings.HasPrefix(command, prefix) {
+				return []byte("failed"), fmt.Errorf("exit status 1")
+			}
+		}
+		if filepath.Base(name) == "hostapd_cli" {
+			return []byte(s.hostapd), nil
+		}
+		return nil, nil
+	}
+	interfaceAddresses = func(name string) ([]net.Addr, error) {
+		return s.addresses, nil
+	}
+	queryDNS = func(server, name string) error {
+		return s.dnsErr
+	}
+
+	s.dir = c.MkDir()
+	s.oldSnapData = os.Getenv("SNAP_DATA")
+	os.Setenv("SNAP_DATA", s.dir)
+
+	procNetUDPPath = filepath.Join(s.dir, "udp")
+	c.Assert(ioutil.WriteFile(procNetUDPPath, []byte(procNetUDPWithDHCP), 0644), check.IsNil)
+
+	// dnsmasq owns the DHCP socket
+	procPath = filepath.Join(s.dir, "proc")
+	c.Assert(os.MkdirAll(filepath.Join(procPath, "1234", "fd"), 0755), check.IsNil)
+	c.Assert(os.Symlink("socket:[5678]", filepath.Join(procPath, "1234", "fd", "3")), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "dnsmasq.pid"), []byte("1234\n"), 0644), check.IsNil)
+
+	s.configPath = filepath.Join(s.dir, "config")
+	configurationPaths = []string{"../../conf/default-config", s.configPath}
+	s.writeConfig(c, "DISABLED=false\n")
+}
+
+func (s *HealthSuite) TearDownTest(c *check.C) {
+	runCommand = s.oldRunCommand
+	interfaceAddresses = s.oldInterfaceAddresses
+	queryDNS = s.oldQueryDNS
+	procNetUDPPath = s.oldProcNetUDPPath
+	procPath = s.oldProcPath
+	configurationPaths = s.oldConfigPaths
+	os.Setenv("SNAP_DATA", s.oldSnapData)
+}
+
+func (s *HealthSuite) writeConfig(c *check.C, content string) {
+	c.Assert(ioutil.WriteFile(s.configPath, []byte(content), 0644), check.IsNil)
+}
+
+func newRunningService() *service {
+	svc := newMockService()
+	svc.ap.Start()
+	svc.status.launched(svc.ap.Pid(), false, "Ubuntu", "6", "wlan0")
+	svc.status.running(svc.ap.Pid())
+	return svc
+}
+
+func checkStatuses(report *healthReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func (s *HealthSuite) TestHealthy(c *check.C) {
+	report := newRunningService().checkHealth()
+	c.Assert(report.Healthy, check.Equals, true)
+	c.Assert(report.Failed(), check.IsNil)
+	c.Assert(checkStatuses(report), check.DeepEquals, map[string]string{
+		"access-point": healthPass,
+		"hostapd":      healthPass,
+		"interface":    healthPass,
+		"dns":          healthPass,
+		"dhcp":         healthPass,
+		"nat":          healthPass,
+	})
+	c.Assert(s.commands, check.DeepEquals, []string{
+		"hostapd_cli -p " + s.dir + "/hostapd -i wlan0 status",
+		"iptables --table nat --check POSTROUTING --out-interface eth0 -j MASQUERADE",
+		"iptables --check FORWARD --in-interface wlan0 -j ACCEPT",
+	})
+}
+
+func (s *HealthSuite) TestDisabled(c *check.C) {
+	s.writeConfig(c, "DISABLED=true\n")
+	report := newRunningService().checkHealth()
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(checkStatuses(report), check.DeepEquals, map[string]string{
+		"access-point": healthSkip,
+	})
+}
+
+func (s *HealthSuite) TestFailingChecks(c *check.C) {
+	s.hostapd = "state=DISABLED\n"
+	s.addresses = nil
+	s.dnsErr = fmt.Errorf("timeout")
+	s.failing = []string{"iptables --table nat"}
+	procNetUDPPath = "/nonexistent"
+
+	svc := newMockService()
+	report := svc.checkHealth()
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(report.Failed().Name, check.Equals, "access-point")
+	c.Assert(checkStatuses(report), check.DeepEquals, map[string]string{
+		"access-point": healthFail,
+		"hostapd":      healthFail,
+		"interface":    healthFail,
+		"dns":          healthFail,
+		"dhcp":         healthFail,
+		"nat":          healthFail,
+	})
+	c.Assert(report.Checks[1].Message, check.Equals, "hostapd reports state DISABLED")
+}
+
+func (s *HealthSuite) TestDHCPServer(c *check.C) {
+	report := &healthReport{Healthy: true}
+	checkDHCPServer(report, "10.0.60.1")
+	c.Assert(report.Healthy, check.Equals, true)
+	c.Assert(report.Checks[0].Message, check.Equals, "dnsmasq is listening on 10.0.60.1 port 67")
+
+	// Sockets bound to other addresses or owned by other processes
+	// don't make a DHCP server for the access point
+	udp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  1: 0100007F:0043 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 5678 2 0000000000000000 0
+  2: 013C000A:0043 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 9999 2 0000000000000000 0
+`
+	c.Assert(ioutil.WriteFile(procNetUDPPath, []byte(udp), 0644), check.IsNil)
+	report = &healthReport{Healthy: true}
+	checkDHCPServer(report, "10.0.60.1")
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(report.Checks[0].Message, check.Equals, "Port 67 on 10.0.60.1 is not bound by dnsmasq (pid 1234)")
+
+	report = &healthReport{Healthy: true}
+	checkDHCPServer(report, "192.168.1.1")
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(report.Checks[0].Message, check.Equals, "No DHCP server is listening on 192.168.1.1 port 67")
+
+	// Without dnsmasq there is no DHCP server either
+	c.Assert(os.Remove(filepath.Join(s.dir, "dnsmasq.pid")), check.IsNil)
+	report = &healthReport{Healthy: true}
+	checkDHCPServer(report, "10.0.60.1")
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(report.Checks[0].Message, check.Matches, "Failed to read pid of dnsmasq: .*")
+}
+
+func (s *HealthSuite) TestSharingDisabled(c *check.C) {
+	s.writeConfig(c, "DISABLED=false\nSHARE_DISABLED=true\nWIFI_INTERFACE_MODE=virtual\n")
+	report := newRunningService().checkHealth()
+	c.Assert(report.Healthy, check.Equals, true)
+	c.Assert(checkStatuses(report)["nat"], check.Equals, healthSkip)
+	c.Assert(s.commands, check.DeepEquals, []string{"hostapd_cli -p " + s.dir + "/hostapd -i ap0 status"})
+}
+
+func (s *HealthSuite) TestDualBand(c *check.C) {
+	s.writeConfig(c, "DISABLED=false\nRADIO2_DISABLED=false\n")
+	svc := newRunningService()
+	svc.radio2Status.launched(100, false, "Ubuntu", "36", "wlan1")
+	svc.radio2Status.running(100)
+
+	report := svc.checkHealth()
+	c.Assert(report.Healthy, check.Equals, true)
+	c.Assert(checkStatuses(report)["radio2"], check.Equals, healthPass)
+	c.Assert(s.commands, check.DeepEquals, []string{
+		"hostapd_cli -p " + s.dir + "/hostapd -i wlan0 status",
+		"hostapd_cli -p " + s.dir + "/hostapd -i wlan1 status",
+		"iptables --table nat --check POSTROUTING --out-interface eth0 -j MASQUERADE",
+		"iptables --check FORWARD --in-interface apbr0 -j ACCEPT",
+	})
+	c.Assert(report.Checks[3].Message, check.Equals, "Interface apbr0 carries address 10.0.60.1")
+
+	svc.radio2Status.failed(100, "Timed out waiting for hostapd to start")
+	report = svc.checkHealth()
+	c.Assert(report.Healthy, check.Equals, false)
+	c.Assert(report.Failed().Message, check.Equals, "Access point on wlan1 is failed")
+}
+
+func (s *HealthSuite) TestQueryDNS(c *check.C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	oldDNSPort := dnsPort
+	defer func() { dnsPort = oldDNSPort }()
+	_, dnsPort, err = net.SplitHostPort(conn.LocalAddr().String())
+	c.Assert(err, check.IsNil)
+
+	// Answers the next query with the given flags and ID offset
+	answer := func(flags byte, idOffset byte) {
+		go func() {
+			query := make([]byte, 512)
+			n, addr, err := conn.ReadFrom(query)
+			if err != nil {
+				return
+			}
+			reply := append([]byte(nil), query[:n]...)
+			reply[1] += idOffset
+			reply[2] = 0x80
+			reply[3] = flags
+			conn.WriteTo(reply, addr)
+		}()
+	}
+
+	answer(0x80, 0)
+	c.Assert(s.oldQueryDNS("127.0.0.1", "ubuntu.com"), check.IsNil)
+
+	// A server without uplink refusing the query is still answering
+	answer(0x85, 0)
+	c.Assert(s.oldQueryDNS("127.0.0.1", "ubuntu.com"), check.IsNil)
+
+	answer(0x80, 1)
+	c.Assert(s.oldQueryDNS("127.0.0.1", "ubuntu.com"), check.ErrorMatches, "Received invalid answer")
+}
+
+func (s *HealthSuite) TestParseHostapdState(c *check.C) {
+	c.Assert(parseHostapdState("state=ENABLED\nfreq=2412\n"), check.Equals, "ENABLED")
+	c.Assert(parseHostapdState("phy=phy0\nstate=COUNTRY_UPDATE\n"), check.Equals, "COUNTRY_UPDATE")
+	c.Assert(parseHostapdState("Failed to connect to hostapd"), check.Equals, "UNKNOWN")
+}
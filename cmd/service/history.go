@@ -0,0 +1,178 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// Number of configurations we keep in the history. Older ones are
+// removed when new ones are recorded.
+const maxHistoryEntries = 100
+
+// historyEntry is a configuration written to $SNAP_DATA/config at
+// some point in time.
+type historyEntry struct {
+	ID          int                    `json:"id"`
+	Time        time.Time              `json:"time"`
+	ChangedKeys []string               `json:"changed-keys"`
+	UID         *uint32                `json:"uid,omitempty"`
+	Config      map[string]interface{} `json:"config,omitempty"`
+}
+
+func (e *historyEntry) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"id":           e.ID,
+		"time":         e.Time,
+		"changed-keys": e.ChangedKeys,
+		"config":       e.Config,
+	}
+	if e.UID != nil {
+		m["uid"] = *e.UID
+	}
+	return m
+}
+
+func historyDir() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "history")
+}
+
+func historyEntryPath(id int) string {
+	return filepath.Join(historyDir(), fmt.Sprintf("%d.json", id))
+}
+
+// changedKeys returns all keys which differ between both configurations.
+func changedKeys(previous, config map[string]interface{}) []string {
+	keys := []string{}
+	for key, value := range config {
+		if old, ok := previous[key]; !ok || fmt.Sprint(old) != fmt.Sprint(value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := config[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// historyIDs returns the IDs of all stored history entries in
+// ascending order.
+func historyIDs() ([]int, error) {
+	files, err := ioutil.ReadDir(historyDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// recordHistory stores a new configuration in the history and drops
+// the oldest ones above the limit.
+func recordHistory(previous, config map[string]interface{}, uid *uint32) (*historyEntry, error) {
+	ids, err := historyIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &historyEntry{
+		ID:          1,
+		Time:        time.Now(),
+		ChangedKeys: changedKeys(previous, config),
+		UID:         uid,
+		Config:      config,
+	}
+	if len(ids) > 0 {
+		entry.ID = ids[len(ids)-1] + 1
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(historyDir(), 0755); err != nil {
+		return nil, err
+	}
+	if err := osutil.AtomicWriteFile(historyEntryPath(entry.ID), data, 0600, osutil.AtomicWriteFlags(0)); err != nil {
+		return nil, err
+	}
+
+	ids = append(ids, entry.ID)
+	for len(ids) > maxHistoryEntries {
+		os.Remove(historyEntryPath(ids[0]))
+		ids = ids[1:]
+	}
+
+	return entry, nil
+}
+
+func loadHistoryEntry(id int) (*historyEntry, error) {
+	data, err := ioutil.ReadFile(historyEntryPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &historyEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// listHistory returns all history entries, oldest first, without
+// their configuration.
+func listHistory() ([]*historyEntry, error) {
+	ids, err := historyIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*historyEntry{}
+	for _, id := range ids {
+		entry, err := loadHistoryEntry(id)
+		if err != nil {
+			return nil, err
+		}
+		entry.Config = nil
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestChangedKeys(c *check.C) {
+	previous := map[string]interface{}{
+		"wifi.ssid":    "Ubuntu",
+		"wifi.channel": "6",
+		"disabled":     true,
+	}
+	config := map[string]interface{}{
+		"wifi.ssid":    "Ubuntu",
+		"wifi.channel": 11,
+		"debug":        true,
+	}
+	c.Assert(changedKeys(previous, config), check.DeepEquals, []string{"debug", "disabled", "wifi.channel"})
+	c.Assert(changedKeys(config, config), check.HasLen, 0)
+}
+
+func (s *S) TestRecordHistory(c *check.C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	entries, err := listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 0)
+
+	uid := uint32(1000)
+	first, err := recordHistory(map[string]interface{}{}, map[string]interface{}{"wifi.ssid": "One"}, &uid)
+	c.Assert(err, check.IsNil)
+	c.Assert(first.ID, check.Equals, 1)
+	c.Assert(first.ChangedKeys, check.DeepEquals, []string{"wifi.ssid"})
+
+	second, err := recordHistory(first.Config, map[string]interface{}{"wifi.ssid": "Two"}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(second.ID, check.Equals, 2)
+
+	entries, err = listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Assert(*entries[0].UID, check.Equals, uid)
+	c.Assert(entries[0].Config, check.IsNil)
+	c.Assert(entries[1].UID, check.IsNil)
+
+	entry, err := loadHistoryEntry(2)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry.Config, check.DeepEquals, map[string]interface{}{"wifi.ssid": "Two"})
+
+	_, err = loadHistoryEntry(3)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestHistoryIsBounded(c *check.C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	for n := 0; n < maxHistoryEntries+5; n++ {
+		_, err := recordHistory(nil, map[string]interface{}{"wifi.channel": n}, nil)
+		c.Assert(err, check.IsNil)
+	}
+
+	ids, err := historyIDs()
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.HasLen, maxHistoryEntries)
+	c.Assert(ids[0], check.Equals, 6)
+}
+
+func (s *S) TestHistoryRestore(c *check.C) {
+	dir := s.setUpConfiguration(c, "")
+	_, err := recordHistory(nil, map[string]interface{}{"wifi.ssid": "Restored", "disabled": false}, nil)
+	c.Assert(err, check.IsNil)
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration/history/1/restore", nil)
+	c.Assert(err, check.IsNil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postHistoryRestore(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["summary"], check.Equals, "Restore configuration from history entry 1")
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "DISABLED='false'\nWIFI_SSID='Restored'\n")
+	c.Assert(cmd.s.ap.Running(), check.Equals, true)
+
+	// The restore itself is recorded as well
+	entries, err := listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Assert(entries[1].ChangedKeys, check.DeepEquals, []string{"disabled", "wifi.ssid"})
+}
+
+func (s *S) TestHistoryRestoreChecksSchema(c *check.C) {
+	dir := s.setUpConfiguration(c, "")
+	_, err := recordHistory(nil, map[string]interface{}{"wifi.security": "wep"}, nil)
+	c.Assert(err, check.IsNil)
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration/history/1/restore", nil)
+	c.Assert(err, check.IsNil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+
+	rec := httptest.NewRecorder()
+	postHistoryRestore(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	_, err = os.Stat(getConfigOnPath(dir))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestHistoryEntryNotFound(c *check.C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	for _, id := range []string{"42", "abc"} {
+		req, err := http.NewRequest(http.MethodGet, "/v1/configuration/history/"+id, nil)
+		c.Assert(err, check.IsNil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+
+		rec := httptest.NewRecorder()
+		getHistoryEntry(newMockServiceCommand(), rec, req)
+
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		c.Assert(resp.Type, check.Equals, "error")
+		if id == "42" {
+			c.Assert(rec.Code, check.Equals, http.StatusNotFound)
+		} else {
+			c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+		}
+	}
+}
@@ -23,6 +23,23 @@ import (
 )
 
 func main() {
+	// Called by the configure hook on installation
+	if len(os.Args) > 1 && os.Args[1] == "apply-gadget-defaults" {
+		if err := applyGadgetDefaults(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Called by the configure hook through the client while the
+	// service is not running
+	if len(os.Args) > 1 && os.Args[1] == "check-snap-config" {
+		if err := checkSnapConfiguration(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	s := &service{}
 
 	// Wait until the configure hook, which is called on snap
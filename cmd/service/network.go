@@ -0,0 +1,55 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// Items which make up the network of the access point
+var networkKeys = []string{"wifi.address", "wifi.netmask", "dhcp.range-start", "dhcp.range-stop"}
+
+// validateNetworkConfiguration checks that the DHCP range of the given
+// effective configuration lies within the network of wifi.address and
+// doesn't end before it starts. Returns a field error for the offending
+// item or nil.
+func validateNetworkConfiguration(config map[string]interface{}) *fieldError {
+	for _, key := range networkKeys {
+		if err := validateConfigurationValue(key, config[key]); err != nil {
+			return &fieldError{key, err.Error()}
+		}
+	}
+
+	address := parseIPv4(fmt.Sprint(config["wifi.address"]))
+	mask := parseNetmask(fmt.Sprint(config["wifi.netmask"]))
+	network := &net.IPNet{IP: address.Mask(mask), Mask: mask}
+
+	for _, key := range []string{"dhcp.range-start", "dhcp.range-stop"} {
+		if ip := parseIPv4(fmt.Sprint(config[key])); !network.Contains(ip) {
+			return &fieldError{key, fmt.Sprintf("%s %s is not within the network %s of wifi.address", key, ip, network)}
+		}
+	}
+
+	start := parseIPv4(fmt.Sprint(config["dhcp.range-start"]))
+	stop := parseIPv4(fmt.Sprint(config["dhcp.range-stop"]))
+
+	if bytes.Compare(start, stop) > 0 {
+		return &fieldError{"dhcp.range-stop", fmt.Sprintf("dhcp.range-stop %s lies before dhcp.range-start %s", stop, start)}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidateNetworkConfiguration(c *check.C) {
+	config := map[string]interface{}{
+		"wifi.address":     "192.168.7.1",
+		"wifi.netmask":     "255.255.255.0",
+		"dhcp.range-start": "192.168.7.2",
+		"dhcp.range-stop":  "192.168.7.51",
+	}
+	c.Assert(validateNetworkConfiguration(config), check.IsNil)
+
+	config["dhcp.range-start"] = "10.0.60.2"
+	c.Assert(validateNetworkConfiguration(config), check.DeepEquals, &fieldError{"dhcp.range-start",
+		"dhcp.range-start 10.0.60.2 is not within the network 192.168.7.0/24 of wifi.address"})
+
+	config["dhcp.range-start"] = "192.168.7.100"
+	c.Assert(validateNetworkConfiguration(config), check.DeepEquals, &fieldError{"dhcp.range-stop",
+		"dhcp.range-stop 192.168.7.51 lies before dhcp.range-start 192.168.7.100"})
+
+	// A wider network holds the range again
+	config["wifi.netmask"] = "255.255.0.0"
+	config["dhcp.range-stop"] = "192.168.8.1"
+	c.Assert(validateNetworkConfiguration(config), check.IsNil)
+
+	config["wifi.address"] = "fd00::1"
+	c.Assert(validateNetworkConfiguration(config), check.DeepEquals, &fieldError{"wifi.address",
+		`Invalid value "fd00::1" for "wifi.address": must be an IPv4 address`})
+}
+
+func (s *S) TestChangeConfigurationChecksDHCPRange(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Depot\n")
+
+	// The default range doesn't fit the new network
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.address": "192.168.7.1"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	postConfiguration(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"dhcp.range-start": "dhcp.range-start 10.0.60.3 is not within the network 192.168.7.0/24 of wifi.address",
+	})
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "WIFI_SSID=Depot\n")
+
+	// Moving the range along is fine
+	req, err = http.NewRequest(http.MethodPost, "/v1/configuration",
+		strings.NewReader(`{"wifi.address": "192.168.7.1", "dhcp.range-start": "192.168.7.2", "dhcp.range-stop": "192.168.7.51"}`))
+	c.Assert(err, check.IsNil)
+
+	rec = httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+}
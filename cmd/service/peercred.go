@@ -0,0 +1,179 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+type contextKey int
+
+const (
+	connContextKey contextKey = iota
+	remoteContextKey
+	accessContextKey
+)
+
+type accessLevel int
+
+// What a client is allowed to do with the API
+const (
+	accessNone accessLevel = iota
+	accessRead
+	accessAdmin
+)
+
+// Configuration items which are only visible to administrators
+var secretKeys = []string{"wifi.security-passphrase"}
+
+var lookupGroupID = func(name string) (string, error) {
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return group.Gid, nil
+}
+
+var lookupUserGroupIDs = func(uid uint32) ([]string, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	return u.GroupIds()
+}
+
+// saveConnInContext makes the connection a request was received on
+// available to the request handlers.
+func saveConnInContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey, conn)
+}
+
+// peerCredentials returns the credentials of the process on the other
+// side of the unix socket connection.
+func peerCredentials(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var ucredErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ucred, ucredErr
+}
+
+// requestCredentials returns the credentials of the process which sent
+// the request. These are only known for requests received on the unix
+// socket.
+func requestCredentials(request *http.Request) (*syscall.Ucred, bool) {
+	conn, ok := request.Context().Value(connContextKey).(*net.UnixConn)
+	if !ok {
+		return nil, false
+	}
+
+	ucred, err := peerCredentials(conn)
+	if err != nil {
+		return nil, false
+	}
+	return ucred, true
+}
+
+// requestUID returns the user ID of the process which sent the
+// request. This is only known for requests received on the unix
+// socket.
+func requestUID(request *http.Request) (uint32, bool) {
+	ucred, ok := requestCredentials(request)
+	if !ok {
+		return 0, false
+	}
+	return ucred.Uid, true
+}
+
+// inGroup checks if the given credentials belong to a member of the
+// group with the given name.
+func inGroup(ucred *syscall.Ucred, name string) bool {
+	gid, err := lookupGroupID(name)
+	if err != nil {
+		return false
+	}
+	if strconv.FormatUint(uint64(ucred.Gid), 10) == gid {
+		return true
+	}
+
+	gids, err := lookupUserGroupIDs(ucred.Uid)
+	if err != nil {
+		return false
+	}
+	for _, id := range gids {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// accessForCredentials applies the access policy of the configuration
+// to a local client. Root is always allowed everything.
+func accessForCredentials(ucred *syscall.Ucred, config map[string]interface{}) accessLevel {
+	if ucred.Uid == 0 {
+		return accessAdmin
+	}
+	if group, _ := config["access.admin-group"].(string); len(group) > 0 && inGroup(ucred, group) {
+		return accessAdmin
+	}
+	if group, _ := config["access.read-group"].(string); len(group) > 0 && inGroup(ucred, group) {
+		return accessRead
+	}
+	return accessNone
+}
+
+// requestAccess determines what the client which sent the request is
+// allowed to do. Clients on the network are fully trusted once they
+// authenticated with a token.
+func requestAccess(request *http.Request) accessLevel {
+	if remote, _ := request.Context().Value(remoteContextKey).(bool); remote {
+		return accessAdmin
+	}
+
+	ucred, ok := requestCredentials(request)
+	if !ok {
+		return accessNone
+	}
+
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		// Without a policy only root can get in
+		config = nil
+	}
+	return accessForCredentials(ucred, config)
+}
+
+// grantedAccess returns the access level the request was authorized
+// with and whether it was authorized at all.
+func grantedAccess(request *http.Request) (accessLevel, bool) {
+	level, ok := request.Context().Value(accessContextKey).(accessLevel)
+	return level, ok
+}
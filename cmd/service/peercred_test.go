@@ -0,0 +1,146 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRequestUID(c *check.C) {
+	path := filepath.Join(c.MkDir(), "socket")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+
+	client, err := net.Dial("unix", path)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/status", nil)
+	c.Assert(err, check.IsNil)
+
+	_, ok := requestUID(req)
+	c.Assert(ok, check.Equals, false)
+
+	req = req.WithContext(saveConnInContext(context.Background(), conn))
+	uid, ok := requestUID(req)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(uid, check.Equals, uint32(os.Getuid()))
+}
+
+func mockGroups(groups map[string]string, members map[uint32][]string) func() {
+	oldLookupGroupID := lookupGroupID
+	oldLookupUserGroupIDs := lookupUserGroupIDs
+	lookupGroupID = func(name string) (string, error) {
+		if gid, ok := groups[name]; ok {
+			return gid, nil
+		}
+		return "", fmt.Errorf("unknown group %s", name)
+	}
+	lookupUserGroupIDs = func(uid uint32) ([]string, error) {
+		return members[uid], nil
+	}
+	return func() {
+		lookupGroupID = oldLookupGroupID
+		lookupUserGroupIDs = oldLookupUserGroupIDs
+	}
+}
+
+func (s *S) TestAccessForCredentials(c *check.C) {
+	defer mockGroups(map[string]string{"netadmin": "120", "netview": "121"},
+		map[uint32][]string{1001: {"1001", "120"}, 1002: {"1002", "121"}})()
+
+	config := map[string]interface{}{
+		"access.admin-group": "netadmin",
+		"access.read-group":  "netview",
+	}
+	for _, t := range []struct {
+		uid, gid uint32
+		access   accessLevel
+	}{
+		{0, 0, accessAdmin},
+		{1001, 1001, accessAdmin},
+		{1002, 1002, accessRead},
+		{1003, 121, accessRead},
+		{1004, 1004, accessNone},
+	} {
+		ucred := &syscall.Ucred{Uid: t.uid, Gid: t.gid}
+		c.Assert(accessForCredentials(ucred, config), check.Equals, t.access, check.Commentf("uid %d", t.uid))
+	}
+
+	// Without groups configured only root gets in
+	c.Assert(accessForCredentials(&syscall.Ucred{Uid: 1001, Gid: 1001}, nil), check.Equals, accessNone)
+	c.Assert(accessForCredentials(&syscall.Ucred{Uid: 0}, nil), check.Equals, accessAdmin)
+}
+
+func (s *S) TestServeHTTPChecksAccess(c *check.C) {
+	svc := newMockService()
+	svc.addRoutes()
+
+	// Requests with unknown origin are refused
+	req, err := http.NewRequest(http.MethodGet, "/v1/status", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	svc.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusForbidden)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "unauthorized")
+
+	// while authenticated remote ones get in
+	req = req.WithContext(context.WithValue(req.Context(), remoteContextKey, true))
+	rec = httptest.NewRecorder()
+	svc.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestGetConfigurationHidesSecrets(c *check.C) {
+	dir := c.MkDir()
+	oldConfigPaths := configurationPaths
+	configurationPaths = []string{"../../conf/default-config", filepath.Join(dir, "config")}
+	defer func() { configurationPaths = oldConfigPaths }()
+	c.Assert(ioutil.WriteFile(configurationPaths[1], []byte("WIFI_SECURITY_PASSPHRASE=secret\n"), 0644), check.IsNil)
+
+	for access, visible := range map[accessLevel]bool{accessRead: false, accessAdmin: true} {
+		req, err := http.NewRequest(http.MethodGet, "/v1/configuration", nil)
+		c.Assert(err, check.IsNil)
+		req = req.WithContext(context.WithValue(req.Context(), accessContextKey, access))
+
+		rec := httptest.NewRecorder()
+		getConfiguration(newMockServiceCommand(), rec, req)
+
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		_, present := resp.Result["wifi.security-passphrase"]
+		c.Assert(present, check.Equals, visible)
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// Profiles are complete configurations which are stored in the same
+// format as $SNAP_DATA/config and replace it when activated.
+var validProfileName = regexp.MustCompile("^[a-z0-9][a-z0-9-]{0,31}$")
+
+func profilesDir() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "profiles")
+}
+
+func profilePath(name string) string {
+	return filepath.Join(profilesDir(), name)
+}
+
+// File storing the name of the last activated profile
+func activeProfilePath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "active-profile")
+}
+
+func listProfiles() ([]string, error) {
+	files, err := ioutil.ReadDir(profilesDir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		if validProfileName.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func loadProfile(name string) (map[string]interface{}, error) {
+	if _, err := os.Stat(profilePath(name)); err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]interface{})
+	if err := readConfigurationFile(profilePath(name), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func saveProfile(name string, config map[string]interface{}) error {
+	if err := os.MkdirAll(profilesDir(), 0755); err != nil {
+		return err
+	}
+	return osutil.AtomicWriteFile(profilePath(name), formatConfiguration(config), 0600, osutil.AtomicWriteFlags(0))
+}
+
+func removeProfile(name string) error {
+	if err := os.Remove(profilePath(name)); err != nil {
+		return err
+	}
+	if activeProfile() == name {
+		setActiveProfile("")
+	}
+	return nil
+}
+
+// activeProfile returns the name of the profile which was activated
+// last or an empty string if the configuration was changed since.
+func activeProfile() string {
+	data, err := ioutil.ReadFile(activeProfilePath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func setActiveProfile(name string) error {
+	if len(name) == 0 {
+		err := os.Remove(activeProfilePath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return osutil.AtomicWriteFile(activeProfilePath(), []byte(name+"\n"), 0644, osutil.AtomicWriteFlags(0))
+}
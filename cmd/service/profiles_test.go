@@ -0,0 +1,144 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/check.v1"
+)
+
+func doProfileRequest(c *check.C, cmd *serviceCommand, method, name, body string) (int, *serviceResponse) {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, "/v1/profiles/"+name, reader)
+	c.Assert(err, check.IsNil)
+	req = mux.SetURLVars(req, map[string]string{"name": name})
+
+	rec := httptest.NewRecorder()
+	switch method {
+	case http.MethodGet:
+		getProfile(cmd, rec, req)
+	case http.MethodPut:
+		putProfile(cmd, rec, req)
+	case http.MethodPost:
+		postProfile(cmd, rec, req)
+	case http.MethodDelete:
+		deleteProfile(cmd, rec, req)
+	}
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	return rec.Code, &resp
+}
+
+func (s *S) TestProfileStorage(c *check.C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+
+	names, err := listProfiles()
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+
+	c.Assert(saveProfile("field", map[string]interface{}{"wifi.ssid": "Field"}), check.IsNil)
+	c.Assert(saveProfile("depot", map[string]interface{}{"share.disabled": true}), check.IsNil)
+
+	names, err = listProfiles()
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"depot", "field"})
+
+	config, err := loadProfile("depot")
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, map[string]interface{}{"share.disabled": true})
+
+	c.Assert(setActiveProfile("depot"), check.IsNil)
+	c.Assert(activeProfile(), check.Equals, "depot")
+	c.Assert(removeProfile("depot"), check.IsNil)
+	c.Assert(activeProfile(), check.Equals, "")
+
+	_, err = loadProfile("depot")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestProfileActivation(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Depot\n")
+
+	cmd := newMockServiceCommand()
+
+	// Save the current configuration and a new one given by the client
+	code, _ := doProfileRequest(c, cmd, http.MethodPost, "depot", `{"action": "save"}`)
+	c.Assert(code, check.Equals, http.StatusOK)
+	code, _ = doProfileRequest(c, cmd, http.MethodPut, "field", `{"wifi.ssid": "Field", "share.network-interface": "wwan0"}`)
+	c.Assert(code, check.Equals, http.StatusOK)
+
+	code, resp := doProfileRequest(c, cmd, http.MethodGet, "depot", "")
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(resp.Result, check.DeepEquals, map[string]interface{}{"wifi.ssid": "Depot"})
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/profiles/field", strings.NewReader(`{"action": "activate"}`))
+	c.Assert(err, check.IsNil)
+	req = mux.SetURLVars(req, map[string]string{"name": "field"})
+	rec := httptest.NewRecorder()
+	postProfile(cmd, rec, req)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "SHARE_NETWORK_INTERFACE='wwan0'\nWIFI_SSID='Field'\n")
+	c.Assert(cmd.s.ap.Running(), check.Equals, true)
+
+	req, err = http.NewRequest(http.MethodGet, "/v1/profiles", nil)
+	c.Assert(err, check.IsNil)
+	rec = httptest.NewRecorder()
+	getProfiles(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), resp), check.IsNil)
+	c.Assert(resp.Result["profiles"], check.DeepEquals, []interface{}{"depot", "field"})
+	c.Assert(resp.Result["active"], check.Equals, "field")
+
+	code, _ = doProfileRequest(c, cmd, http.MethodDelete, "field", "")
+	c.Assert(code, check.Equals, http.StatusOK)
+	code, _ = doProfileRequest(c, cmd, http.MethodPost, "field", `{"action": "activate"}`)
+	c.Assert(code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestProfileInvalidRequests(c *check.C) {
+	s.setUpConfiguration(c, "")
+
+	cmd := newMockServiceCommand()
+
+	code, resp := doProfileRequest(c, cmd, http.MethodPut, "Bad_Name", `{"wifi.ssid": "x"}`)
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Result["message"], check.Equals, `Invalid profile name "Bad_Name"`)
+
+	code, _ = doProfileRequest(c, cmd, http.MethodPut, "field", `{"bad.token": "x"}`)
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	code, _ = doProfileRequest(c, cmd, http.MethodPost, "field", `{"action": "explode"}`)
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	code, _ = doProfileRequest(c, cmd, http.MethodGet, "missing", "")
+	c.Assert(code, check.Equals, http.StatusNotFound)
+}
@@ -0,0 +1,223 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bridge joining the access points of both radios into one network.
+// Has to match DUAL_BAND_BRIDGE in helper.sh.
+const dualBandBridge = "apbr0"
+
+// Items of the second radio and the access point items they replace
+// for it. All other items are shared by both radios.
+var radioKeys = map[string]string{
+	"radio2.interface":      "wifi.interface",
+	"radio2.channel":        "wifi.channel",
+	"radio2.operation-mode": "wifi.operation-mode",
+	"radio2.channel-width":  "wifi.channel-width",
+	"radio2.ieee80211ac":    "wifi.ieee80211ac",
+}
+
+// File in $SNAP_DATA radio.sh reads the selected channel from
+func radioAutoChannelPath() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), "auto-channel-radio2")
+}
+
+// File in $SNAP_DATA radio.sh writes the pid of its hostapd to
+const radioHostapdPidFile = "hostapd-radio2.pid"
+
+// dualBandEnabled returns whether the configuration operates a second
+// access point on radio2.interface.
+func dualBandEnabled(config map[string]interface{}) bool {
+	return fmt.Sprint(config["radio2.disabled"]) == "false"
+}
+
+// radioConfiguration returns the effective configuration of the second
+// radio, the one of the access point with the items of the radio in
+// place. The position of wide channels is always derived from the
+// channel of the radio.
+func radioConfiguration(config map[string]interface{}) map[string]interface{} {
+	radio := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		radio[key] = value
+	}
+	for radioKey, key := range radioKeys {
+		radio[key] = config[radioKey]
+	}
+	radio["wifi.interface-mode"] = "direct"
+	radio["wifi.secondary-channel"] = "auto"
+	radio["wifi.center-channel"] = autoChannel
+	return radio
+}
+
+// radioField turns an error about the configuration of the second radio
+// into one about the items of the radio.
+func radioField(field *fieldError) *fieldError {
+	if field == nil {
+		return nil
+	}
+	radio := &fieldError{Field: field.Field, Message: field.Message}
+	for radioKey, key := range radioKeys {
+		if field.Field == key {
+			radio.Field = radioKey
+		}
+		radio.Message = strings.Replace(radio.Message, key, radioKey, -1)
+	}
+	return radio
+}
+
+// validateRadio checks that the second radio of the given effective
+// configuration can operate next to the access point.
+func validateRadio(config map[string]interface{}) *fieldError {
+	if !dualBandEnabled(config) {
+		return nil
+	}
+
+	switch {
+	case config["wifi.interface-mode"] == "virtual":
+		return &fieldError{"radio2.disabled", "A second radio requires wifi.interface-mode direct"}
+	case fmt.Sprint(config["radio2.interface"]) == fmt.Sprint(config["wifi.interface"]):
+		return &fieldError{"radio2.interface", "The second radio requires another interface than wifi.interface"}
+	}
+
+	radio := radioConfiguration(config)
+	if field := validateThroughput(radio); field != nil {
+		return radioField(field)
+	}
+	return radioField(validateRegulatory(radio))
+}
+
+// validateRadioHardware checks that the second radio of the given
+// effective configuration is a device of its own which supports the
+// access point mode and the 802.11n/ac settings of the radio.
+func validateRadioHardware(previous, config map[string]interface{}) *fieldError {
+	if !dualBandEnabled(config) {
+		return nil
+	}
+	changed := !dualBandEnabled(previous) || fmt.Sprint(previous["wifi.interface"]) != fmt.Sprint(config["wifi.interface"])
+	for radioKey := range radioKeys {
+		changed = changed || fmt.Sprint(previous[radioKey]) != fmt.Sprint(config[radioKey])
+	}
+	if !changed {
+		return nil
+	}
+
+	phys, err := loadHardware()
+	if err != nil {
+		log.Printf("Can not check the wireless hardware: %s", err)
+		return nil
+	}
+
+	iface := fmt.Sprint(config["radio2.interface"])
+	var primary, secondary *wirelessPhy
+	for n := range phys {
+		if containsString(phys[n].Interfaces, fmt.Sprint(config["wifi.interface"])) {
+			primary = &phys[n]
+		}
+		if containsString(phys[n].Interfaces, iface) {
+			secondary = &phys[n]
+		}
+	}
+
+	switch {
+	case secondary == nil:
+		// The device might not be plugged in yet
+		return nil
+	case secondary == primary:
+		return &fieldError{"radio2.interface",
+			fmt.Sprintf("Interface %s belongs to %s like wifi.interface, the second radio requires another device",
+				iface, secondary.Name)}
+	case !secondary.AccessPoint:
+		return &fieldError{"radio2.interface",
+			fmt.Sprintf("Interface %s (%s) can not operate an access point", iface, secondary.Name)}
+	}
+	return radioField(validateThroughputHardware(secondary, radioConfiguration(config)))
+}
+
+// startRadio starts the access point on the second radio if the given
+// configuration asks for it. The radio.sh script waits for ap.sh to
+// create the bridge the access point joins.
+func (s *service) startRadio(config map[string]interface{}) error {
+	if s.radio2 == nil || config["disabled"] == true || !dualBandEnabled(config) {
+		return nil
+	}
+
+	radio := radioConfiguration(config)
+	iface := fmt.Sprint(radio["wifi.interface"])
+	channel := fmt.Sprint(radio["wifi.channel"])
+	selection := prepareChannel(radio, iface, radioAutoChannelPath(), s.radio2Status.radarFallback())
+	if selection != nil {
+		channel = strconv.Itoa(selection.Channel)
+	}
+	s.radio2Status.channelSelected(selection)
+
+	startedAt := time.Now()
+	if err := s.radio2.Start(); err != nil {
+		s.radio2Status.transition(apStateFailed, err.Error())
+		return err
+	}
+
+	pid := s.radio2.Pid()
+	s.radio2Status.launched(pid, false, fmt.Sprint(config["wifi.ssid"]), channel, iface)
+	s.radio2Monitors.start(func(stop <-chan struct{}) {
+		s.waitForAccessPoint(&s.radio2Status, pid, radioHostapdPidFile, startedAt, stop)
+	})
+	s.radio2Monitors.start(func(stop <-chan struct{}) {
+		s.monitorHostapd(&s.radio2Status, pid, iface, stop)
+	})
+	return nil
+}
+
+func (s *service) stopRadio() error {
+	s.radio2Monitors.stop()
+	if s.radio2 == nil || !s.radio2.Running() {
+		return nil
+	}
+	if state := s.radio2Status.State(); state == apStateStarting || state == apStateRunning {
+		s.radio2Status.transition(apStateStopping, "")
+	}
+	return s.radio2.Stop()
+}
+
+func (s *service) radioExited(exit processExit) {
+	if s.radio2Status.exited(exit) == apStateRunning {
+		log.Printf("Access point process of the second radio terminated with exit code %d", exit.ExitCode)
+	}
+}
+
+// radioStatus returns the status of the second radio in the format used
+// by the REST API or nil if it never operated an access point.
+func (s *service) radioStatus() map[string]interface{} {
+	status := s.radio2Status.toMap()
+	if history, _ := status["ap.history"].([]apTransition); len(history) == 0 {
+		return nil
+	}
+
+	radio := make(map[string]interface{}, len(status)+1)
+	for key, value := range status {
+		radio["radio2."+strings.TrimPrefix(key, "ap.")] = value
+	}
+	radio["radio2.active"] = s.radio2 != nil && s.radio2.Running()
+	return radio
+}
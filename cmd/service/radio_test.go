@@ -0,0 +1,168 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidateRadio(c *check.C) {
+	defaultValues = make(map[string]interface{})
+	c.Assert(readConfigurationFile("../../conf/default-config", defaultValues), check.IsNil)
+
+	// Disabled radios are not checked
+	c.Assert(validateChannelConfiguration(effectiveConfiguration(map[string]interface{}{
+		"radio2.interface": "wlan0",
+	})), check.IsNil)
+
+	for _, t := range []struct {
+		config map[string]interface{}
+		field  *fieldError
+	}{
+		{map[string]interface{}{}, nil},
+		{map[string]interface{}{"radio2.channel": "auto", "radio2.channel-width": 80, "radio2.ieee80211ac": true}, nil},
+		{map[string]interface{}{"wifi.interface-mode": "virtual"},
+			&fieldError{"radio2.disabled", "A second radio requires wifi.interface-mode direct"}},
+		{map[string]interface{}{"radio2.interface": "wlan0"},
+			&fieldError{"radio2.interface", "The second radio requires another interface than wifi.interface"}},
+		{map[string]interface{}{"radio2.channel": "149"},
+			&fieldError{"radio2.channel",
+				"Channel 149 is not allowed with operation mode a in JP, allowed are [36 40 44 48 52 56 60 64 100 104 108 112 116 120 124 128 132 136 140]"}},
+		{map[string]interface{}{"wifi.country-code": ""},
+			&fieldError{"wifi.country-code",
+				"Operation mode a requires wifi.country-code to be set"}},
+		{map[string]interface{}{"radio2.operation-mode": "g", "radio2.ieee80211ac": true},
+			&fieldError{"radio2.ieee80211ac", "802.11ac requires operation mode a"}},
+		{map[string]interface{}{"radio2.channel-width": 80},
+			&fieldError{"radio2.channel-width", "A channel width of 80 MHz requires radio2.ieee80211ac"}},
+	} {
+		config := map[string]interface{}{"radio2.disabled": false, "wifi.country-code": "JP"}
+		for key, value := range t.config {
+			config[key] = value
+		}
+		c.Assert(validateChannelConfiguration(effectiveConfiguration(config)), check.DeepEquals, t.field,
+			check.Commentf("%v", t.config))
+	}
+
+	c.Assert(validateConfigurationValue("radio2.channel", "first"), check.ErrorMatches,
+		`Invalid value "first" for "radio2.channel": must be a number or auto`)
+}
+
+func (s *S) TestRadioHardwareValidation(c *check.C) {
+	defer mockIwHardware(iwListOutput, iwDevOutput+"\tInterface wlan1\n")()
+
+	s.setUpConfiguration(c, "WIFI_INTERFACE=wlx0\nWIFI_CHANNEL=1\n")
+
+	cmd := newMockServiceCommand()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		postConfiguration(cmd, rec, req)
+		return rec
+	}
+	details := func(rec *httptest.ResponseRecorder) interface{} {
+		c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		return resp.Result["details"]
+	}
+
+	// The radios have to be different devices
+	rec := post(`{"radio2.disabled": false, "wifi.interface": "wlan0", "radio2.interface": "wlan1", "wifi.country-code": "DE"}`)
+	c.Assert(details(rec), check.DeepEquals, map[string]interface{}{
+		"radio2.interface": "Interface wlan1 belongs to phy0 like wifi.interface, the second radio requires another device",
+	})
+
+	rec = post(`{"radio2.disabled": false, "radio2.interface": "wlan0", "radio2.channel-width": 160, "radio2.ieee80211ac": true,
+		"wifi.country-code": "DE"}`)
+	c.Assert(details(rec), check.DeepEquals, map[string]interface{}{
+		"radio2.channel-width": "Interface wlan0 (phy0) does not support 160 MHz wide channels on 5GHz",
+	})
+
+	rec = post(`{"radio2.disabled": false, "radio2.interface": "wlan0", "radio2.channel-width": 80, "radio2.ieee80211ac": true,
+		"wifi.country-code": "DE"}`)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+}
+
+func (s *S) TestRadioLifecycle(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	oldConfigPaths := configurationPaths
+	configurationPaths = []string{"../../conf/default-config", getConfigOnPath(dir)}
+	defer func() { configurationPaths = oldConfigPaths }()
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("DISABLED=false\n"), 0644), check.IsNil)
+
+	radio := &mockBackgroundProcess{}
+	cmd := newMockServiceCommand()
+	cmd.s.radio2 = radio
+
+	// Without a second radio its status is not reported
+	c.Assert(cmd.s.restartAccessPoint(), check.IsNil)
+	c.Assert(radio.running, check.Equals, false)
+	status := getStatusMap(c, cmd)
+	_, ok := status["radio2.state"]
+	c.Assert(ok, check.Equals, false)
+
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir),
+		[]byte("DISABLED=false\nRADIO2_DISABLED=false\nRADIO2_CHANNEL=auto\nWIFI_COUNTRY_CODE=DE\n"), 0644), check.IsNil)
+	restore := mockIw(iwScanOutput, iwSurveyOutput, nil)
+	defer restore()
+	c.Assert(cmd.s.restartAccessPoint(), check.IsNil)
+	c.Assert(radio.running, check.Equals, true)
+
+	status = getStatusMap(c, cmd)
+	c.Assert(status["radio2.state"], check.Equals, string(apStateStarting))
+	c.Assert(status["radio2.interface"], check.Equals, "wlan1")
+	c.Assert(status["radio2.ssid"], check.Equals, "Ubuntu")
+	c.Assert(status["radio2.active"], check.Equals, true)
+	c.Assert(status["radio2.channel-selection"], check.NotNil)
+	channel, err := ioutil.ReadFile(radioAutoChannelPath())
+	c.Assert(err, check.IsNil)
+	c.Assert(status["radio2.channel"], check.Equals, strings.TrimSpace(string(channel)))
+
+	// Stopping the access point stops the radio as well
+	c.Assert(cmd.s.stopAccessPoint(), check.IsNil)
+	c.Assert(radio.running, check.Equals, false)
+	c.Assert(getStatusMap(c, cmd)["radio2.state"], check.Equals, string(apStateStopping))
+	cmd.s.radioExited(processExit{Pid: radio.pid})
+	c.Assert(getStatusMap(c, cmd)["radio2.state"], check.Equals, string(apStateDisabled))
+
+	// The radio doesn't outlive an access point which terminated
+	c.Assert(cmd.s.restartAccessPoint(), check.IsNil)
+	c.Assert(radio.running, check.Equals, true)
+	cmd.s.accessPointExited(processExit{Pid: cmd.s.ap.Pid(), ExitCode: 1})
+	c.Assert(radio.running, check.Equals, false)
+	c.Assert(getStatusMap(c, cmd)["radio2.state"], check.Equals, string(apStateStopping))
+}
+
+func getStatusMap(c *check.C, cmd *serviceCommand) map[string]interface{} {
+	req, err := http.NewRequest(http.MethodGet, "/v1/status", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	getStatus(cmd, rec, req)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	return resp.Result
+}
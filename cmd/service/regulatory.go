@@ -0,0 +1,277 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// regulatoryDomain lists the channels a country allows access points to
+// operate on in each band.
+type regulatoryDomain struct {
+	Name       string
+	Channels24 []int
+	Channels5  []int
+}
+
+func channelRange(first, last, step int) []int {
+	var channels []int
+	for channel := first; channel <= last; channel += step {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func joinChannels(lists ...[]int) []int {
+	var channels []int
+	for _, list := range lists {
+		channels = append(channels, list...)
+	}
+	return channels
+}
+
+// Channel groups of the 5 GHz band
+var (
+	channelsUNII1  = channelRange(36, 48, 4)
+	channelsUNII2  = channelRange(52, 64, 4)
+	channelsUNII2e = channelRange(100, 140, 4)
+	channelsUNII3  = channelRange(149, 165, 4)
+)
+
+// Channels which require radar detection (DFS) before they can be used
+var dfsChannels = joinChannels(channelsUNII2, channelsUNII2e, []int{144})
+
+// Channels of the 60 GHz band usable everywhere 802.11ad is allowed
+var channels60 = channelRange(1, 4, 1)
+
+// worldDomain applies if no country code is configured. It only allows
+// channels usable everywhere. Like the world domain of
+// the kernel it doesn't allow to initiate radiation on 5 GHz, so an
+// access point there needs a country code.
+var worldDomain = &regulatoryDomain{
+	Name:       "world",
+	Channels24: channelRange(1, 11, 1),
+}
+
+var (
+	domainFCC = &regulatoryDomain{
+		Name:       "FCC",
+		Channels24: channelRange(1, 11, 1),
+		Channels5:  joinChannels(channelsUNII1, channelsUNII2, channelsUNII2e, []int{144}, channelsUNII3),
+	}
+	domainETSI = &regulatoryDomain{
+		Name:       "ETSI",
+		Channels24: channelRange(1, 13, 1),
+		Channels5:  joinChannels(channelsUNII1, channelsUNII2, channelsUNII2e),
+	}
+	domainJP = &regulatoryDomain{
+		Name:       "JP",
+		Channels24: channelRange(1, 13, 1),
+		Channels5:  joinChannels(channelsUNII1, channelsUNII2, channelsUNII2e),
+	}
+	domainCN = &regulatoryDomain{
+		Name:       "CN",
+		Channels24: channelRange(1, 13, 1),
+		Channels5:  joinChannels(channelsUNII1, channelsUNII2, channelsUNII3),
+	}
+	domainAPAC = &regulatoryDomain{
+		Name:       "APAC",
+		Channels24: channelRange(1, 13, 1),
+		Channels5:  joinChannels(channelsUNII1, channelsUNII2, channelsUNII2e, channelsUNII3),
+	}
+)
+
+// regulatoryDomains maps ISO 3166-1 country codes to the rules of the
+// country. It is a simplified version of the wireless-regdb covering
+// the markets devices are shipped to.
+var regulatoryDomains = map[string]*regulatoryDomain{
+	"US": domainFCC, "CA": domainFCC, "MX": domainFCC, "PR": domainFCC,
+	"AT": domainETSI, "BE": domainETSI, "BG": domainETSI, "CH": domainETSI,
+	"CY": domainETSI, "CZ": domainETSI, "DE": domainETSI, "DK": domainETSI,
+	"EE": domainETSI, "ES": domainETSI, "FI": domainETSI, "FR": domainETSI,
+	"GB": domainETSI, "GR": domainETSI, "HR": domainETSI, "HU": domainETSI,
+	"IE": domainETSI, "IS": domainETSI, "IT": domainETSI, "LI": domainETSI,
+	"LT": domainETSI, "LU": domainETSI, "LV": domainETSI, "MT": domainETSI,
+	"NL": domainETSI, "NO": domainETSI, "PL": domainETSI, "PT": domainETSI,
+	"RO": domainETSI, "SE": domainETSI, "SI": domainETSI, "SK": domainETSI,
+	"JP": domainJP,
+	"CN": domainCN,
+	"AU": domainAPAC, "NZ": domainAPAC, "IN": domainAPAC, "KR": domainAPAC,
+	"SG": domainAPAC,
+}
+
+var countryCodePattern = regexp.MustCompile("^[A-Z]{2}$")
+
+// lookupRegulatoryDomain returns the rules of the given country, the
+// world domain without a country code or nil if the country is not
+// supported.
+func lookupRegulatoryDomain(countryCode string) *regulatoryDomain {
+	if len(countryCode) == 0 {
+		return worldDomain
+	}
+	return regulatoryDomains[countryCode]
+}
+
+// unsupportedCountry describes why the given country code can't be used.
+func unsupportedCountry(countryCode string) string {
+	codes := make([]string, 0, len(regulatoryDomains))
+	for code := range regulatoryDomains {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return fmt.Sprintf("country %s is not supported, supported are %s", countryCode, strings.Join(codes, ", "))
+}
+
+// channels returns the channels allowed with the given operation mode.
+// Countries which are not supported allow none.
+func (domain *regulatoryDomain) channels(operationMode string) []int {
+	if domain == nil {
+		return nil
+	}
+	switch operationMode {
+	case "a":
+		return domain.Channels5
+	case "ad":
+		return channels60
+	case "b":
+		// Japan allows channel 14 for 802.11b only
+		if domain == domainJP {
+			return joinChannels(domain.Channels24, []int{14})
+		}
+	}
+	return domain.Channels24
+}
+
+func containsChannel(channels []int, channel int) bool {
+	for _, allowed := range channels {
+		if allowed == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func isDFSChannel(channel int) bool {
+	return containsChannel(dfsChannels, channel)
+}
+
+// channelFrequency returns the center frequency in MHz of the channel
+// in the band of the given operation mode.
+func channelFrequency(operationMode string, channel int) int {
+	switch {
+	case operationMode == "a":
+		return 5000 + 5*channel
+	case operationMode == "ad":
+		return 56160 + 2160*channel
+	case channel == 14:
+		return 2484
+	}
+	return 2407 + 5*channel
+}
+
+// effectiveConfiguration returns the given system configuration with
+// the default values filled in.
+func effectiveConfiguration(config map[string]interface{}) map[string]interface{} {
+	effective := make(map[string]interface{}, len(defaultValues)+len(config))
+	for key, value := range defaultValues {
+		effective[key] = value
+	}
+	for key, value := range config {
+		effective[key] = value
+	}
+	return effective
+}
+
+// validateRegulatory checks that the channel of the given effective
+// configuration may be used in its band and country with its whole
+// width. Returns a field error for wifi.channel or wifi.channel-width,
+// or nil.
+func validateRegulatory(config map[string]interface{}) *fieldError {
+	countryCode := ""
+	if value, ok := config["wifi.country-code"]; ok {
+		countryCode = fmt.Sprint(value)
+	}
+	where := "without a country code"
+	if len(countryCode) > 0 {
+		where = "in " + countryCode
+	}
+	operationMode := fmt.Sprint(config["wifi.operation-mode"])
+	width := channelWidth(config)
+
+	domain := lookupRegulatoryDomain(countryCode)
+	allowed := domain.channels(operationMode)
+	switch {
+	case domain == nil:
+		// Stored by a version which didn't check the country code
+		return &fieldError{"wifi.country-code", fmt.Sprintf("The %s", unsupportedCountry(countryCode))}
+	case len(allowed) == 0 && len(countryCode) == 0:
+		return &fieldError{"wifi.country-code", fmt.Sprintf("Operation mode %s requires wifi.country-code to be set", operationMode)}
+	case len(allowed) == 0:
+		return &fieldError{"wifi.country-code", fmt.Sprintf("Operation mode %s is not allowed %s", operationMode, where)}
+	}
+
+	text := fmt.Sprint(config["wifi.channel"])
+	channel, err := strconv.Atoi(text)
+	if err != nil {
+		// Automatic selection only picks allowed channels but needs one
+		if len(candidateChannels(config, nil)) == 0 {
+			return &fieldError{"wifi.channel-width", fmt.Sprintf("No channel of operation mode %s with a width of %d MHz and without DFS is allowed %s",
+				operationMode, width, where)}
+		}
+		return nil
+	}
+
+	if !containsChannel(allowed, channel) {
+		return &fieldError{"wifi.channel", fmt.Sprintf("Channel %d is not allowed with operation mode %s %s, allowed are %v",
+			channel, operationMode, where, allowed)}
+	}
+	for _, occupied := range occupiedChannels(config, channel) {
+		if !containsChannel(allowed, occupied) {
+			return &fieldError{"wifi.channel-width", fmt.Sprintf("Channel %d with a width of %d MHz occupies channel %d which is not allowed with operation mode %s %s",
+				channel, width, occupied, operationMode, where)}
+		}
+	}
+	return nil
+}
+
+// regulatoryInformation describes the channels allowed in the given
+// country for every operation mode in the format of the REST API.
+func regulatoryInformation(countryCode string) map[string]interface{} {
+	domain := lookupRegulatoryDomain(countryCode)
+
+	channels := make(map[string]interface{})
+	for _, mode := range findSchemaItem("wifi.operation-mode").Values {
+		list := []map[string]interface{}{}
+		for _, channel := range domain.channels(mode) {
+			list = append(list, map[string]interface{}{
+				"channel":   channel,
+				"frequency": channelFrequency(mode, channel),
+				"dfs":       mode == "a" && isDFSChannel(channel),
+			})
+		}
+		channels[mode] = list
+	}
+
+	return map[string]interface{}{
+		"country-code": countryCode,
+		"domain":       domain.Name,
+		"channels":     channels,
+	}
+}
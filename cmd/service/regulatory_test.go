@@ -0,0 +1,186 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidateRegulatory(c *check.C) {
+	for _, t := range []struct {
+		channel, mode, country string
+		valid                  bool
+	}{
+		{"11", "g", "", true},
+		{"13", "g", "", false},
+		{"13", "g", "DE", true},
+		{"13", "g", "US", false},
+		{"14", "g", "JP", false},
+		{"14", "b", "JP", true},
+		{"36", "a", "", false},
+		{"auto", "a", "", false},
+		{"36", "a", "DE", true},
+		{"52", "a", "DE", true},
+		{"149", "a", "DE", false},
+		{"149", "a", "US", true},
+		{"6", "a", "US", false},
+		{"2", "ad", "US", true},
+		{"auto", "g", "", true},
+		// Countries which are not supported allow no channel at all
+		{"11", "g", "ZZ", false},
+	} {
+		config := map[string]interface{}{"wifi.channel": t.channel, "wifi.operation-mode": t.mode}
+		if len(t.country) > 0 {
+			config["wifi.country-code"] = t.country
+		}
+		field := validateRegulatory(config)
+		c.Assert(field == nil, check.Equals, t.valid, check.Commentf("%v", t))
+	}
+
+	field := validateRegulatory(map[string]interface{}{"wifi.channel": "13", "wifi.operation-mode": "g", "wifi.country-code": "US"})
+	c.Assert(field.Message, check.Equals, "Channel 13 is not allowed with operation mode g in US, allowed are [1 2 3 4 5 6 7 8 9 10 11]")
+
+	// The world domain doesn't allow to initiate radiation on 5 GHz
+	field = validateRegulatory(map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a"})
+	c.Assert(field, check.DeepEquals, &fieldError{"wifi.country-code",
+		"Operation mode a requires wifi.country-code to be set"})
+
+	// Stored by a version which accepted any country code
+	field = validateRegulatory(map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "g", "wifi.country-code": "BR"})
+	c.Assert(field.Field, check.Equals, "wifi.country-code")
+	c.Assert(field.Message, check.Matches, "The country BR is not supported, supported are AT, AU, .*")
+
+	c.Assert(validateConfigurationValue("wifi.country-code", "DE"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.country-code", ""), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.country-code", "de"), check.NotNil)
+	c.Assert(validateConfigurationValue("wifi.country-code", "BR"), check.ErrorMatches,
+		`Invalid value "BR" for "wifi.country-code": country BR is not supported, supported are AT, AU, BE, .*, US`)
+}
+
+func (s *S) TestRegulatoryConfigurationChange(c *check.C) {
+	s.setUpConfiguration(c, "WIFI_CHANNEL=6\n")
+
+	cmd := newMockServiceCommand()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		postConfiguration(cmd, rec, req)
+		return rec
+	}
+
+	rec := post(`{"wifi.channel": "13"}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-value")
+	c.Assert(resp.Result["details"].(map[string]interface{})["wifi.channel"], check.Matches, "Channel 13 is not allowed .*")
+
+	// Together with a country allowing it the channel is fine
+	rec = post(`{"wifi.channel": "13", "wifi.country-code": "DE"}`)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	// Changing the country has to keep the channel legal
+	rec = post(`{"wifi.country-code": "US"}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGetRegulatory(c *check.C) {
+	dir := c.MkDir()
+	oldConfigPaths := configurationPaths
+	configurationPaths = []string{"../../conf/default-config", getConfigOnPath(dir)}
+	defer func() { configurationPaths = oldConfigPaths }()
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_COUNTRY_CODE=DE\n"), 0644), check.IsNil)
+
+	get := func(path string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		getRegulatory(newMockServiceCommand(), rec, req)
+		var resp serviceResponse
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+		return rec.Code, resp.Result
+	}
+
+	code, result := get("/v1/regulatory")
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(result["country-code"], check.Equals, "DE")
+	c.Assert(result["domain"], check.Equals, "ETSI")
+	channels := result["channels"].(map[string]interface{})
+	c.Assert(channels["g"], check.HasLen, 13)
+	c.Assert(channels["a"].([]interface{})[4], check.DeepEquals, map[string]interface{}{
+		"channel":   52.0,
+		"frequency": 5260.0,
+		"dfs":       true,
+	})
+
+	code, result = get("/v1/regulatory?country-code=US")
+	c.Assert(code, check.Equals, http.StatusOK)
+	c.Assert(result["domain"], check.Equals, "FCC")
+
+	code, _ = get("/v1/regulatory?country-code=usa")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+
+	// There are no rules for unsupported countries to report
+	code, result = get("/v1/regulatory?country-code=BR")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(result["kind"], check.Equals, "invalid-value")
+
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_COUNTRY_CODE=BR\n"), 0644), check.IsNil)
+	code, result = get("/v1/regulatory")
+	c.Assert(code, check.Equals, http.StatusBadRequest)
+	c.Assert(result["message"], check.Matches, `Invalid value "BR" for "wifi.country-code": country BR is not supported, .*`)
+}
+
+func (s *S) TestChangeConfigurationKeepsStoredChannelConfiguration(c *check.C) {
+	// Older versions accepted 5 GHz without a country code
+	dir := s.setUpConfiguration(c, "WIFI_OPERATION_MODE=a\nWIFI_CHANNEL=36\n")
+
+	cmd := newMockServiceCommand()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		postConfiguration(cmd, rec, req)
+		return rec
+	}
+
+	// Unrelated items can still be changed
+	change := waitForChange(c, cmd, post(`{"wifi.ssid": "Depot"}`))
+	c.Assert(change["status"], check.Equals, changeDone)
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{getConfigOnPath(dir)}, config), check.IsNil)
+	c.Assert(config["wifi.ssid"], check.Equals, "Depot")
+
+	// Touching the channel needs the country code though
+	rec := post(`{"wifi.channel": "40"}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.country-code": "Operation mode a requires wifi.country-code to be set",
+	})
+
+	change = waitForChange(c, cmd, post(`{"wifi.channel": "40", "wifi.country-code": "DE"}`))
+	c.Assert(change["status"], check.Equals, changeDone)
+}
@@ -0,0 +1,228 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files in $SNAP_DATA configuring the remote management listener
+const (
+	remoteDirSuffix      = "remote"
+	remoteCertificate    = "server.crt"
+	remoteKey            = "server.key"
+	remoteClientCA       = "client-ca.crt"
+	remoteTokensFileName = "tokens"
+)
+
+// Timeouts of remote connections. Requests have to arrive quickly as
+// the token is only checked once the headers are read. Waiting for
+// events gets maxEventWait on top of the time to write the response.
+const (
+	remoteReadHeaderTimeout = 10 * time.Second
+	remoteReadTimeout       = 30 * time.Second
+	remoteWriteTimeout      = 30 * time.Second
+	remoteIdleTimeout       = 2 * time.Minute
+)
+
+func remoteDir() string {
+	return filepath.Join(os.Getenv("SNAP_DATA"), remoteDirSuffix)
+}
+
+// loadRemoteTokens reads the bearer tokens accepted by the remote
+// management listener. The file has one token per line, empty lines
+// and lines starting with # are ignored.
+func loadRemoteTokens(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, scanner.Err()
+}
+
+// remoteTLSConfig loads the server certificate and, if present, the CA
+// client certificates have to be signed with.
+func remoteTLSConfig(dir string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, remoteCertificate), filepath.Join(dir, remoteKey))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(dir, remoteClientCA))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", remoteClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// remoteTokens holds the accepted access tokens and reads them again
+// when their file changes, so that tokens can be added and revoked
+// without restarting the service.
+type remoteTokens struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	tokens  []string
+}
+
+// current returns the tokens currently in the file. No token is
+// accepted anymore if the file is removed or can't be read.
+func (t *remoteTokens) current() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		t.tokens, t.modTime, t.size = nil, time.Time{}, 0
+		return nil
+	}
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.tokens
+	}
+
+	tokens, err := loadRemoteTokens(t.path)
+	if err != nil {
+		log.Printf("Failed to read access tokens: %s", err)
+		t.tokens, t.modTime, t.size = nil, time.Time{}, 0
+		return nil
+	}
+	t.tokens, t.modTime, t.size = tokens, info.ModTime(), info.Size()
+	return t.tokens
+}
+
+// requireToken only passes requests to the handler which carry one of
+// the tokens given by the function as bearer token.
+func requireToken(tokens func() []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		header := request.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Bearer ") {
+			given := []byte(strings.TrimPrefix(header, "Bearer "))
+			for _, token := range tokens() {
+				if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+					ctx := context.WithValue(request.Context(), remoteContextKey, true)
+					handler.ServeHTTP(writer, request.WithContext(ctx))
+					return
+				}
+			}
+		}
+
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="wifi-ap"`)
+		resp := makeErrorResponse(http.StatusUnauthorized, "Missing or invalid access token", errorKindUnauthorized)
+		sendHTTPResponse(writer, resp)
+	})
+}
+
+// limitWriteTime gives every request remoteWriteTimeout to write its
+// response. Requests waiting for events get the time they may wait on
+// top of it.
+func limitWriteTime(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		timeout := remoteWriteTimeout
+		if request.URL.Path == eventsCmd.Path {
+			timeout += maxEventWait
+		}
+		// Not every writer supports deadlines, like the ones of tests
+		http.NewResponseController(writer).SetWriteDeadline(time.Now().Add(timeout))
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// listenRemote opens the TLS listener for remote management on the
+// given address. It serves the same API as the unix socket but every
+// request has to be authenticated with a token.
+func (s *service) listenRemote(address string) error {
+	dir := remoteDir()
+	tokens := &remoteTokens{path: filepath.Join(dir, remoteTokensFileName)}
+	if _, err := loadRemoteTokens(tokens.path); err != nil {
+		return fmt.Errorf("Failed to read access tokens: %s", err)
+	}
+	if len(tokens.current()) == 0 {
+		return fmt.Errorf("No access tokens configured in %s", tokens.path)
+	}
+
+	config, err := remoteTLSConfig(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS configuration: %s", err)
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.remoteListener = tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+
+	server := &http.Server{
+		Handler:           limitWriteTime(requireToken(tokens.current, s.router)),
+		ConnContext:       saveConnInContext,
+		ReadHeaderTimeout: remoteReadHeaderTimeout,
+		ReadTimeout:       remoteReadTimeout,
+		IdleTimeout:       remoteIdleTimeout,
+	}
+	s.tomb.Go(func() error {
+		err := server.Serve(s.remoteListener)
+		// Closing the listener on shutdown is expected
+		if err != nil && s.tomb.Alive() {
+			return fmt.Errorf("Failed to serve remote HTTP: %s", err)
+		}
+		return nil
+	})
+
+	log.Printf("Listening for remote management on %s", address)
+	if config.ClientAuth == tls.RequireAndVerifyClientCert {
+		log.Println("Remote clients have to present a certificate")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// writeTestCertificate creates a self-signed certificate for localhost
+// and returns it in PEM format.
+func writeTestCertificate(c *check.C, certPath, keyPath string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	c.Assert(ioutil.WriteFile(certPath, cert, 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), check.IsNil)
+	return cert
+}
+
+func (s *S) TestLoadRemoteTokens(c *check.C) {
+	path := filepath.Join(c.MkDir(), "tokens")
+	c.Assert(ioutil.WriteFile(path, []byte("# dashboard\nsecret-one\n\n  secret-two  \n"), 0600), check.IsNil)
+
+	tokens, err := loadRemoteTokens(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.DeepEquals, []string{"secret-one", "secret-two"})
+
+	_, err = loadRemoteTokens(path + ".missing")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestRemoteTokensReload(c *check.C) {
+	path := filepath.Join(c.MkDir(), remoteTokensFileName)
+	c.Assert(ioutil.WriteFile(path, []byte("secret-one\n"), 0600), check.IsNil)
+
+	tokens := &remoteTokens{path: path}
+	c.Assert(tokens.current(), check.DeepEquals, []string{"secret-one"})
+
+	// Revoking a token doesn't need a restart
+	c.Assert(ioutil.WriteFile(path, []byte("secret-two\nsecret-three\n"), 0600), check.IsNil)
+	c.Assert(tokens.current(), check.DeepEquals, []string{"secret-two", "secret-three"})
+
+	c.Assert(os.Remove(path), check.IsNil)
+	c.Assert(tokens.current(), check.HasLen, 0)
+}
+
+func (s *S) TestRequireToken(c *check.C) {
+	handler := requireToken(func() []string { return []string{"secret"} }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendHTTPResponse(w, makeResponse(http.StatusOK, nil))
+	}))
+
+	for header, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "/v1/status", nil)
+		c.Assert(err, check.IsNil)
+		if len(header) > 0 {
+			req.Header.Set("Authorization", header)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		c.Assert(rec.Code, check.Equals, code, check.Commentf("header %q", header))
+
+		if code == http.StatusUnauthorized {
+			var resp serviceResponse
+			c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+			c.Assert(resp.Result["kind"], check.Equals, "unauthorized")
+			c.Assert(rec.Header().Get("WWW-Authenticate"), check.Equals, `Bearer realm="wifi-ap"`)
+		}
+	}
+}
+
+func (s *S) TestListenRemote(c *check.C) {
+	os.Setenv("SNAP_DATA", c.MkDir())
+	dir := remoteDir()
+	c.Assert(os.MkdirAll(dir, 0700), check.IsNil)
+
+	svc := newMockService()
+	svc.addRoutes()
+
+	// Neither tokens nor certificate are there yet
+	c.Assert(svc.listenRemote("127.0.0.1:0"), check.ErrorMatches, "Failed to read access tokens: .*")
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, remoteTokensFileName), []byte("secret\n"), 0600), check.IsNil)
+	c.Assert(svc.listenRemote("127.0.0.1:0"), check.ErrorMatches, "Failed to load TLS configuration: .*")
+
+	cert := writeTestCertificate(c, filepath.Join(dir, remoteCertificate), filepath.Join(dir, remoteKey))
+	c.Assert(svc.listenRemote("127.0.0.1:0"), check.IsNil)
+	defer func() {
+		svc.tomb.Kill(nil)
+		svc.remoteListener.Close()
+		svc.tomb.Wait()
+	}()
+
+	pool := x509.NewCertPool()
+	c.Assert(pool.AppendCertsFromPEM(cert), check.Equals, true)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	uri := "https://" + svc.remoteListener.Addr().String() + "/v1/status"
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "secret": http.StatusOK} {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, check.Equals, code)
+	}
+
+	// Revoked tokens are rejected right away
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, remoteTokensFileName), []byte("# revoked\n"), 0600), check.IsNil)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestRemoteTLSConfigRequiresClientCertificates(c *check.C) {
+	dir := c.MkDir()
+	cert := writeTestCertificate(c, filepath.Join(dir, remoteCertificate), filepath.Join(dir, remoteKey))
+
+	config, err := remoteTLSConfig(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.ClientAuth, check.Equals, tls.NoClientCert)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, remoteClientCA), cert, 0644), check.IsNil)
+	config, err = remoteTLSConfig(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.ClientAuth, check.Equals, tls.RequireAndVerifyClientCert)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, remoteClientCA), []byte("garbage"), 0644), check.IsNil)
+	_, err = remoteTLSConfig(dir)
+	c.Assert(err, check.ErrorMatches, "No certificates found in client-ca.crt")
+}
@@ -39,15 +39,48 @@ type serviceResponse struct {
 	Type       string                 `json:"type"`
 }
 
-func makeErrorResponse(code int, message, kind string) *serviceResponse {
+// Kinds of errors the service reports so that clients can react on
+// them without parsing the message
+const (
+	errorKindInternal         = "internal-error"
+	errorKindInvalidFormat    = "invalid-format"
+	errorKindInvalidKey       = "invalid-key"
+	errorKindInvalidValue     = "invalid-value"
+	errorKindConflict         = "conflict"
+	errorKindApStartFailed    = "ap-start-failed"
+	errorKindNotFound         = "not-found"
+	errorKindMethodNotAllowed = "method-not-allowed"
+	errorKindUnauthorized     = "unauthorized"
+	errorKindLockedKey        = "locked-key"
+)
+
+// fieldError describes what is wrong with a single item of a request.
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// makeErrorResponse creates an error response of the given kind. Any
+// given field errors are reported as details keyed by the field.
+func makeErrorResponse(code int, message, kind string, fields ...fieldError) *serviceResponse {
+	result := map[string]interface{}{
+		"message": message,
+		"kind":    kind,
+	}
+
+	if len(fields) > 0 {
+		details := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			details[field.Field] = field.Message
+		}
+		result["details"] = details
+	}
+
 	return &serviceResponse{
 		Type:       "error",
 		Status:     http.StatusText(code),
 		StatusCode: code,
-		Result: map[string]interface{}{
-			"message": message,
-			"kind":    kind,
-		},
+		Result:     result,
 	}
 }
 
@@ -66,6 +99,19 @@ func makeResponse(status int, result map[string]interface{}) *serviceResponse {
 	return resp
 }
 
+// makeAsyncResponse tells the client that the request is processed in
+// the background by the given change.
+func makeAsyncResponse(c *change) *serviceResponse {
+	return &serviceResponse{
+		Type:       "async",
+		Status:     http.StatusText(http.StatusAccepted),
+		StatusCode: http.StatusAccepted,
+		Result: map[string]interface{}{
+			"change": c.id,
+		},
+	}
+}
+
 func sendHTTPResponse(writer http.ResponseWriter, response *serviceResponse) {
 	writer.WriteHeader(response.StatusCode)
 	data, _ := json.Marshal(response)
@@ -31,6 +31,20 @@ func (s *S) TestMakeErrorResponse(c *check.C) {
 	c.Assert(resp.Type, check.Equals, "error")
 }
 
+func (s *S) TestMakeErrorResponseWithDetails(c *check.C) {
+	resp := makeErrorResponse(http.StatusBadRequest, "Invalid configuration", errorKindInvalidValue,
+		fieldError{"wifi.channel", "must be a number"}, fieldError{"disabled", "must be true or false"})
+	c.Assert(resp.Result, check.DeepEquals, map[string]interface{}{
+		"message": "Invalid configuration",
+		"kind":    "invalid-value",
+		"details": map[string]interface{}{
+			"wifi.channel": "must be a number",
+			"disabled":     "must be true or false",
+		},
+	})
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
 func (s *S) TestMakeResponse(c *check.C) {
 	resp := makeResponse(http.StatusOK, nil)
 	c.Assert(resp.Result, check.DeepEquals, map[string]interface{}{})
@@ -0,0 +1,198 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Security of scanned networks
+const (
+	securityOpen = "open"
+	securityWEP  = "wep"
+	securityWPA  = "wpa"
+	securityWPA2 = "wpa2"
+	securityWPA3 = "wpa3"
+)
+
+// scannedNetwork is a neighbouring network found by iw scan.
+type scannedNetwork struct {
+	BSSID   string `json:"bssid"`
+	SSID    string `json:"ssid"`
+	Channel int    `json:"channel"`
+	// Channel width in MHz
+	Width int `json:"width"`
+	// Signal strength in dBm
+	Signal   float64 `json:"signal"`
+	Security string  `json:"security"`
+}
+
+// parseScan parses the output of iw dev <interface> scan.
+func parseScan(output []byte) []scannedNetwork {
+	var networks []scannedNetwork
+	var current *scannedNetwork
+	// Section of the current network the indented lines belong to
+	section := ""
+	privacy := false
+
+	finish := func() {
+		if current != nil && current.Security == securityOpen && privacy {
+			current.Security = securityWEP
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "BSS ") {
+			finish()
+			bssid := strings.TrimPrefix(line, "BSS ")
+			if i := strings.IndexAny(bssid, "( "); i > 0 {
+				bssid = bssid[:i]
+			}
+			networks = append(networks, scannedNetwork{BSSID: bssid, Width: 20, Signal: -100, Security: securityOpen})
+			current = &networks[len(networks)-1]
+			section = ""
+			privacy = false
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		// Sections start on the first level of indentation, their
+		// items are indented further
+		text := strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "\t\t") {
+			section = text
+			if i := strings.IndexRune(section, ':'); i >= 0 {
+				section = section[:i]
+			}
+		}
+		// Items may also follow on the line of the section
+		if i := strings.Index(text, "* "); i >= 0 {
+			text = text[i+2:]
+		}
+
+		fields := strings.Fields(text)
+		switch {
+		case section == "freq" && len(fields) >= 2:
+			if freq, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				current.Channel = channelFromFrequency(int(freq))
+			}
+		case section == "signal" && len(fields) >= 2:
+			if signal, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				current.Signal = signal
+			}
+		case section == "SSID":
+			current.SSID = strings.TrimPrefix(strings.TrimPrefix(text, "SSID:"), " ")
+		case section == "capability":
+			privacy = strings.Contains(text, "Privacy")
+		case section == "WPA":
+			if current.Security == securityOpen {
+				current.Security = securityWPA
+			}
+		case section == "RSN" && strings.HasPrefix(text, "Authentication suites:"):
+			if strings.Contains(text, "SAE") {
+				current.Security = securityWPA3
+			} else {
+				current.Security = securityWPA2
+			}
+		case section == "HT operation" && strings.HasPrefix(text, "secondary channel offset:"):
+			if !strings.HasSuffix(text, "no secondary") && current.Width < 40 {
+				current.Width = 40
+			}
+		case section == "VHT operation" && strings.HasPrefix(text, "channel width:"):
+			// Like "channel width: 1 (80 MHz)"
+			if i := strings.IndexRune(text, '('); i >= 0 {
+				if width := strings.Fields(text[i+1:]); len(width) > 0 {
+					if width, err := strconv.Atoi(width[0]); err == nil && width > current.Width {
+						current.Width = width
+					}
+				}
+			}
+		}
+	}
+	finish()
+
+	// Networks on frequencies we don't know about can't interfere
+	result := []scannedNetwork{}
+	for _, network := range networks {
+		if network.Channel > 0 {
+			result = append(result, network)
+		}
+	}
+	return result
+}
+
+// Scan results younger than this are returned without scanning again
+var maxScanAge = 30 * time.Second
+
+// scanCache keeps the result of the last scan for neighbouring networks
+// as scanning takes a few seconds and interrupts the access point.
+type scanCache struct {
+	mutex    sync.Mutex
+	time     time.Time
+	iface    string
+	networks []scannedNetwork
+}
+
+// errAccessPointBusy is returned when a scan would interrupt the
+// running access point and wasn't forced.
+var errAccessPointBusy = fmt.Errorf("The access point is running on the interface, the scan has to be forced")
+
+// scan returns the networks found on the given interface, strongest
+// first. A cached result is returned if it is recent enough and no
+// refresh is asked for. Scanning while the access point is running on
+// the interface has to be forced.
+func (cache *scanCache) scan(iface string, apRunning, force, refresh bool) (time.Time, []scannedNetwork, error) {
+	// Concurrent requests wait for the same scan
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if !refresh && cache.iface == iface && time.Since(cache.time) < maxScanAge {
+		return cache.time, cache.networks, nil
+	}
+
+	args := []string{"dev", iface, "scan"}
+	if apRunning {
+		if !force {
+			return time.Time{}, nil, errAccessPointBusy
+		}
+		args = append(args, "ap-force")
+	}
+	output, err := runIw(args...)
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("Failed to scan for networks: %s", err)
+	}
+
+	networks := parseScan(output)
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].Signal > networks[j].Signal
+	})
+
+	cache.time = time.Now()
+	cache.iface = iface
+	cache.networks = networks
+	return cache.time, networks, nil
+}
@@ -0,0 +1,127 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseScan(c *check.C) {
+	c.Assert(parseScan([]byte(iwScanOutput)), check.DeepEquals, []scannedNetwork{
+		{BSSID: "00:11:22:33:44:55", SSID: "Neighbour", Channel: 1, Width: 40, Signal: -40, Security: securityWPA2},
+		{BSSID: "00:11:22:33:44:66", SSID: "Far away", Channel: 6, Width: 20, Signal: -85, Security: securityWEP},
+		{BSSID: "00:11:22:33:44:77", SSID: "Fast", Channel: 36, Width: 80, Signal: -60, Security: securityWPA3},
+	})
+
+	// An empty list is reported as such and not as null
+	c.Assert(parseScan(nil), check.NotNil)
+	c.Assert(parseScan(nil), check.HasLen, 0)
+
+	// Truncated output doesn't bring the service down
+	c.Assert(parseScan([]byte("BSS 00:11:22:33:44:55(on wlan0)\n\tfreq: 5180\n\tVHT operation:\n\t\t * channel width: 1 (")), check.DeepEquals, []scannedNetwork{
+		{BSSID: "00:11:22:33:44:55", Channel: 36, Width: 20, Signal: -100, Security: securityOpen},
+	})
+}
+
+func (s *S) TestGetScan(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	oldConfigPaths := configurationPaths
+	configurationPaths = []string{"../../conf/default-config", getConfigOnPath(dir)}
+	defer func() { configurationPaths = oldConfigPaths }()
+
+	var calls []string
+	oldRunIw := runIw
+	defer func() { runIw = oldRunIw }()
+	runIw = func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		return []byte(iwScanOutput), nil
+	}
+
+	cmd := newMockServiceCommand()
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		getScan(cmd, rec, req)
+		return rec
+	}
+
+	rec := get("/v1/scan")
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["interface"], check.Equals, "wlan0")
+
+	// Strongest networks come first
+	networks := resp.Result["networks"].([]interface{})
+	c.Assert(networks, check.HasLen, 3)
+	c.Assert(networks[0], check.DeepEquals, map[string]interface{}{
+		"bssid":    "00:11:22:33:44:55",
+		"ssid":     "Neighbour",
+		"channel":  1.0,
+		"width":    40.0,
+		"signal":   -40.0,
+		"security": "wpa2",
+	})
+	c.Assert(networks[1].(map[string]interface{})["ssid"], check.Equals, "Fast")
+
+	// Recent results are cached unless a refresh is asked for
+	get("/v1/scan")
+	c.Assert(calls, check.DeepEquals, []string{"dev wlan0 scan"})
+
+	// Scanning with a running access point has to be forced
+	cmd.s.status.launched(42, false, "Ubuntu", "6", "wlan0")
+	rec = get("/v1/scan?refresh=true")
+	c.Assert(rec.Code, check.Equals, http.StatusConflict)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, errorKindConflict)
+	c.Assert(calls, check.DeepEquals, []string{"dev wlan0 scan"})
+
+	rec = get("/v1/scan?refresh=true&force=true")
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(calls, check.DeepEquals, []string{"dev wlan0 scan", "dev wlan0 scan ap-force"})
+
+	// but only by administrators
+	req, err := http.NewRequest(http.MethodGet, "/v1/scan?refresh=true&force=true", nil)
+	c.Assert(err, check.IsNil)
+	req = req.WithContext(context.WithValue(req.Context(), accessContextKey, accessRead))
+	rec = httptest.NewRecorder()
+	getScan(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusForbidden)
+	c.Assert(calls, check.HasLen, 2)
+
+	rec = get("/v1/scan?refresh=maybe")
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	rec = get("/v1/scan?force=maybe")
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+
+	runIw = func(args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("iw dev wlan0 scan failed: Operation not supported")
+	}
+	rec = get("/v1/scan?refresh=1&force=1")
+	c.Assert(rec.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["message"], check.Equals, "Failed to scan for networks: iw dev wlan0 scan failed: Operation not supported")
+}
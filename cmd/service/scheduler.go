@@ -0,0 +1,326 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval in which the scheduler checks if the access point has to be
+// enabled or disabled. Changes of the schedule are picked up with it.
+var schedulerInterval = time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow is a weekly time window in which the access point
+// is enabled. Windows ending before they start span midnight.
+type scheduleWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+func parseTimeOfDay(text string) (int, error) {
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		if text == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("Invalid time %q", text)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(text string) ([7]bool, error) {
+	var days [7]bool
+	for _, item := range strings.Split(text, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("Invalid day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return days, fmt.Errorf("Invalid day %q", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseSchedule parses a list of windows separated by semicolons like
+// "mon-fri 07:00-18:00; sat,sun 09:00-12:00". Days can be omitted for
+// windows which apply to every day.
+func parseSchedule(text string) ([]scheduleWindow, error) {
+	windows := []scheduleWindow{}
+	for _, item := range strings.Split(text, ";") {
+		fields := strings.Fields(strings.ToLower(item))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Invalid schedule window %q", strings.TrimSpace(item))
+		}
+
+		window := scheduleWindow{}
+		for day := range window.days {
+			window.days[day] = true
+		}
+		if len(fields) == 2 {
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.days = days
+		}
+
+		times := strings.SplitN(fields[len(fields)-1], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Invalid time range %q", fields[len(fields)-1])
+		}
+		var err error
+		if window.start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if window.end, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		if window.start == window.end {
+			return nil, fmt.Errorf("Empty time range %q", fields[len(fields)-1])
+		}
+
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// scheduleEnabledAt returns whether the access point is enabled by the
+// schedule at the given time.
+func scheduleEnabledAt(windows []scheduleWindow, t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+		} else if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextScheduleTransition returns the next time after t at which the
+// schedule enables or disables the access point.
+func nextScheduleTransition(windows []scheduleWindow, t time.Time) (time.Time, bool) {
+	current := scheduleEnabledAt(windows, t)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	var next time.Time
+	for offset := -1; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			end := w.end
+			if w.end < w.start {
+				end += 24 * 60
+			}
+			for _, minute := range []int{w.start, end} {
+				candidate := day.Add(time.Duration(minute) * time.Minute)
+				if !candidate.After(t) || (!next.IsZero() && !candidate.Before(next)) {
+					continue
+				}
+				if scheduleEnabledAt(windows, candidate) != current {
+					next = candidate
+				}
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// scheduleItems names the configuration item holding a schedule and
+// the one it enables and disables the access point or a part of it with.
+type scheduleItems struct {
+	schedule string
+	disabled string
+	name     string
+}
+
+var (
+	apScheduleItems     = scheduleItems{"schedule", "disabled", "the access point"}
+	radio2ScheduleItems = scheduleItems{"radio2.schedule", "radio2.disabled", "the second radio"}
+)
+
+// scheduleState is what the scheduler reports in the status.
+type scheduleState struct {
+	mutex          sync.Mutex
+	nextTransition time.Time
+	nextEnabled    bool
+	lastError      string
+}
+
+// toMap returns the status items of the schedule prefixed with the
+// key of its configuration item.
+func (s *scheduleState) toMap(prefix string) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := make(map[string]interface{})
+	if !s.nextTransition.IsZero() {
+		status[prefix+".next-transition"] = s.nextTransition.Format(time.RFC3339)
+		status[prefix+".next-action"] = "disable"
+		if s.nextEnabled {
+			status[prefix+".next-action"] = "enable"
+		}
+	}
+	if len(s.lastError) > 0 {
+		status[prefix+".last-error"] = s.lastError
+	}
+	return status
+}
+
+func (s *scheduleState) update(next time.Time, enabled bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextTransition = next
+	s.nextEnabled = enabled
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+// applyScheduledItem sets a configuration item on behalf of the
+// schedule. Locked items are left alone like for every other change.
+// Unlike changes made by a user it is not recorded in the history and
+// doesn't reset the active profile, but the snap configuration follows
+// so that the next snap set doesn't bring back the previous value.
+func (s *service) applyScheduledItem(key string, value interface{}) error {
+	if !s.configMutex.TryLock() {
+		return errConfigurationBusy
+	}
+	defer s.configMutex.Unlock()
+
+	previous := make(map[string]interface{})
+	if readConfiguration([]string{getConfigOnPath(os.Getenv("SNAP_DATA"))}, previous) != nil {
+		return fmt.Errorf("Failed to read existing configuration file")
+	}
+	config := make(map[string]interface{}, len(previous)+1)
+	for k, v := range previous {
+		config[k] = v
+	}
+	config[key] = value
+
+	if resp := checkLockedKeys(previous, config); resp != nil {
+		return fmt.Errorf("%s", resp.Result["message"])
+	}
+	if resp := validateConfiguration(map[string]interface{}{key: value}, true); resp != nil {
+		return fmt.Errorf("%s", resp.Result["message"])
+	}
+
+	if _, err := s.writeConfigurationLocked(config, nil); err != nil {
+		return err
+	}
+
+	if err := mirrorSnapConfiguration(previous, config); err != nil {
+		log.Printf("Failed to update snap configuration: %s", err)
+	}
+	return nil
+}
+
+// applySchedule enables or disables the access point or the part of it
+// given by the items according to the configured schedule. Returns the
+// state the schedule requested or nil if there is none.
+func (s *service) applySchedule(items scheduleItems, state *scheduleState, now time.Time, lastRequested *bool) *bool {
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		state.update(time.Time{}, false, err)
+		return nil
+	}
+
+	text, _ := config[items.schedule].(string)
+	windows, err := parseSchedule(text)
+	if err != nil || len(windows) == 0 {
+		state.update(time.Time{}, false, err)
+		return nil
+	}
+
+	enabled := scheduleEnabledAt(windows, now)
+	next, _ := nextScheduleTransition(windows, now)
+	state.update(next, !enabled, nil)
+
+	// Only act when the schedule changes its mind so that a manual
+	// change or a failed attempt is left alone until the next window.
+	if lastRequested != nil && *lastRequested == enabled {
+		return lastRequested
+	}
+	if (config[items.disabled] == true) == !enabled {
+		return &enabled
+	}
+
+	log.Printf("Schedule %s %s", map[bool]string{true: "enables", false: "disables"}[enabled], items.name)
+	if err := s.applyScheduledItem(items.disabled, !enabled); err == errConfigurationBusy {
+		// Try again with the next check
+		return lastRequested
+	} else if err != nil {
+		log.Printf("Failed to apply schedule: %s", err)
+		state.update(next, !enabled, err)
+	}
+	return &enabled
+}
+
+// runScheduler periodically applies the schedules until the service
+// is shut down. As the schedules are stored in the configuration they
+// are applied again right away when the service starts.
+func (s *service) runScheduler() error {
+	var apRequested, radio2Requested *bool
+	for {
+		now := time.Now()
+		apRequested = s.applySchedule(apScheduleItems, &s.schedule, now, apRequested)
+		radio2Requested = s.applySchedule(radio2ScheduleItems, &s.radio2Schedule, now, radio2Requested)
+
+		select {
+		case <-s.tomb.Dying():
+			return nil
+		case <-time.After(schedulerInterval):
+		}
+	}
+}
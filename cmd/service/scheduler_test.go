@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// 2017-05-01 is a Monday
+func scheduleTime(day, hour, minute int) time.Time {
+	return time.Date(2017, 5, day, hour, minute, 0, 0, time.Local)
+}
+
+func (s *S) TestParseSchedule(c *check.C) {
+	windows, err := parseSchedule("mon-fri 07:00-18:00; sat,sun 22:00-02:30;")
+	c.Assert(err, check.IsNil)
+	c.Assert(windows, check.HasLen, 2)
+	c.Assert(windows[0].days, check.Equals, [7]bool{false, true, true, true, true, true, false})
+	c.Assert(windows[0].start, check.Equals, 7*60)
+	c.Assert(windows[0].end, check.Equals, 18*60)
+	c.Assert(windows[1].days, check.Equals, [7]bool{true, false, false, false, false, false, true})
+
+	windows, err = parseSchedule("fri-mon 00:00-24:00")
+	c.Assert(err, check.IsNil)
+	c.Assert(windows[0].days, check.Equals, [7]bool{true, true, false, false, false, true, true})
+	c.Assert(windows[0].end, check.Equals, 24*60)
+
+	windows, err = parseSchedule("")
+	c.Assert(err, check.IsNil)
+	c.Assert(windows, check.HasLen, 0)
+
+	for _, text := range []string{"foo 07:00-08:00", "mon 7-8", "mon 07:00", "mon 07:00-07:00", "mon tue 07:00-08:00", "mon 25:00-26:00"} {
+		_, err = parseSchedule(text)
+		c.Assert(err, check.NotNil, check.Commentf("schedule %q", text))
+	}
+}
+
+func (s *S) TestScheduleEnabledAt(c *check.C) {
+	windows, err := parseSchedule("mon-fri 07:00-18:00; sat 22:00-02:00")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(1, 6, 59)), check.Equals, false)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(1, 7, 0)), check.Equals, true)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(5, 17, 59)), check.Equals, true)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(5, 18, 0)), check.Equals, false)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(6, 12, 0)), check.Equals, false)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(6, 23, 0)), check.Equals, true)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(7, 1, 59)), check.Equals, true)
+	c.Assert(scheduleEnabledAt(windows, scheduleTime(7, 2, 0)), check.Equals, false)
+}
+
+func (s *S) TestNextScheduleTransition(c *check.C) {
+	windows, err := parseSchedule("mon-fri 07:00-18:00; sat 22:00-02:00")
+	c.Assert(err, check.IsNil)
+
+	next, ok := nextScheduleTransition(windows, scheduleTime(1, 12, 0))
+	c.Assert(ok, check.Equals, true)
+	c.Assert(next, check.Equals, scheduleTime(1, 18, 0))
+
+	next, _ = nextScheduleTransition(windows, scheduleTime(5, 18, 0))
+	c.Assert(next, check.Equals, scheduleTime(6, 22, 0))
+
+	next, _ = nextScheduleTransition(windows, scheduleTime(6, 23, 0))
+	c.Assert(next, check.Equals, scheduleTime(7, 2, 0))
+
+	next, _ = nextScheduleTransition(windows, scheduleTime(7, 3, 0))
+	c.Assert(next, check.Equals, scheduleTime(8, 7, 0))
+
+	// Windows covering the whole week never change anything
+	windows, err = parseSchedule("00:00-24:00")
+	c.Assert(err, check.IsNil)
+	_, ok = nextScheduleTransition(windows, scheduleTime(1, 12, 0))
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestApplySchedule(c *check.C) {
+	dir := s.setUpConfiguration(c, "DISABLED=true\nSCHEDULE=\"mon-fri 07:00-18:00\"\n")
+	configPath := getConfigOnPath(dir)
+
+	snapctlCalls, restore := mockSnapctl("{}")
+	defer restore()
+	c.Assert(setActiveProfile("home"), check.IsNil)
+
+	svc := newMockService()
+
+	requested := svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 8, 0), nil)
+	c.Assert(*requested, check.Equals, true)
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{configPath}, config), check.IsNil)
+	c.Assert(config["disabled"], check.Equals, false)
+	c.Assert(svc.ap.Running(), check.Equals, true)
+
+	status := svc.schedule.toMap("schedule")
+	c.Assert(status["schedule.next-action"], check.Equals, "disable")
+	c.Assert(status["schedule.next-transition"], check.Equals, scheduleTime(1, 18, 0).Format(time.RFC3339))
+
+	// A manual change within the window is left alone
+	c.Assert(ioutil.WriteFile(configPath, []byte("DISABLED=true\nSCHEDULE=\"mon-fri 07:00-18:00\"\n"), 0644), check.IsNil)
+	requested = svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 9, 0), requested)
+	config = make(map[string]interface{})
+	c.Assert(readConfiguration([]string{configPath}, config), check.IsNil)
+	c.Assert(config["disabled"], check.Equals, true)
+
+	// but the schedule applies again at the end of it
+	c.Assert(ioutil.WriteFile(configPath, []byte("DISABLED=false\nSCHEDULE=\"mon-fri 07:00-18:00\"\n"), 0644), check.IsNil)
+	requested = svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 18, 0), requested)
+	c.Assert(*requested, check.Equals, false)
+	config = make(map[string]interface{})
+	c.Assert(readConfiguration([]string{configPath}, config), check.IsNil)
+	c.Assert(config["disabled"], check.Equals, true)
+
+	// Changes made by the schedule are neither recorded in the history
+	// nor do they reset the active profile. The snap configuration
+	// follows to not bring back the previous state with the next snap set.
+	entries, err := listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 0)
+	c.Assert(activeProfile(), check.Equals, "home")
+	c.Assert(*snapctlCalls, check.DeepEquals, []string{"get -d", "set disabled=false", "get -d", "set disabled=true"})
+
+	// Without a schedule nothing is reported
+	c.Assert(ioutil.WriteFile(configPath, []byte("DISABLED=true\n"), 0644), check.IsNil)
+	c.Assert(svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 8, 0), nil), check.IsNil)
+	c.Assert(svc.schedule.toMap("schedule"), check.HasLen, 0)
+}
+
+func (s *S) TestApplyScheduleLockedItem(c *check.C) {
+	dir := s.setUpConfiguration(c, "DISABLED=true\nSCHEDULE=\"mon-fri 07:00-18:00\"\n")
+
+	_, restore := mockSnapctl(`{"locked-keys": "disabled"}`)
+	defer restore()
+
+	svc := newMockService()
+
+	// The schedule doesn't get around items locked by the device
+	requested := svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 8, 0), nil)
+	c.Assert(*requested, check.Equals, true)
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{getConfigOnPath(dir)}, config), check.IsNil)
+	c.Assert(config["disabled"], check.Equals, true)
+	c.Assert(svc.ap.Running(), check.Equals, false)
+	c.Assert(svc.schedule.toMap("schedule")["schedule.last-error"], check.Equals, `Configuration item "disabled" is locked`)
+}
+
+func (s *S) TestApplyRadio2Schedule(c *check.C) {
+	dir := s.setUpConfiguration(c, "DISABLED=false\nRADIO2_DISABLED=false\nRADIO2_SCHEDULE=\"mon-fri 07:00-18:00\"\n")
+
+	_, restore := mockSnapctl("{}")
+	defer restore()
+
+	svc := newMockService()
+
+	// Outside of its window only the second radio is disabled
+	requested := svc.applySchedule(radio2ScheduleItems, &svc.radio2Schedule, scheduleTime(1, 20, 0), nil)
+	c.Assert(*requested, check.Equals, false)
+	config := make(map[string]interface{})
+	c.Assert(readConfiguration([]string{getConfigOnPath(dir)}, config), check.IsNil)
+	c.Assert(config["radio2.disabled"], check.Equals, true)
+	c.Assert(config["disabled"], check.Equals, false)
+
+	status := svc.radio2Schedule.toMap("radio2.schedule")
+	c.Assert(status["radio2.schedule.next-action"], check.Equals, "enable")
+	c.Assert(status["radio2.schedule.next-transition"], check.Equals, scheduleTime(2, 7, 0).Format(time.RFC3339))
+
+	// The access point itself has no schedule
+	c.Assert(svc.applySchedule(apScheduleItems, &svc.schedule, scheduleTime(1, 20, 0), nil), check.IsNil)
+}
+
+func (s *S) TestScheduleValidation(c *check.C) {
+	c.Assert(validateConfigurationValue("schedule", "mon-fri 07:00-18:00"), check.IsNil)
+	c.Assert(validateConfigurationValue("schedule", "someday 07:00-18:00"), check.NotNil)
+	c.Assert(validateConfigurationValue("radio2.schedule", "sat 09:00-12:00"), check.IsNil)
+	c.Assert(validateConfigurationValue("radio2.schedule", "09:00"), check.NotNil)
+}
@@ -0,0 +1,302 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of configuration items
+const (
+	schemaBoolean = "boolean"
+	schemaInteger = "integer"
+	schemaString  = "string"
+)
+
+// Formats of string items
+const (
+	formatIPv4    = "ipv4"
+	formatNetmask = "netmask"
+)
+
+// schemaItem describes a configuration item. Its default value comes
+// from the default configuration file the ap.sh script sources.
+type schemaItem struct {
+	Key         string
+	Type        string
+	Values      []string
+	Description string
+	// Whether the access point is restarted when the item changes
+	RequiresRestart bool
+	// Further restrictions of string values, nil if there are none
+	Limits *schemaLimits
+}
+
+// schemaLimits restricts the length and the format of string values.
+type schemaLimits struct {
+	// Length of the value in bytes, 0 for no limit
+	MinLength, MaxLength int
+	// Whether an empty value is accepted regardless of MinLength
+	AllowEmpty bool
+	// Format of the value like formatIPv4, empty for any
+	Format string
+}
+
+// schema describes every configuration item the service accepts.
+var schema = []schemaItem{
+	{"disabled", schemaBoolean, nil,
+		"Whether the access point is disabled.", true, nil},
+	{"debug", schemaBoolean, nil,
+		"Enable verbose debugging output of the access point.", true, nil},
+	{"wifi.interface", schemaString, nil,
+		"Network interface the access point operates on.", true, nil},
+	{"wifi.address", schemaString, nil,
+		"IP address of the access point interface.", true, &schemaLimits{Format: formatIPv4}},
+	{"wifi.netmask", schemaString, nil,
+		"Netmask of the access point network.", true, &schemaLimits{Format: formatNetmask}},
+	{"wifi.interface-mode", schemaString, []string{"virtual", "direct"},
+		"Whether a virtual interface is created on top of wifi.interface or the interface is used directly.", true, nil},
+	{"wifi.hostapd-driver", schemaString, []string{"nl80211"},
+		"Driver hostapd uses to talk to the wireless hardware.", true, nil},
+	{"wifi.ssid", schemaString, nil,
+		"Name of the wireless network, 1 to 32 characters.", true, &schemaLimits{MinLength: 1, MaxLength: 32}},
+	{"wifi.security", schemaString, []string{"open", "wpa2"},
+		"Security of the wireless network.", true, nil},
+	{"wifi.security-passphrase", schemaString, nil,
+		"WPA2 passphrase clients need to connect, 8 to 63 characters or empty for none.", true, &schemaLimits{MinLength: 8, MaxLength: 63, AllowEmpty: true}},
+	{"wifi.channel", schemaString, nil,
+		"Channel the access point operates on or auto to select the least busy one on every start.", true, nil},
+	{"wifi.operation-mode", schemaString, []string{"a", "b", "g", "ad"},
+		"IEEE 802.11 mode: a (5 GHz), b or g (2.4 GHz) or ad (60 GHz).", true, nil},
+	{"wifi.country-code", schemaString, nil,
+		"ISO 3166-1 country code the access point operates in.", true, nil},
+	{"wifi.ieee80211n", schemaBoolean, nil,
+		"Whether 802.11n (HT) is enabled.", true, nil},
+	{"wifi.ieee80211ac", schemaBoolean, nil,
+		"Whether 802.11ac (VHT) is enabled, requires operation mode a.", true, nil},
+	{"wifi.channel-width", schemaInteger, []string{"20", "40", "80", "160"},
+		"Width of the channel in MHz. 40 MHz requires 802.11n, 80 and 160 MHz require 802.11ac on 5 GHz.", true, nil},
+	{"wifi.secondary-channel", schemaString, []string{"auto", "above", "below"},
+		"Whether the secondary channel of 40 MHz wide channels lies above or below wifi.channel.", true, nil},
+	{"wifi.center-channel", schemaString, nil,
+		"Center channel of 80 and 160 MHz wide channels or auto to derive it from wifi.channel.", true, nil},
+	{"wifi.ht-capabilities", schemaString, nil,
+		"Additional HT capabilities in the hostapd ht_capab format like [SHORT-GI-20][SHORT-GI-40].", true, nil},
+	{"wifi.vht-capabilities", schemaString, nil,
+		"VHT capabilities in the hostapd vht_capab format like [SHORT-GI-80][RXLDPC].", true, nil},
+	{"wifi.dfs-fallback", schemaBoolean, nil,
+		"Whether the access point moves to a channel without DFS for 30 minutes after radar was detected.", false, nil},
+	{"radio2.disabled", schemaBoolean, nil,
+		"Whether the access point on a second radio sharing SSID and network with the first one is disabled.", true, nil},
+	{"radio2.interface", schemaString, nil,
+		"Network interface of the second radio.", true, nil},
+	{"radio2.channel", schemaString, nil,
+		"Channel the second radio operates on or auto to select the least busy one on every start.", true, nil},
+	{"radio2.operation-mode", schemaString, []string{"a", "b", "g", "ad"},
+		"IEEE 802.11 mode of the second radio: a (5 GHz), b or g (2.4 GHz) or ad (60 GHz).", true, nil},
+	{"radio2.channel-width", schemaInteger, []string{"20", "40", "80", "160"},
+		"Width of the channel of the second radio in MHz.", true, nil},
+	{"radio2.ieee80211ac", schemaBoolean, nil,
+		"Whether 802.11ac (VHT) is enabled on the second radio, requires operation mode a.", true, nil},
+	{"radio2.schedule", schemaString, nil,
+		"Weekly windows in which the second radio is enabled, in the format of schedule.", false, nil},
+	{"share.disabled", schemaBoolean, nil,
+		"Whether sharing the connection of share.network-interface is disabled.", true, nil},
+	{"share.network-interface", schemaString, nil,
+		"Network interface whose connection is shared with clients, none to not share any.", true, nil},
+	{"dhcp.range-start", schemaString, nil,
+		"First address handed out to clients, within the network of wifi.address.", true, &schemaLimits{Format: formatIPv4}},
+	{"dhcp.range-stop", schemaString, nil,
+		"Last address handed out to clients, within the network of wifi.address.", true, &schemaLimits{Format: formatIPv4}},
+	{"dhcp.lease-time", schemaString, nil,
+		"Lease time of addresses handed out to clients, like 12h.", true, nil},
+	{"apply.timeout", schemaInteger, nil,
+		"Seconds to wait for the access point to become healthy after a change before it is rolled back, 0 to disable the rollback.", false, nil},
+	{"schedule", schemaString, nil,
+		"Weekly windows in which the access point is enabled, like \"mon-fri 07:00-18:00; sat 09:00-12:00\".", false, nil},
+	{"remote.address", schemaString, nil,
+		"Address like :8443 to accept remote management requests on. Applies when the service is restarted.", false, nil},
+	{"access.read-group", schemaString, nil,
+		"Group whose members may view the status and the configuration without secrets.", false, nil},
+	{"access.admin-group", schemaString, nil,
+		"Group whose members may change the configuration.", false, nil},
+}
+
+// findSchemaItem returns the description of the given configuration
+// item or nil if there is none.
+func findSchemaItem(key string) *schemaItem {
+	for n := range schema {
+		if schema[n].Key == key {
+			return &schema[n]
+		}
+	}
+	return nil
+}
+
+// validate checks that the text of a value fits the type of the item
+// and is one of its allowed values.
+func (item *schemaItem) validate(text string) error {
+	switch item.Type {
+	case schemaBoolean:
+		if text != "true" && text != "false" {
+			return fmt.Errorf("Invalid value %q for %q: must be true or false", text, item.Key)
+		}
+	case schemaInteger:
+		if _, err := strconv.Atoi(text); err != nil {
+			return fmt.Errorf("Invalid value %q for %q: must be a number", text, item.Key)
+		}
+	}
+
+	if len(item.Values) > 0 {
+		for _, allowed := range item.Values {
+			if text == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("Invalid value %q for %q: must be one of %v", text, item.Key, item.Values)
+	}
+
+	if item.Limits != nil {
+		return item.Limits.validate(item.Key, text)
+	}
+	return nil
+}
+
+func (limits *schemaLimits) validate(key, text string) error {
+	if len(text) == 0 && limits.AllowEmpty {
+		return nil
+	}
+	if len(text) < limits.MinLength || (limits.MaxLength > 0 && len(text) > limits.MaxLength) {
+		return fmt.Errorf("Invalid value %q for %q: must be %d to %d characters long", text, key, limits.MinLength, limits.MaxLength)
+	}
+
+	switch limits.Format {
+	case formatIPv4:
+		if parseIPv4(text) == nil {
+			return fmt.Errorf("Invalid value %q for %q: must be an IPv4 address", text, key)
+		}
+	case formatNetmask:
+		if parseNetmask(text) == nil {
+			return fmt.Errorf("Invalid value %q for %q: must be an IPv4 netmask like 255.255.255.0", text, key)
+		}
+	}
+	return nil
+}
+
+// parseIPv4 returns the IPv4 address in the given text or nil if it
+// isn't one.
+func parseIPv4(text string) net.IP {
+	return net.ParseIP(text).To4()
+}
+
+// parseNetmask returns the IPv4 netmask in dotted notation in the given
+// text or nil if it isn't one.
+func parseNetmask(text string) net.IPMask {
+	ip := parseIPv4(text)
+	if ip == nil {
+		return nil
+	}
+	mask := net.IPMask(ip)
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil
+	}
+	return mask
+}
+
+// schemaTokens returns the keys of all items of the schema, which are
+// the configuration items the service accepts.
+func schemaTokens() map[string]bool {
+	tokens := make(map[string]bool, len(schema))
+	for _, item := range schema {
+		tokens[item.Key] = true
+	}
+	return tokens
+}
+
+// checkDefaultConfiguration verifies that the default configuration
+// file at the given path has a default value for every item of the
+// schema and nothing else.
+func checkDefaultConfiguration(path string) error {
+	tokens, err := loadValidTokens(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read default configuration: %s", err)
+	}
+
+	var missing, unknown []string
+	for _, item := range schema {
+		if !tokens[item.Key] {
+			missing = append(missing, item.Key)
+		}
+	}
+	for key := range tokens {
+		if findSchemaItem(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	switch {
+	case len(missing) > 0:
+		return fmt.Errorf("Default configuration lacks the items %s", strings.Join(missing, ", "))
+	case len(unknown) > 0:
+		return fmt.Errorf("Default configuration has items without schema: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// toMap returns the item in the format used by the REST API.
+func (item *schemaItem) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"key":              item.Key,
+		"type":             item.Type,
+		"default":          defaultValues[item.Key],
+		"description":      item.Description,
+		"requires-restart": item.RequiresRestart,
+	}
+	if len(item.Values) > 0 {
+		m["values"] = item.Values
+	}
+	if item.Limits != nil {
+		if item.Limits.MinLength > 0 {
+			m["min-length"] = item.Limits.MinLength
+		}
+		if item.Limits.MaxLength > 0 {
+			m["max-length"] = item.Limits.MaxLength
+		}
+		if item.Limits.AllowEmpty {
+			m["allow-empty"] = true
+		}
+		if len(item.Limits.Format) > 0 {
+			m["format"] = item.Limits.Format
+		}
+	}
+	return m
+}
+
+// requiresRestart returns whether the access point has to be restarted
+// for changes of the given configuration items.
+func requiresRestart(keys []string) bool {
+	for _, key := range keys {
+		if item := findSchemaItem(key); item == nil || item.RequiresRestart {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestSchemaMatchesDefaultConfiguration(c *check.C) {
+	c.Assert(checkDefaultConfiguration("../../conf/default-config"), check.IsNil)
+
+	tokens, err := loadValidTokens("../../conf/default-config")
+	c.Assert(err, check.IsNil)
+	c.Assert(schemaTokens(), check.DeepEquals, tokens)
+
+	for _, item := range schema {
+		c.Assert(item.Description, check.Not(check.Equals), "", check.Commentf("key %s", item.Key))
+	}
+}
+
+func (s *S) TestCheckDefaultConfiguration(c *check.C) {
+	data, err := ioutil.ReadFile("../../conf/default-config")
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(c.MkDir(), "default-config")
+
+	c.Assert(ioutil.WriteFile(path, append(data, "WIFI_UNKNOWN=1\n"...), 0644), check.IsNil)
+	c.Assert(checkDefaultConfiguration(path), check.ErrorMatches, "Default configuration has items without schema: wifi.unknown")
+
+	c.Assert(ioutil.WriteFile(path, []byte(strings.Replace(string(data), "\nDEBUG=", "\n#DEBUG=", 1)), 0644), check.IsNil)
+	c.Assert(checkDefaultConfiguration(path), check.ErrorMatches, "Default configuration lacks the items debug")
+
+	c.Assert(checkDefaultConfiguration(path+".missing"), check.ErrorMatches, "Failed to read default configuration: .*")
+}
+
+func (s *S) TestSchemaDefaultsAreValid(c *check.C) {
+	defaultValues = make(map[string]interface{})
+	c.Assert(readConfigurationFile("../../conf/default-config", defaultValues), check.IsNil)
+
+	for key, value := range defaultValues {
+		c.Assert(validateConfigurationValue(key, value), check.IsNil, check.Commentf("key %s", key))
+	}
+}
+
+func (s *S) TestSchemaValidatesAllowedValues(c *check.C) {
+	c.Assert(validateConfigurationValue("wifi.security", "wpa2"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.security", "wep"), check.ErrorMatches,
+		`Invalid value "wep" for "wifi.security": must be one of \[open wpa2\]`)
+	c.Assert(validateConfigurationValue("apply.timeout", float64(10)), check.IsNil)
+	c.Assert(validateConfigurationValue("apply.timeout", "soon"), check.ErrorMatches,
+		`Invalid value "soon" for "apply.timeout": must be a number`)
+}
+
+func (s *S) TestSchemaValidatesLimits(c *check.C) {
+	c.Assert(validateConfigurationValue("wifi.ssid", "Depot"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.ssid", ""), check.ErrorMatches,
+		`Invalid value "" for "wifi.ssid": must be 1 to 32 characters long`)
+	c.Assert(validateConfigurationValue("wifi.ssid", strings.Repeat("x", 33)), check.ErrorMatches,
+		`Invalid value "x+" for "wifi.ssid": must be 1 to 32 characters long`)
+
+	// The passphrase may be empty for open networks
+	c.Assert(validateConfigurationValue("wifi.security-passphrase", ""), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.security-passphrase", "secret"), check.ErrorMatches,
+		`Invalid value "secret" for "wifi.security-passphrase": must be 8 to 63 characters long`)
+	c.Assert(validateConfigurationValue("wifi.security-passphrase", strings.Repeat("x", 64)), check.ErrorMatches,
+		`Invalid value "x+" for "wifi.security-passphrase": must be 8 to 63 characters long`)
+
+	c.Assert(validateConfigurationValue("wifi.address", "192.168.7.1"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.address", "fd00::1"), check.ErrorMatches,
+		`Invalid value "fd00::1" for "wifi.address": must be an IPv4 address`)
+	c.Assert(validateConfigurationValue("dhcp.range-start", "10.0.60"), check.ErrorMatches,
+		`Invalid value "10.0.60" for "dhcp.range-start": must be an IPv4 address`)
+	c.Assert(validateConfigurationValue("wifi.netmask", "255.255.0.0"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.netmask", "255.0.255.0"), check.ErrorMatches,
+		`Invalid value "255.0.255.0" for "wifi.netmask": must be an IPv4 netmask like 255.255.255.0`)
+}
+
+func (s *S) TestGetSchema(c *check.C) {
+	defaultValues = make(map[string]interface{})
+	c.Assert(readConfigurationFile("../../conf/default-config", defaultValues), check.IsNil)
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/schema", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	getSchema(newMockServiceCommand(), rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	items, ok := resp.Result["items"].([]interface{})
+	c.Assert(ok, check.Equals, true)
+	c.Assert(items, check.HasLen, len(schema))
+
+	for _, entry := range items {
+		item := entry.(map[string]interface{})
+		if item["key"] != "wifi.security" {
+			continue
+		}
+		c.Assert(item, check.DeepEquals, map[string]interface{}{
+			"key":              "wifi.security",
+			"type":             "string",
+			"default":          "open",
+			"values":           []interface{}{"open", "wpa2"},
+			"description":      "Security of the wireless network.",
+			"requires-restart": true,
+			"locked":           false,
+		})
+		return
+	}
+	c.Fatal("wifi.security is not described")
+}
+
+func (s *S) TestSchemaItemLimits(c *check.C) {
+	item := findSchemaItem("wifi.security-passphrase").toMap()
+	c.Assert(item["min-length"], check.Equals, 8)
+	c.Assert(item["max-length"], check.Equals, 63)
+	c.Assert(item["allow-empty"], check.Equals, true)
+	_, ok := item["format"]
+	c.Assert(ok, check.Equals, false)
+
+	c.Assert(findSchemaItem("wifi.address").toMap()["format"], check.Equals, "ipv4")
+	_, ok = findSchemaItem("wifi.security").toMap()["min-length"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestChangeWithoutRestart(c *check.C) {
+	dir := s.setUpConfiguration(c, "WIFI_SSID=Depot\n")
+
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"access.read-group": "staff"}`))
+	c.Assert(err, check.IsNil)
+
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+	c.Assert(cmd.s.ap.Running(), check.Equals, false)
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "ACCESS_READ_GROUP='staff'\nWIFI_SSID='Depot'\n")
+}
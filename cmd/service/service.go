@@ -16,16 +16,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/snapcore/snapd/osutil"
 	"gopkg.in/tomb.v2"
 )
 
@@ -39,7 +45,9 @@ type serviceCommand struct {
 	PUT    responceFunc
 	POST   responceFunc
 	DELETE responceFunc
-	s      *service
+	// Whether GET is allowed for clients with read-only access
+	ReadAccess bool
+	s          *service
 }
 
 type service struct {
@@ -48,6 +56,27 @@ type service struct {
 	listener net.Listener
 	router   *mux.Router
 	ap       BackgroundProcess
+	status   apStatus
+	schedule scheduleState
+	changes  changeTracker
+	scans    scanCache
+	events   eventLog
+
+	// Goroutines following the hostapd of the access point
+	apMonitors monitorGroup
+
+	// Access point on the second radio of dual-band setups
+	radio2         BackgroundProcess
+	radio2Status   apStatus
+	radio2Schedule scheduleState
+	radio2Monitors monitorGroup
+
+	// Only set when remote management is enabled
+	remoteListener net.Listener
+
+	// Serializes changes of the configuration done by clients
+	// and the scheduler
+	configMutex sync.Mutex
 }
 
 func (c *serviceCommand) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -65,16 +94,30 @@ func (c *serviceCommand) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if rspf == nil {
-		rsp := makeErrorResponse(http.StatusInternalServerError, "Invalid method called", "internal-error")
+		rsp := makeErrorResponse(http.StatusMethodNotAllowed, "Invalid method called", errorKindMethodNotAllowed)
+		sendHTTPResponse(w, rsp)
+		return
+	}
+
+	required := accessAdmin
+	if r.Method == "GET" && c.ReadAccess {
+		required = accessRead
+	}
+	access := requestAccess(r)
+	if access < required {
+		rsp := makeErrorResponse(http.StatusForbidden, "Permission denied", errorKindUnauthorized)
 		sendHTTPResponse(w, rsp)
 		return
 	}
 
-	rspf(c, w, r)
+	rspf(c, w, r.WithContext(context.WithValue(r.Context(), accessContextKey, access)))
 }
 
 func (s *service) addRoutes() {
 	s.router = mux.NewRouter()
+	s.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendHTTPResponse(w, makeErrorResponse(http.StatusNotFound, "Invalid path "+r.URL.Path, errorKindNotFound))
+	})
 
 	for _, c := range api {
 		c.s = s
@@ -91,30 +134,371 @@ func (s *service) setupAccesPoint() error {
 	}
 
 	s.ap = ap
-	err = s.ap.Start()
+	s.ap.SetExitHandler(s.accessPointExited)
+
+	radio2, err := NewBackgroundProcess(filepath.Join(os.Getenv("SNAP"), "bin", "radio.sh"))
 	if err != nil {
 		return err
 	}
 
+	s.radio2 = radio2
+	s.radio2.SetExitHandler(s.radioExited)
+	return s.startAccessPoint()
+}
+
+// Time we give hostapd to come up before we consider the start of
+// the access point as failed.
+var accessPointStartTimeout = 30 * time.Second
+
+// accessPointUp checks if the access point process with the given pid
+// managed to launch hostapd. The ap.sh and radio.sh scripts write the
+// given pid file of hostapd right after they started it.
+var accessPointUp = func(pid int, pidFile string, startedAt time.Time) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(os.Getenv("SNAP_DATA"), pidFile))
+	return err == nil && !info.ModTime().Before(startedAt)
+}
+
+func (s *service) startAccessPoint() error {
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		err = fmt.Errorf("Failed to read configuration: %s", err)
+		s.status.transition(apStateFailed, err.Error())
+		return err
+	}
+
+	channel := fmt.Sprint(config["wifi.channel"])
+	selection := prepareChannel(config, fmt.Sprint(config["wifi.interface"]), autoChannelPath(), s.status.radarFallback())
+	if selection != nil {
+		channel = strconv.Itoa(selection.Channel)
+	}
+	s.status.channelSelected(selection)
+
+	startedAt := time.Now()
+	if err := s.ap.Start(); err != nil {
+		s.status.transition(apStateFailed, err.Error())
+		return err
+	}
+
+	iface := fmt.Sprint(config["wifi.interface"])
+	if config["wifi.interface-mode"] == "virtual" {
+		iface = "ap0"
+	}
+
+	// The ap.sh script decides on its own if the access point is
+	// disabled and just terminates then.
+	pid := s.ap.Pid()
+	disabled := config["disabled"] == true
+	s.status.launched(pid, disabled, fmt.Sprint(config["wifi.ssid"]), channel, iface)
+	if !disabled {
+		s.apMonitors.start(func(stop <-chan struct{}) {
+			s.waitForAccessPoint(&s.status, pid, "hostapd.pid", startedAt, stop)
+		})
+		s.apMonitors.start(func(stop <-chan struct{}) {
+			s.monitorHostapd(&s.status, pid, iface, stop)
+		})
+	}
+
+	return s.startRadio(config)
+}
+
+// monitorGroup keeps track of the goroutines following an access point
+// process so that they don't outlive it.
+type monitorGroup struct {
+	mutex sync.Mutex
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// start runs the given function in a goroutine of the group. The
+// function has to return once the given channel is closed.
+func (m *monitorGroup) start(f func(stop <-chan struct{})) {
+	m.mutex.Lock()
+	if m.done == nil {
+		m.done = make(chan struct{})
+	}
+	done := m.done
+	m.wg.Add(1)
+	m.mutex.Unlock()
+
+	go func() {
+		defer m.wg.Done()
+		f(done)
+	}()
+}
+
+// stop ends the goroutines of the group and waits for them.
+func (m *monitorGroup) stop() {
+	m.mutex.Lock()
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+	m.mutex.Unlock()
+	m.wg.Wait()
+}
+
+func (s *service) waitForAccessPoint(status *apStatus, pid int, pidFile string, startedAt time.Time, stop <-chan struct{}) {
+	for deadline := startedAt.Add(accessPointStartTimeout); time.Now().Before(deadline); {
+		if status.State() != apStateStarting {
+			return
+		}
+		if accessPointUp(pid, pidFile, startedAt) {
+			status.running(pid)
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second / 2):
+		}
+	}
+	if status.State() == apStateStarting {
+		status.failed(pid, "Timed out waiting for hostapd to start")
+	}
+}
+
+func (s *service) stopAccessPoint() error {
+	// The second radio joins the bridge of the access point
+	if err := s.stopRadio(); err != nil {
+		return err
+	}
+	s.apMonitors.stop()
+	if !s.ap.Running() {
+		return nil
+	}
+	if state := s.status.State(); state == apStateStarting || state == apStateRunning {
+		s.status.transition(apStateStopping, "")
+	}
+	return s.ap.Stop()
+}
+
+func (s *service) restartAccessPoint() error {
+	if err := s.stopAccessPoint(); err != nil {
+		return err
+	}
+	return s.startAccessPoint()
+}
+
+// Interval in which we check the health of the access point while
+// waiting for it to come up after a configuration change.
+var healthPollInterval = time.Second
+
+var checkAccessPointHealth = func(s *service) *healthReport {
+	return s.checkHealth()
+}
+
+// rollbackError is returned when a configuration change was reverted
+// because the access point did not come up with it.
+type rollbackError struct {
+	reason string
+}
+
+func (e *rollbackError) Error() string {
+	return fmt.Sprintf("Access point failed to come up with the new configuration (%s), previous configuration restored", e.reason)
+}
+
+// applyConfiguration writes the given configuration file and, if asked
+// to, restarts the access point with it. If the access point does not
+// become healthy within the configured timeout the previous file is put
+// back in place.
+func (s *service) applyConfiguration(path string, data []byte, restart bool, progress *change) error {
+	previous, err := ioutil.ReadFile(path)
+	hadPrevious := err == nil
+
+	progress.step("Write configuration")
+
+	// Always use an atomic write for the configuration file to ensure
+	// it's state is always persistent and kept in error cases.
+	if err := osutil.AtomicWriteFile(path, data, 0644, osutil.AtomicWriteFlags(0)); err != nil {
+		return err
+	}
+
+	if s.ap == nil || !restart {
+		return nil
+	}
+
+	reason := ""
+	progress.step("Restart access point")
+	if err := s.restartAccessPoint(); err != nil {
+		reason = "Failed to restart AP process"
+	} else {
+		progress.step("Wait for access point to become healthy")
+		if err := s.waitUntilHealthy(); err != nil {
+			reason = err.Error()
+		} else {
+			return nil
+		}
+	}
+
+	log.Printf("Rolling back configuration change: %s", reason)
+	progress.step("Restore previous configuration")
+	if hadPrevious {
+		err = osutil.AtomicWriteFile(path, previous, 0644, osutil.AtomicWriteFlags(0))
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		log.Printf("Failed to restore previous configuration: %s", err)
+	}
+	if err := s.restartAccessPoint(); err != nil {
+		log.Printf("Failed to restart access point with previous configuration: %s", err)
+	}
+
+	return &rollbackError{reason: reason}
+}
+
+// errConfigurationBusy is returned when a configuration change is
+// requested while another one is still being applied.
+var errConfigurationBusy = fmt.Errorf("Another configuration change is in progress")
+
+// Number of steps a configuration change goes through if it succeeds
+const configurationSteps = 3
+
+// updateConfiguration replaces the system configuration with the given
+// one, restarts the access point with it and records the change in the
+// configuration history.
+func (s *service) updateConfiguration(config map[string]interface{}, uid *uint32) error {
+	if !s.configMutex.TryLock() {
+		return errConfigurationBusy
+	}
+	defer s.configMutex.Unlock()
+	return s.updateConfigurationLocked(config, uid, nil)
+}
+
+// updateConfigurationLocked does the work of updateConfiguration for
+// callers already holding the configuration lock and reports its steps
+// on the given change.
+func (s *service) updateConfigurationLocked(config map[string]interface{}, uid *uint32, progress *change) error {
+	previous, err := s.writeConfigurationLocked(config, progress)
+	if err != nil {
+		return err
+	}
+
+	// The configuration doesn't match any profile anymore
+	if err := setActiveProfile(""); err != nil {
+		log.Printf("Failed to reset active profile: %s", err)
+	}
+
+	if _, err := recordHistory(previous, config, uid); err != nil {
+		log.Printf("Failed to record configuration history: %s", err)
+	}
+
+	if err := mirrorSnapConfiguration(previous, config); err != nil {
+		log.Printf("Failed to update snap configuration: %s", err)
+	}
+
 	return nil
 }
 
+// writeConfigurationLocked replaces the system configuration with the
+// given one and restarts the access point if needed. Returns the
+// configuration which was replaced.
+func (s *service) writeConfigurationLocked(config map[string]interface{}, progress *change) (map[string]interface{}, error) {
+	configPath := getConfigOnPath(os.Getenv("SNAP_DATA"))
+	previous := make(map[string]interface{})
+	if readConfiguration([]string{configPath}, previous) != nil {
+		return nil, fmt.Errorf("Failed to read existing configuration file")
+	}
+
+	// Items like the access groups are picked up without a restart
+	restart := requiresRestart(changedKeys(previous, config))
+	if err := s.applyConfiguration(configPath, formatConfiguration(config), restart, progress); err != nil {
+		if _, ok := err.(*rollbackError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Can't write configuration file")
+	}
+
+	return previous, nil
+}
+
+// waitUntilHealthy waits for the access point to pass the local health
+// checks within the timeout given by the apply.timeout setting. Checks
+// depending on the uplink are left out as a device without one would
+// roll back every change otherwise.
+func (s *service) waitUntilHealthy() error {
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err != nil {
+		return err
+	}
+
+	timeout, err := strconv.Atoi(fmt.Sprint(config["apply.timeout"]))
+	if config["disabled"] == true || err != nil || timeout <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		report := checkAccessPointHealth(s)
+		if report.FailedLocally() == nil {
+			return nil
+		}
+		// hostapd only comes up after the channel availability check
+		cacEnd := s.status.cacEnd()
+		if radioEnd := s.radio2Status.cacEnd(); radioEnd.After(cacEnd) {
+			cacEnd = radioEnd
+		}
+		if cacEnd.Add(time.Duration(timeout) * time.Second).After(deadline) {
+			deadline = cacEnd.Add(time.Duration(timeout) * time.Second)
+		}
+		// No need to wait any longer when the access point is gone
+		if time.Now().After(deadline) || s.status.State() == apStateFailed || s.radio2Status.State() == apStateFailed {
+			if failed := report.FailedLocally(); failed != nil {
+				return fmt.Errorf("%s", failed.Message)
+			}
+			return fmt.Errorf("Access point did not become healthy")
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+func (s *service) accessPointExited(exit processExit) {
+	switch s.status.exited(exit) {
+	case apStateRunning:
+		log.Printf("Access point process terminated with exit code %d", exit.ExitCode)
+		fallthrough
+	case apStateStarting:
+		// The second radio joined the bridge of the access point which
+		// is gone now. When the service stops the access point it stops
+		// the radio itself.
+		if exit.Pid != s.ap.Pid() {
+			break
+		}
+		if err := s.stopRadio(); err != nil {
+			log.Printf("Failed to stop the second radio: %s", err)
+		}
+	}
+}
+
 func (s *service) Shutdown() {
 	log.Println("Shutting down ...")
-	s.listener.Close()
 	s.tomb.Kill(nil)
+	s.listener.Close()
+	if s.remoteListener != nil {
+		s.remoteListener.Close()
+	}
 	s.tomb.Wait()
 }
 
 func (s *service) Run() error {
 	s.addRoutes()
-	if err := s.setupAccesPoint(); err != nil {
+
+	// The schema lists the configuration items, the default
+	// configuration ap.sh sources their default values
+	validTokens = schemaTokens()
+	if err := checkDefaultConfiguration(filepath.Join(os.Getenv("SNAP"), "conf", "default-config")); err != nil {
 		return err
 	}
+	loadDefaultValues()
 
-	var err error
-	if validTokens, err = loadValidTokens(filepath.Join(os.Getenv("SNAP"), "conf", "default-config")); err != nil {
-		log.Println("Failed to read default configuration:", err)
+	// The access point has to come up with the snap configuration
+	s.importSnapConfiguration()
+
+	if err := s.setupAccesPoint(); err != nil {
+		return err
 	}
 
 	// Create the socket directory and remove any stale socket
@@ -124,11 +508,17 @@ func (s *service) Run() error {
 	}
 	os.Remove(path)
 
-	s.server = &http.Server{Handler: s.router}
+	s.server = &http.Server{Handler: s.router, ConnContext: saveConnInContext}
+	var err error
 	s.listener, err = net.Listen("unix", path)
 	if err != nil {
 		return err
 	}
+	// Everyone may connect, what a client is allowed to do is decided
+	// based on its credentials
+	if err := os.Chmod(path, 0666); err != nil {
+		return err
+	}
 
 	s.tomb.Go(func() error {
 		err := s.server.Serve(s.listener)
@@ -137,12 +527,21 @@ func (s *service) Run() error {
 		}
 		return nil
 	})
+	s.tomb.Go(s.runScheduler)
+
+	config := make(map[string]interface{})
+	if err := readConfiguration(configurationPaths, config); err == nil {
+		if address, _ := config["remote.address"].(string); len(address) > 0 {
+			// The local socket stays usable if remote management fails
+			if err := s.listenRemote(address); err != nil {
+				log.Printf("Failed to enable remote management: %s", err)
+			}
+		}
+	}
 
 	s.tomb.Wait()
 
-	if s.ap.Running() {
-		s.ap.Stop()
-	}
+	s.stopAccessPoint()
 
 	return nil
 }
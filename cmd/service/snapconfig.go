@@ -0,0 +1,378 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// runSnapctl runs snapctl with the given arguments and returns its
+// output.
+var runSnapctl = func(args ...string) ([]byte, error) {
+	output, err := exec.Command("snapctl", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("snapctl %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// snapConfigurationAvailable returns whether the service runs as part
+// of a snap and can access the snap configuration.
+var snapConfigurationAvailable = func() bool {
+	return len(os.Getenv("SNAP_NAME")) > 0
+}
+
+// flattenSnapConfiguration converts the nested document snapctl returns
+// into configuration items with dotted keys.
+func flattenSnapConfiguration(prefix string, document map[string]interface{}, config map[string]interface{}) {
+	for key, value := range document {
+		if len(prefix) > 0 {
+			key = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSnapConfiguration(key, nested, config)
+		} else {
+			config[key] = value
+		}
+	}
+}
+
+// readSnapConfiguration returns the items of the snap configuration
+// which are configuration items of the service.
+func readSnapConfiguration() (map[string]interface{}, error) {
+	output, err := runSnapctl("get", "-d")
+	if err != nil {
+		return nil, err
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(output, &document); err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]interface{})
+	flattenSnapConfiguration("", document, all)
+
+	config := make(map[string]interface{})
+	for key, value := range all {
+		if findSchemaItem(key) != nil {
+			config[key] = value
+		}
+	}
+	return config, nil
+}
+
+// importSnapConfiguration takes over items set with snap set while the
+// service was not running, like on installation when the configure hook
+// runs before the service starts. Invalid items are ignored.
+func (s *service) importSnapConfiguration() {
+	if !snapConfigurationAvailable() {
+		return
+	}
+
+	items, err := readSnapConfiguration()
+	if err != nil {
+		log.Printf("Failed to read snap configuration: %s", err)
+		return
+	}
+
+	path := getConfigOnPath(os.Getenv("SNAP_DATA"))
+	previous := make(map[string]interface{})
+	if err := readConfiguration([]string{path}, previous); err != nil {
+		log.Printf("Failed to read configuration: %s", err)
+		return
+	}
+
+	config := make(map[string]interface{})
+	for key, value := range previous {
+		config[key] = value
+	}
+	locked, err := readLockedKeys()
+	if err != nil {
+		log.Printf("Failed to read locked configuration items: %s", err)
+		return
+	}
+
+	for key, value := range items {
+		if err := validateConfigurationValue(key, value); err != nil {
+			log.Printf("Ignoring snap configuration item: %s", err)
+			continue
+		}
+		if isLockedKey(locked, key) {
+			log.Printf("Ignoring snap configuration item %q: locked", key)
+			continue
+		}
+		config[key] = fmt.Sprint(value)
+	}
+
+	changed := changedKeys(previous, config)
+	if len(changed) == 0 {
+		unsetSnapSecrets(items)
+		return
+	}
+
+	if field := validateDependencies(previous, config); field != nil {
+		log.Printf("Ignoring snap configuration: %s", field.Message)
+		return
+	}
+
+	log.Printf("Taking over snap configuration of %s", strings.Join(changed, ", "))
+	if err := osutil.AtomicWriteFile(path, formatConfiguration(config), 0644, osutil.AtomicWriteFlags(0)); err != nil {
+		log.Printf("Failed to write configuration: %s", err)
+		return
+	}
+	if _, err := recordHistory(previous, config, nil); err != nil {
+		log.Printf("Failed to record configuration history: %s", err)
+	}
+	unsetSnapSecrets(items)
+}
+
+// checkSnapConfiguration validates the items set with snap set while
+// the service is not running, as it would ignore invalid ones when it
+// takes them over. It is run by the configure hook so that snap set
+// fails on them like when the service is running.
+func checkSnapConfiguration() error {
+	if !snapConfigurationAvailable() {
+		return nil
+	}
+
+	items, err := readSnapConfiguration()
+	if err != nil {
+		return err
+	}
+
+	// The defaults are needed to check the channel configuration
+	if err := loadDefaultValues(); err != nil {
+		return err
+	}
+
+	config := make(map[string]interface{})
+	if err := readConfiguration([]string{getConfigOnPath(os.Getenv("SNAP_DATA"))}, config); err != nil {
+		return err
+	}
+	current := effectiveConfiguration(config)
+	previous := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		previous[key] = value
+	}
+
+	locked, err := readLockedKeys()
+	if err != nil {
+		return err
+	}
+
+	// Items which didn't change, like the ones mirrored back by the
+	// service, are fine
+	for key, value := range items {
+		if fmt.Sprint(current[key]) == fmt.Sprint(value) {
+			continue
+		}
+		if err := validateConfigurationValue(key, value); err != nil {
+			return err
+		}
+		if isLockedKey(locked, key) {
+			return fmt.Errorf(`Configuration item "%s" is locked`, key)
+		}
+		config[key] = fmt.Sprint(value)
+	}
+
+	if field := validateDependencies(previous, config); field != nil {
+		return fmt.Errorf("%s", field.Message)
+	}
+	return nil
+}
+
+// unsetSnapSecrets removes the secrets among the given items from the
+// snap configuration once they were taken over. They are not mirrored
+// back, so a secret left behind would revert a newer one later on.
+func unsetSnapSecrets(items map[string]interface{}) {
+	var keys []string
+	for key := range items {
+		if isSecretKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if _, err := runSnapctl(append([]string{"unset"}, keys...)...); err != nil {
+		log.Printf("Failed to remove secrets from snap configuration: %s", err)
+	}
+}
+
+// mirrorSnapConfiguration updates the snap configuration with the
+// changed items of the service configuration so that snap get shows
+// the same values. Secrets are not mirrored as everyone can read the
+// snap configuration.
+func mirrorSnapConfiguration(previous, config map[string]interface{}) error {
+	if !snapConfigurationAvailable() {
+		return nil
+	}
+
+	var set, unset []string
+	for _, key := range changedKeys(previous, config) {
+		if findSchemaItem(key) == nil || isSecretKey(key) {
+			continue
+		}
+		if value, ok := config[key]; ok {
+			set = append(set, key+"="+fmt.Sprint(value))
+		} else {
+			unset = append(unset, key)
+		}
+	}
+
+	if len(set) > 0 {
+		if _, err := runSnapctl(append([]string{"set"}, set...)...); err != nil {
+			return err
+		}
+	}
+	if len(unset) > 0 {
+		if _, err := runSnapctl(append([]string{"unset"}, unset...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockedKeysOption is the snap configuration option listing the
+// configuration items which must not be changed through the service.
+// It can only be set by a gadget snap or the administrator.
+const lockedKeysOption = "locked-keys"
+
+// readLockedKeys returns the configuration items locked through the
+// snap configuration, given either as a list or as a comma separated
+// string.
+func readLockedKeys() ([]string, error) {
+	if !snapConfigurationAvailable() {
+		return nil, nil
+	}
+
+	output, err := runSnapctl("get", "-d")
+	if err != nil {
+		return nil, err
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(output, &document); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	switch value := document[lockedKeysOption].(type) {
+	case string:
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); len(key) > 0 {
+				keys = append(keys, key)
+			}
+		}
+	case []interface{}:
+		for _, key := range value {
+			keys = append(keys, fmt.Sprint(key))
+		}
+	}
+	return keys, nil
+}
+
+func isLockedKey(locked []string, key string) bool {
+	for _, lockedKey := range locked {
+		if key == lockedKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isSecretKey(key string) bool {
+	for _, secret := range secretKeys {
+		if key == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// readGadgetDefaults returns the configuration items a gadget snap
+// provides below default.* in the snap configuration.
+func readGadgetDefaults() (map[string]interface{}, error) {
+	items := make(map[string]interface{})
+	if !snapConfigurationAvailable() {
+		return items, nil
+	}
+
+	output, err := runSnapctl("get", "-d")
+	if err != nil {
+		return nil, err
+	}
+
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(output, &document); err != nil {
+		return nil, err
+	}
+	if defaults, ok := document["default"].(map[string]interface{}); ok {
+		flattenSnapConfiguration("", defaults, items)
+	}
+	return items, nil
+}
+
+// applyGadgetDefaults writes the configuration items a gadget snap
+// provides below default.* into the system configuration. It is run
+// by the configure hook on installation, before the service starts,
+// and fails on unknown or invalid items.
+func applyGadgetDefaults() error {
+	items, err := readGadgetDefaults()
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	// The configure hook runs before the service loaded the defaults
+	// the items are checked against
+	if err := loadDefaultValues(); err != nil {
+		return err
+	}
+
+	path := getConfigOnPath(os.Getenv("SNAP_DATA"))
+	previous := make(map[string]interface{})
+	if err := readConfiguration([]string{path}, previous); err != nil {
+		return err
+	}
+	config := make(map[string]interface{}, len(previous))
+	for key, value := range previous {
+		config[key] = value
+	}
+
+	for key, value := range items {
+		if findSchemaItem(key) == nil {
+			return fmt.Errorf("Invalid gadget default default.%s: unknown configuration item", key)
+		}
+		if err := validateConfigurationValue(key, value); err != nil {
+			return fmt.Errorf("Invalid gadget default default.%s: %s", key, err)
+		}
+		config[key] = fmt.Sprint(value)
+	}
+
+	if field := validateDependencies(previous, config); field != nil {
+		return fmt.Errorf("Invalid gadget defaults: %s", field.Message)
+	}
+
+	return osutil.AtomicWriteFile(path, formatConfiguration(config), 0644, osutil.AtomicWriteFlags(0))
+}
@@ -0,0 +1,261 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+// mockSnapctl replaces snapctl with a function returning the given
+// configuration document and recording all calls.
+func mockSnapctl(document string) (calls *[]string, restore func()) {
+	oldRun, oldAvailable := runSnapctl, snapConfigurationAvailable
+	calls = &[]string{}
+	runSnapctl = func(args ...string) ([]byte, error) {
+		*calls = append(*calls, strings.Join(args, " "))
+		if args[0] == "get" {
+			return []byte(document), nil
+		}
+		return nil, nil
+	}
+	snapConfigurationAvailable = func() bool { return true }
+	return calls, func() {
+		runSnapctl, snapConfigurationAvailable = oldRun, oldAvailable
+	}
+}
+
+func (s *S) TestReadSnapConfiguration(c *check.C) {
+	_, restore := mockSnapctl(`{"wifi": {"ssid": "Depot", "channel": 11, "unknown": "x"}, "automatic-setup": {"disable": true}, "disabled": false}`)
+	defer restore()
+
+	config, err := readSnapConfiguration()
+	c.Assert(err, check.IsNil)
+	c.Assert(config, check.DeepEquals, map[string]interface{}{
+		"wifi.ssid":    "Depot",
+		"wifi.channel": float64(11),
+		"disabled":     false,
+	})
+}
+
+func (s *S) TestImportSnapConfiguration(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_SSID=Old\n"), 0644), check.IsNil)
+
+	calls, restore := mockSnapctl(`{"wifi": {"ssid": "Depot", "channel": 11, "security": "wep", "security-passphrase": "secret123"}}`)
+	defer restore()
+
+	svc := &service{}
+	svc.importSnapConfiguration()
+
+	// The invalid security is left out
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "WIFI_CHANNEL='11'\nWIFI_SECURITY_PASSPHRASE='secret123'\nWIFI_SSID='Depot'\n")
+
+	// The passphrase doesn't stay in the snap configuration
+	c.Assert((*calls)[len(*calls)-1], check.Equals, "unset wifi.security-passphrase")
+
+	entries, err := listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+
+	// Nothing to do once both agree
+	svc.importSnapConfiguration()
+	entries, err = listHistory()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+}
+
+func (s *S) TestMirrorSnapConfiguration(c *check.C) {
+	calls, restore := mockSnapctl(`{}`)
+	defer restore()
+
+	previous := map[string]interface{}{"wifi.ssid": "Old", "wifi.channel": "6", "debug": true}
+	config := map[string]interface{}{"wifi.ssid": "New", "wifi.security-passphrase": "secret", "debug": true}
+	c.Assert(mirrorSnapConfiguration(previous, config), check.IsNil)
+	c.Assert(*calls, check.DeepEquals, []string{
+		"set wifi.ssid=New",
+		"unset wifi.channel",
+	})
+
+	// Outside of a snap there is nothing to mirror
+	*calls = nil
+	snapConfigurationAvailable = func() bool { return false }
+	c.Assert(mirrorSnapConfiguration(previous, config), check.IsNil)
+	c.Assert(*calls, check.HasLen, 0)
+}
+
+func (s *S) TestApplyGadgetDefaults(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_SSID=Old\n"), 0644), check.IsNil)
+
+	_, restore := mockSnapctl(`{"default": {"wifi": {"ssid": "Gadget", "channel": 11, "country-code": "DE"}, "share": {"disabled": true}}, "automatic-setup": {"disable": false}}`)
+	c.Assert(applyGadgetDefaults(), check.IsNil)
+	restore()
+
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "SHARE_DISABLED='true'\nWIFI_CHANNEL='11'\nWIFI_COUNTRY_CODE='DE'\nWIFI_SSID='Gadget'\n")
+
+	// Nothing is written when the gadget provides an invalid item
+	_, restore = mockSnapctl(`{"default": {"wifi": {"ssid": "Other", "security": "wep"}}}`)
+	c.Assert(applyGadgetDefaults(), check.ErrorMatches, `Invalid gadget default default.wifi.security: .*`)
+	restore()
+
+	_, restore = mockSnapctl(`{"default": {"wifi": {"unknown": "x"}}}`)
+	c.Assert(applyGadgetDefaults(), check.ErrorMatches, `Invalid gadget default default.wifi.unknown: unknown configuration item`)
+	restore()
+
+	config, err = ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Matches, "(?s).*WIFI_SSID='Gadget'\n")
+
+	// Items only valid together with the default values of other items
+	// are accepted without the service having loaded the defaults
+	os.Setenv("SNAP", "../..")
+	defaultValues = nil
+	_, restore = mockSnapctl(`{"default": {"wifi": {"channel-width": 40}, "radio2": {"disabled": false}}}`)
+	c.Assert(applyGadgetDefaults(), check.IsNil)
+	restore()
+	config, err = ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Matches, "(?s).*RADIO2_DISABLED='false'\n.*WIFI_CHANNEL_WIDTH='40'\n.*")
+
+	// Without gadget defaults the configuration stays untouched
+	_, restore = mockSnapctl(`{"automatic-setup": {"disable": false}}`)
+	defer restore()
+	c.Assert(applyGadgetDefaults(), check.IsNil)
+}
+
+func (s *S) TestReadLockedKeys(c *check.C) {
+	_, restore := mockSnapctl(`{"locked-keys": "wifi.channel, wifi.country-code"}`)
+	keys, err := readLockedKeys()
+	restore()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.DeepEquals, []string{"wifi.channel", "wifi.country-code"})
+
+	_, restore = mockSnapctl(`{"locked-keys": ["share.network-interface"]}`)
+	keys, err = readLockedKeys()
+	restore()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.DeepEquals, []string{"share.network-interface"})
+
+	_, restore = mockSnapctl(`{}`)
+	defer restore()
+	keys, err = readLockedKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 0)
+}
+
+func (s *S) TestLockedKeys(c *check.C) {
+	s.setUpConfiguration(c, "WIFI_CHANNEL=6\nWIFI_SSID=Depot\n")
+
+	_, restore := mockSnapctl(`{"locked-keys": "wifi.channel,wifi.country-code"}`)
+	defer restore()
+
+	// Changing a locked item is rejected
+	req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "11", "wifi.ssid": "Other"}`))
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	postConfiguration(cmd, rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusForbidden)
+
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "locked-key")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.channel": `Configuration item "wifi.channel" is locked`,
+	})
+
+	// Setting it to its current value or changing others is fine
+	req, err = http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(`{"wifi.channel": "6", "wifi.ssid": "Other"}`))
+	c.Assert(err, check.IsNil)
+	rec = httptest.NewRecorder()
+	postConfiguration(cmd, rec, req)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	// The schema tells which items are locked
+	req, err = http.NewRequest(http.MethodGet, "/v1/schema", nil)
+	c.Assert(err, check.IsNil)
+	rec = httptest.NewRecorder()
+	getSchema(cmd, rec, req)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	locked := []string{}
+	for _, entry := range resp.Result["items"].([]interface{}) {
+		item := entry.(map[string]interface{})
+		if item["locked"] == true {
+			locked = append(locked, item["key"].(string))
+		}
+	}
+	c.Assert(locked, check.DeepEquals, []string{"wifi.channel", "wifi.country-code"})
+}
+
+func (s *S) TestResetKeepsLockedKeysAndGadgetDefaults(c *check.C) {
+	dir := c.MkDir()
+	os.Setenv("SNAP_DATA", dir)
+	c.Assert(ioutil.WriteFile(getConfigOnPath(dir), []byte("WIFI_CHANNEL=6\nWIFI_COUNTRY_CODE=DE\nWIFI_SSID=Other\n"), 0644), check.IsNil)
+
+	_, restore := mockSnapctl(`{"locked-keys": "wifi.country-code,wifi.security", "default": {"wifi": {"ssid": "Gadget", "country-code": "US", "security": "wpa2"}}}`)
+	defer restore()
+
+	req, err := http.NewRequest(http.MethodDelete, "/v1/configuration", nil)
+	c.Assert(err, check.IsNil)
+	rec := httptest.NewRecorder()
+	cmd := newMockServiceCommand()
+	deleteConfiguration(cmd, rec, req)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	// Locked items keep their value, even over a gadget default, and
+	// other items fall back to the gadget defaults
+	config, err := ioutil.ReadFile(getConfigOnPath(dir))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(config), check.Equals, "WIFI_COUNTRY_CODE='DE'\nWIFI_SSID='Gadget'\n")
+}
+
+func (s *S) TestCheckSnapConfiguration(c *check.C) {
+	s.setUpConfiguration(c, "WIFI_CHANNEL=6\n")
+	os.Setenv("SNAP", "../..")
+
+	for document, expected := range map[string]string{
+		`{"wifi": {"channel": 11, "ssid": "Depot"}}`:                "",
+		`{"wifi": {"channel": 999}}`:                                `Channel 999 .*`,
+		`{"wifi": {"security": "wep"}}`:                             `Invalid value "wep" for "wifi.security": .*`,
+		`{"wifi": {"channel": 11}, "locked-keys": "wifi.channel"}`:  `Configuration item "wifi.channel" is locked`,
+		`{"wifi": {"channel": "6"}, "locked-keys": "wifi.channel"}`: "",
+		`{"wifi": {"ssid": "Ubuntu"}, "locked-keys": "wifi.ssid"}`:  "",
+	} {
+		_, restore := mockSnapctl(document)
+		err := checkSnapConfiguration()
+		restore()
+		if len(expected) == 0 {
+			c.Assert(err, check.IsNil, check.Commentf(document))
+		} else {
+			c.Assert(err, check.ErrorMatches, expected, check.Commentf(document))
+		}
+	}
+}
@@ -0,0 +1,316 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type apState string
+
+// The states the access point goes through during its lifetime
+const (
+	apStateDisabled apState = "disabled"
+	apStateStarting apState = "starting"
+	apStateRunning  apState = "running"
+	apStateStopping apState = "stopping"
+	apStateFailed   apState = "failed"
+)
+
+// Number of state transitions we keep in the history
+const maxStateHistory = 20
+
+type apTransition struct {
+	From   apState   `json:"from"`
+	To     apState   `json:"to"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// apStatus tracks the lifecycle of the access point. The zero value
+// is a disabled access point.
+type apStatus struct {
+	mutex     sync.Mutex
+	state     apState
+	since     time.Time
+	pid       int
+	exitCode  *int
+	lastExit  *processExit
+	lastError string
+	ssid      string
+	channel   string
+	selection *channelSelection
+	iface     string
+	history   []apTransition
+	dfs       *dfsStatus
+	lastRadar *radarDetection
+}
+
+// State returns the current state of the access point.
+func (s *apStatus) State() apState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.currentState()
+}
+
+func (s *apStatus) currentState() apState {
+	if s.state == "" {
+		return apStateDisabled
+	}
+	return s.state
+}
+
+// transition moves the access point into a new state and records
+// the change in the history.
+func (s *apStatus) transition(to apState, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transitionLocked(to, reason)
+}
+
+func (s *apStatus) transitionLocked(to apState, reason string) {
+	from := s.currentState()
+	if from == to && s.state != "" {
+		return
+	}
+
+	s.state = to
+	s.since = time.Now()
+	s.history = append(s.history, apTransition{
+		From:   from,
+		To:     to,
+		Time:   s.since,
+		Reason: reason,
+	})
+	if len(s.history) > maxStateHistory {
+		s.history = s.history[len(s.history)-maxStateHistory:]
+	}
+}
+
+// launched records that a new access point process was started
+// with the given effective settings.
+func (s *apStatus) launched(pid int, disabled bool, ssid, channel, iface string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pid = pid
+	s.ssid = ssid
+	s.channel = channel
+	s.iface = iface
+	s.dfs = nil
+
+	if disabled {
+		s.transitionLocked(apStateDisabled, "Access point is disabled in the configuration")
+	} else {
+		s.lastError = ""
+		s.transitionLocked(apStateStarting, "")
+	}
+
+	// The process may have already terminated before we got here
+	if s.lastExit != nil && s.lastExit.Pid == pid {
+		s.applyExitLocked()
+	}
+}
+
+// channelSelected records the outcome of the automatic channel
+// selection for the next start or nil if the channel is static.
+func (s *apStatus) channelSelected(selection *channelSelection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.selection = selection
+}
+
+// current returns whether the access point process with the given pid
+// is the one starting or running the access point.
+func (s *apStatus) current(pid int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.currentState()
+	return s.pid == pid && (state == apStateStarting || state == apStateRunning)
+}
+
+// cacStarted records that hostapd of the process with the given pid
+// checks the channel for radar before operating on it.
+func (s *apStatus) cacStarted(pid, channel int, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid {
+		return
+	}
+	s.dfs = &dfsStatus{State: dfsStateCAC, Channel: channel, CACEnd: time.Now().Add(duration)}
+}
+
+// cacFinished records the outcome of the channel availability check.
+func (s *apStatus) cacFinished(pid int, success bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid || s.dfs == nil {
+		return
+	}
+	s.dfs.State = dfsStateAvailable
+	if !success {
+		s.dfs.State = dfsStateCACFailed
+	}
+	s.dfs.CACEnd = time.Time{}
+}
+
+// radarDetected records radar on the given channel and whether the
+// access point falls back to a channel without DFS.
+func (s *apStatus) radarDetected(pid, channel int, fallback bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid {
+		return
+	}
+	s.lastRadar = &radarDetection{Time: time.Now(), Channel: channel, Fallback: fallback}
+	if s.dfs != nil {
+		s.dfs.State = dfsStateRadarDetected
+		s.dfs.CACEnd = time.Time{}
+	}
+}
+
+// channelMoved records that hostapd switched to the given channel
+// after radar was detected.
+func (s *apStatus) channelMoved(pid, channel int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid {
+		return
+	}
+	s.channel = strconv.Itoa(channel)
+	s.dfs = nil
+	if isDFSChannel(channel) {
+		s.dfs = &dfsStatus{State: dfsStateAvailable, Channel: channel}
+	}
+}
+
+// cacEnd returns when the running channel availability check ends or
+// the zero time if there is none.
+func (s *apStatus) cacEnd() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dfs == nil {
+		return time.Time{}
+	}
+	return s.dfs.CACEnd
+}
+
+// radarFallback returns whether the access point has to avoid DFS
+// channels as radar was detected within the non-occupancy period.
+func (s *apStatus) radarFallback() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastRadar != nil && s.lastRadar.Fallback && time.Since(s.lastRadar.Time) < nonOccupancyPeriod
+}
+
+// running marks the access point as up but only if it is still
+// starting the process with the given pid.
+func (s *apStatus) running(pid int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid || s.currentState() != apStateStarting {
+		return false
+	}
+	s.transitionLocked(apStateRunning, "")
+	return true
+}
+
+// failed marks the access point as failed for the given reason if
+// the process with the given pid is still the current one.
+func (s *apStatus) failed(pid int, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pid != pid {
+		return
+	}
+	s.lastError = reason
+	s.transitionLocked(apStateFailed, reason)
+}
+
+// exited records the termination of an access point process and
+// returns the state the access point was in before.
+func (s *apStatus) exited(exit processExit) apState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.currentState()
+	s.lastExit = &exit
+	if exit.Pid == s.pid {
+		s.applyExitLocked()
+	}
+	return previous
+}
+
+func (s *apStatus) applyExitLocked() {
+	code := s.lastExit.ExitCode
+	s.exitCode = &code
+
+	switch s.currentState() {
+	case apStateStarting, apStateRunning:
+		reason := lastErrorLine(s.lastExit.Output)
+		if len(reason) == 0 {
+			reason = fmt.Sprintf("Access point process terminated unexpectedly with exit code %d", code)
+		}
+		s.lastError = reason
+		s.transitionLocked(apStateFailed, reason)
+	case apStateStopping:
+		s.transitionLocked(apStateDisabled, "Access point was stopped")
+	}
+}
+
+// toMap returns the status in the format used by the REST API.
+func (s *apStatus) toMap() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.currentState()
+	status := map[string]interface{}{
+		"ap.state":      string(state),
+		"ap.uptime":     0,
+		"ap.pid":        0,
+		"ap.last-error": s.lastError,
+		"ap.ssid":       s.ssid,
+		"ap.channel":    s.channel,
+		"ap.interface":  s.iface,
+		"ap.history":    append([]apTransition{}, s.history...),
+	}
+
+	if !s.since.IsZero() {
+		status["ap.state-since"] = s.since.Format(time.RFC3339)
+	}
+	if state == apStateRunning {
+		status["ap.uptime"] = int(time.Since(s.since).Seconds())
+	}
+	if state == apStateStarting || state == apStateRunning || state == apStateStopping {
+		status["ap.pid"] = s.pid
+	}
+	if s.exitCode != nil {
+		status["ap.last-exit-code"] = *s.exitCode
+	}
+	if s.selection != nil {
+		status["ap.channel-selection"] = s.selection.toMap()
+	}
+	if s.dfs != nil {
+		status["ap.dfs"] = s.dfs.toMap()
+	}
+	if s.lastRadar != nil {
+		status["ap.last-radar"] = s.lastRadar.toMap()
+	}
+
+	return status
+}
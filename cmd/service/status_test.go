@@ -0,0 +1,93 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestStatusDefaultsToDisabled(c *check.C) {
+	var status apStatus
+	c.Assert(status.State(), check.Equals, apStateDisabled)
+
+	m := status.toMap()
+	c.Assert(m["ap.state"], check.Equals, "disabled")
+	c.Assert(m["ap.pid"], check.Equals, 0)
+	c.Assert(m["ap.history"], check.HasLen, 0)
+}
+
+func (s *S) TestStatusLifecycle(c *check.C) {
+	var status apStatus
+
+	status.launched(42, false, "Ubuntu", "6", "wlan0")
+	c.Assert(status.State(), check.Equals, apStateStarting)
+	c.Assert(status.running(41), check.Equals, false)
+	c.Assert(status.running(42), check.Equals, true)
+	c.Assert(status.State(), check.Equals, apStateRunning)
+	c.Assert(status.toMap()["ap.pid"], check.Equals, 42)
+
+	status.transition(apStateStopping, "")
+	c.Assert(status.exited(processExit{Pid: 42, ExitCode: 0}), check.Equals, apStateStopping)
+	c.Assert(status.State(), check.Equals, apStateDisabled)
+
+	m := status.toMap()
+	c.Assert(m["ap.last-exit-code"], check.Equals, 0)
+	c.Assert(m["ap.last-error"], check.Equals, "")
+	c.Assert(m["ap.history"], check.HasLen, 4)
+}
+
+func (s *S) TestStatusFailureReason(c *check.C) {
+	var status apStatus
+
+	status.launched(42, false, "Ubuntu", "6", "wlan0")
+	status.exited(processExit{
+		Pid:      42,
+		ExitCode: 1,
+		Output:   []string{"ERROR: WiFi interface wlan0 is not available!", "done"},
+	})
+
+	c.Assert(status.State(), check.Equals, apStateFailed)
+	m := status.toMap()
+	c.Assert(m["ap.last-exit-code"], check.Equals, 1)
+	c.Assert(m["ap.last-error"], check.Equals, "WiFi interface wlan0 is not available!")
+
+	status.launched(43, false, "Ubuntu", "6", "wlan0")
+	status.exited(processExit{Pid: 43, ExitCode: 0})
+	c.Assert(status.toMap()["ap.last-error"], check.Equals,
+		"Access point process terminated unexpectedly with exit code 0")
+}
+
+func (s *S) TestStatusExitBeforeLaunch(c *check.C) {
+	var status apStatus
+
+	// The process can terminate before we recorded its launch
+	status.exited(processExit{Pid: 42, ExitCode: 1})
+	status.launched(42, false, "Ubuntu", "6", "wlan0")
+	c.Assert(status.State(), check.Equals, apStateFailed)
+}
+
+func (s *S) TestStatusHistoryIsBounded(c *check.C) {
+	var status apStatus
+
+	for n := 0; n < maxStateHistory; n++ {
+		status.transition(apStateStarting, "")
+		status.transition(apStateFailed, "")
+	}
+
+	history := status.toMap()["ap.history"].([]apTransition)
+	c.Assert(history, check.HasLen, maxStateHistory)
+	c.Assert(history[len(history)-1].To, check.Equals, apStateFailed)
+}
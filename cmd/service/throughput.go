@@ -0,0 +1,257 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Capabilities hostapd takes in ht_capab and vht_capab format
+var capabilitiesPattern = regexp.MustCompile(`^(\[[A-Z0-9+-]+\])*$`)
+
+// textValue returns the text of a configuration item or the fallback
+// if it is not set.
+func textValue(config map[string]interface{}, key, fallback string) string {
+	if value, ok := config[key]; ok {
+		return fmt.Sprint(value)
+	}
+	return fallback
+}
+
+func isEnabled(config map[string]interface{}, key string) bool {
+	return fmt.Sprint(config[key]) == "true"
+}
+
+// channelWidth returns the configured channel width in MHz.
+func channelWidth(config map[string]interface{}) int {
+	if width, err := strconv.Atoi(fmt.Sprint(config["wifi.channel-width"])); err == nil {
+		return width
+	}
+	return 20
+}
+
+// secondaryChannelAbove returns whether the secondary channel of a
+// 40 MHz wide channel lies above the primary one. The pairs of channels
+// are fixed on 5 GHz. Has to match secondary_channel_position in
+// helper.sh.
+func secondaryChannelAbove(operationMode string, channel int, secondary string) bool {
+	if operationMode == "a" {
+		first := 36
+		if channel >= 149 {
+			first = 149
+		}
+		return (channel-first)/4%2 == 0
+	}
+	if secondary == "auto" {
+		return channel <= 7
+	}
+	return secondary == "above"
+}
+
+// centerChannel returns the channel in the center of the 80 or 160 MHz
+// wide channel on 5 GHz the given channel belongs to. Has to match
+// center_channel in helper.sh.
+func centerChannel(channel, width int) int {
+	first := 36
+	if channel >= 149 {
+		first = 149
+	}
+	// Number of 20 MHz channels in the wide channel
+	count := width / 20
+	start := first + (channel-first)/(count*4)*(count*4)
+	return start + (count-1)*2
+}
+
+// occupiedChannels returns the 20 MHz channels the given channel
+// occupies with the configured width.
+func occupiedChannels(config map[string]interface{}, channel int) []int {
+	switch width := channelWidth(config); width {
+	case 40:
+		if secondaryChannelAbove(fmt.Sprint(config["wifi.operation-mode"]), channel,
+			textValue(config, "wifi.secondary-channel", "auto")) {
+			return []int{channel, channel + 4}
+		}
+		return []int{channel - 4, channel}
+	case 80, 160:
+		center, err := strconv.Atoi(fmt.Sprint(config["wifi.center-channel"]))
+		if err != nil {
+			center = centerChannel(channel, width)
+		}
+		var channels []int
+		for occupied := center - (width/20-1)*2; occupied <= center+(width/20-1)*2; occupied += 4 {
+			channels = append(channels, occupied)
+		}
+		return channels
+	}
+	return []int{channel}
+}
+
+// validateCapabilities checks the value of an item taking hostapd
+// capabilities.
+func validateCapabilities(key, text string) error {
+	switch key {
+	case "wifi.ht-capabilities", "wifi.vht-capabilities":
+		if !capabilitiesPattern.MatchString(text) {
+			return fmt.Errorf("Invalid value %q for %q: must be capabilities like [SHORT-GI-20][RX-STBC1]", text, key)
+		}
+		if strings.Contains(text, "[HT40") {
+			return fmt.Errorf("Invalid value %q for %q: use wifi.channel-width and wifi.secondary-channel for 40 MHz wide channels",
+				text, key)
+		}
+	}
+	return nil
+}
+
+// validateThroughput checks that the 802.11n/ac settings of the given
+// effective configuration fit together.
+func validateThroughput(config map[string]interface{}) *fieldError {
+	operationMode := fmt.Sprint(config["wifi.operation-mode"])
+	ht := isEnabled(config, "wifi.ieee80211n")
+	vht := isEnabled(config, "wifi.ieee80211ac")
+	width := channelWidth(config)
+
+	switch {
+	case vht && operationMode != "a":
+		return &fieldError{"wifi.ieee80211ac", "802.11ac requires operation mode a"}
+	case vht && !ht:
+		return &fieldError{"wifi.ieee80211n", "802.11ac requires wifi.ieee80211n"}
+	case width > 20 && !ht:
+		return &fieldError{"wifi.channel-width", fmt.Sprintf("A channel width of %d MHz requires wifi.ieee80211n", width)}
+	case width > 20 && operationMode != "a" && operationMode != "g":
+		return &fieldError{"wifi.channel-width", fmt.Sprintf("A channel width of %d MHz requires operation mode a or g", width)}
+	case width > 40 && operationMode != "a":
+		return &fieldError{"wifi.channel-width", fmt.Sprintf("A channel width of %d MHz requires operation mode a", width)}
+	case width > 40 && !vht:
+		return &fieldError{"wifi.channel-width", fmt.Sprintf("A channel width of %d MHz requires wifi.ieee80211ac", width)}
+	case width < 80 && textValue(config, "wifi.center-channel", autoChannel) != autoChannel:
+		return &fieldError{"wifi.center-channel", "wifi.center-channel only applies to channel widths of 80 and 160 MHz"}
+	}
+
+	channel, err := strconv.Atoi(fmt.Sprint(config["wifi.channel"]))
+	if err != nil {
+		return nil
+	}
+
+	secondary := textValue(config, "wifi.secondary-channel", "auto")
+	if width > 20 && operationMode == "a" && secondary != "auto" &&
+		secondaryChannelAbove(operationMode, channel, secondary) != (secondary == "above") {
+		position := "below"
+		if secondaryChannelAbove(operationMode, channel, secondary) {
+			position = "above"
+		}
+		return &fieldError{"wifi.secondary-channel",
+			fmt.Sprintf("Channel %d pairs with the channel %s it on 5 GHz", channel, position)}
+	}
+
+	if !containsChannel(occupiedChannels(config, channel), channel) {
+		return &fieldError{"wifi.center-channel",
+			fmt.Sprintf("Channel %d is not part of the %d MHz wide channel around channel %v",
+				channel, width, config["wifi.center-channel"])}
+	}
+	return nil
+}
+
+// Items validateChannelConfiguration depends on
+var channelKeys = []string{
+	"wifi.interface", "wifi.interface-mode", "wifi.channel", "wifi.operation-mode",
+	"wifi.country-code", "wifi.ieee80211n", "wifi.ieee80211ac", "wifi.channel-width",
+	"wifi.secondary-channel", "wifi.center-channel",
+	"radio2.disabled", "radio2.interface", "radio2.channel", "radio2.operation-mode",
+	"radio2.channel-width", "radio2.ieee80211ac",
+}
+
+// validateChannelConfiguration checks the channel related items of the
+// given effective configuration against each other and the regulatory
+// domain, for the access point and the second radio.
+func validateChannelConfiguration(config map[string]interface{}) *fieldError {
+	if field := validateThroughput(config); field != nil {
+		return field
+	}
+	if field := validateRegulatory(config); field != nil {
+		return field
+	}
+	return validateRadio(config)
+}
+
+// Items the hardware has to support when they change
+var throughputKeys = []string{
+	"wifi.interface", "wifi.operation-mode", "wifi.channel-width", "wifi.ieee80211ac",
+}
+
+// throughputChanged returns whether the effective configuration asks
+// for more than 802.11n with 20 MHz wide channels, which every device
+// supports, and changed in a way the hardware has to be checked for.
+func throughputChanged(previous, config map[string]interface{}) bool {
+	if channelWidth(config) == 20 && !isEnabled(config, "wifi.ieee80211ac") {
+		return false
+	}
+	for _, key := range throughputKeys {
+		if fmt.Sprint(previous[key]) != fmt.Sprint(config[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateThroughputHardware checks that the device supports the
+// 802.11n/ac settings of the given effective configuration.
+func validateThroughputHardware(phy *wirelessPhy, config map[string]interface{}) *fieldError {
+	iface := fmt.Sprint(config["wifi.interface"])
+	name := "2.4GHz"
+	if config["wifi.operation-mode"] == "a" {
+		name = "5GHz"
+	}
+
+	var band *phyBand
+	for n := range phy.Bands {
+		if phy.Bands[n].Band == name {
+			band = &phy.Bands[n]
+		}
+	}
+	if band == nil {
+		return &fieldError{"wifi.operation-mode",
+			fmt.Sprintf("Interface %s (%s) does not support the %s band", iface, phy.Name, name)}
+	}
+
+	width := channelWidth(config)
+	supportsWidth := true
+	switch {
+	case width == 40:
+		supportsWidth = containsString(band.HT, "HT20/HT40")
+	case width == 80:
+		supportsWidth = band.VHT != nil
+	case width == 160:
+		supportsWidth = false
+		for _, capability := range band.VHT {
+			if strings.HasPrefix(capability, "Supported Channel Width: 160") {
+				supportsWidth = true
+			}
+		}
+	}
+
+	switch {
+	case !supportsWidth:
+		return &fieldError{"wifi.channel-width",
+			fmt.Sprintf("Interface %s (%s) does not support %d MHz wide channels on %s", iface, phy.Name, width, name)}
+	case isEnabled(config, "wifi.ieee80211ac") && band.VHT == nil:
+		return &fieldError{"wifi.ieee80211ac",
+			fmt.Sprintf("Interface %s (%s) does not support 802.11ac on %s", iface, phy.Name, name)}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (C) 2017 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestWideChannels(c *check.C) {
+	c.Assert(secondaryChannelAbove("g", 6, "auto"), check.Equals, true)
+	c.Assert(secondaryChannelAbove("g", 11, "auto"), check.Equals, false)
+	c.Assert(secondaryChannelAbove("g", 6, "below"), check.Equals, false)
+	c.Assert(secondaryChannelAbove("a", 36, "below"), check.Equals, true)
+	c.Assert(secondaryChannelAbove("a", 40, "auto"), check.Equals, false)
+	c.Assert(secondaryChannelAbove("a", 157, "auto"), check.Equals, true)
+
+	c.Assert(centerChannel(44, 80), check.Equals, 42)
+	c.Assert(centerChannel(112, 80), check.Equals, 106)
+	c.Assert(centerChannel(161, 80), check.Equals, 155)
+	c.Assert(centerChannel(60, 160), check.Equals, 50)
+	c.Assert(centerChannel(100, 160), check.Equals, 114)
+
+	config := map[string]interface{}{"wifi.operation-mode": "a", "wifi.channel-width": "80"}
+	c.Assert(occupiedChannels(config, 44), check.DeepEquals, []int{36, 40, 44, 48})
+	config["wifi.channel-width"] = 40.0
+	c.Assert(occupiedChannels(config, 44), check.DeepEquals, []int{44, 48})
+	config = map[string]interface{}{"wifi.operation-mode": "g", "wifi.channel-width": "40", "wifi.secondary-channel": "below"}
+	c.Assert(occupiedChannels(config, 6), check.DeepEquals, []int{2, 6})
+}
+
+func (s *S) TestValidateThroughput(c *check.C) {
+	for _, t := range []struct {
+		config map[string]interface{}
+		field  string
+	}{
+		{map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "g", "wifi.ieee80211n": true, "wifi.channel-width": "40"}, ""},
+		{map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "g", "wifi.ieee80211n": false, "wifi.channel-width": "40"}, "wifi.channel-width"},
+		{map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "b", "wifi.ieee80211n": true, "wifi.channel-width": "40"}, "wifi.channel-width"},
+		{map[string]interface{}{"wifi.channel": "6", "wifi.operation-mode": "g", "wifi.ieee80211n": true, "wifi.ieee80211ac": true}, "wifi.ieee80211ac"},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": false, "wifi.ieee80211ac": true}, "wifi.ieee80211n"},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": true, "wifi.channel-width": "80"}, "wifi.channel-width"},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": true, "wifi.ieee80211ac": true,
+			"wifi.channel-width": "80"}, ""},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": true, "wifi.ieee80211ac": true,
+			"wifi.channel-width": "80", "wifi.center-channel": "58"}, "wifi.center-channel"},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": true,
+			"wifi.center-channel": "42"}, "wifi.center-channel"},
+		{map[string]interface{}{"wifi.channel": "36", "wifi.operation-mode": "a", "wifi.ieee80211n": true, "wifi.channel-width": "40",
+			"wifi.secondary-channel": "below"}, "wifi.secondary-channel"},
+	} {
+		field := validateThroughput(t.config)
+		if len(t.field) == 0 {
+			c.Assert(field, check.IsNil, check.Commentf("%v", t.config))
+		} else {
+			c.Assert(field, check.NotNil, check.Commentf("%v", t.config))
+			c.Assert(field.Field, check.Equals, t.field)
+		}
+	}
+
+	// The whole width has to be allowed in the country
+	config := map[string]interface{}{"wifi.channel": "11", "wifi.operation-mode": "g", "wifi.ieee80211n": true,
+		"wifi.channel-width": "40", "wifi.secondary-channel": "above", "wifi.country-code": "US"}
+	c.Assert(validateChannelConfiguration(config).Message, check.Equals,
+		"Channel 11 with a width of 40 MHz occupies channel 15 which is not allowed with operation mode g in US")
+	config = map[string]interface{}{"wifi.channel": "auto", "wifi.operation-mode": "a", "wifi.ieee80211n": true,
+		"wifi.ieee80211ac": true, "wifi.channel-width": "160", "wifi.country-code": "US"}
+	c.Assert(validateChannelConfiguration(config).Message, check.Equals,
+		"No channel of operation mode a with a width of 160 MHz and without DFS is allowed in US")
+
+	c.Assert(validateConfigurationValue("wifi.ht-capabilities", "[SHORT-GI-20][RX-STBC1]"), check.IsNil)
+	c.Assert(validateConfigurationValue("wifi.ht-capabilities", "[HT40+]"), check.NotNil)
+	c.Assert(validateConfigurationValue("wifi.vht-capabilities", "SHORT-GI-80"), check.NotNil)
+	c.Assert(validateConfigurationValue("wifi.center-channel", "middle"), check.NotNil)
+	c.Assert(validateConfigurationValue("wifi.channel-width", 60.0), check.NotNil)
+}
+
+func (s *S) TestThroughputHardwareValidation(c *check.C) {
+	defer mockIwHardware(iwListOutput, iwDevOutput)()
+
+	s.setUpConfiguration(c, "WIFI_INTERFACE=wlan0\nWIFI_OPERATION_MODE=a\nWIFI_CHANNEL=36\nWIFI_COUNTRY_CODE=DE\n")
+
+	cmd := newMockServiceCommand()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/v1/configuration", strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		rec := httptest.NewRecorder()
+		postConfiguration(cmd, rec, req)
+		return rec
+	}
+
+	// The device only supports up to 80 MHz
+	rec := post(`{"wifi.ieee80211ac": true, "wifi.channel-width": 160}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	var resp serviceResponse
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.channel-width": "Interface wlan0 (phy0) does not support 160 MHz wide channels on 5GHz",
+	})
+
+	// 802.11ax is not available with the hostapd of the snap so there
+	// is no item for it
+	rec = post(`{"wifi.ieee80211ac": true, "wifi.ieee80211ax": true, "wifi.channel-width": 80}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["kind"], check.Equals, "invalid-key")
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.ieee80211ax": `Invalid key "wifi.ieee80211ax"`,
+	})
+
+	rec = post(`{"wifi.ieee80211ac": true, "wifi.channel-width": 80}`)
+	change := waitForChange(c, cmd, rec)
+	c.Assert(change["status"], check.Equals, changeDone)
+
+	// Without VHT support on 2.4 GHz
+	rec = post(`{"wifi.interface": "wlx0", "wifi.operation-mode": "g", "wifi.channel": "1", "wifi.ieee80211ac": false,
+		"wifi.channel-width": 40}`)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), check.IsNil)
+	c.Assert(resp.Result["details"], check.DeepEquals, map[string]interface{}{
+		"wifi.channel-width": "Interface wlx0 (phy1) does not support 40 MHz wide channels on 2.4GHz",
+	})
+}